@@ -1,4 +1,8 @@
-CREATE SEQUENCE 
+-- The full Red String schema, for reference. Databases are created and
+-- updated by the migrations in server/migrate (`go run main.go migrate`);
+-- keep this file in sync when adding one.
+
+CREATE SEQUENCE
 IF NOT EXISTS next_id
     START WITH 1
     INCREMENT BY 1
@@ -6,6 +10,22 @@ IF NOT EXISTS next_id
     NO MAXVALUE
     CACHE 1;
 
+-- sources record where each fact came from. See server/provenance.
+CREATE TABLE IF NOT EXISTS sources (
+    id text DEFAULT nextval('next_id') PRIMARY KEY,
+    -- source_type is one of airtable, file, cfb or manual
+    source_type text NOT NULL,
+    -- url cites the source
+    url text,
+    airtable_record_id text,
+    -- file is the imported file, e.g. the CFB filing export
+    file text,
+    cfb_refno text,
+    note text,
+    added_by text NOT NULL,
+    added_ts timestamp NOT NULL
+);
+
 CREATE TABLE IF NOT EXISTS individuals (
     id text DEFAULT nextval('next_id') PRIMARY KEY,
     first_name text NOT NULL,
@@ -18,42 +38,92 @@ CREATE TABLE IF NOT EXISTS individuals (
     updated_ts timestamp NOT NULL,
     role text,
     title text,
-    twitter text
+    twitter text,
+    notes text,
+    -- source_urls cite where the annotation came from
+    source_urls text[],
+    -- airtable_id is the Airtable record ID of the annotation
+    -- this individual was synced from, if any
+    airtable_id text UNIQUE,
+    source_id text REFERENCES sources (id)
     -- TODO: add other fields
 );
 
-CREATE TABLE IF NOT EXISTS associations (
+CREATE INDEX IF NOT EXISTS individuals_cfb_name_idx ON individuals (cfb_name);
+CREATE INDEX IF NOT EXISTS individuals_first_name_last_name_idx ON individuals (first_name, last_name);
+
+CREATE TABLE IF NOT EXISTS categories (
     id text DEFAULT nextval('next_id') PRIMARY KEY,
     description text NOT NULL,
-    category_id text
+    -- airtable_id is the Airtable record ID of the category
+    -- this was synced from, if any
+    airtable_id text UNIQUE
 );
 
-CREATE TABLE IF NOT EXISTS categories (
+CREATE TABLE IF NOT EXISTS associations (
     id text DEFAULT nextval('next_id') PRIMARY KEY,
-    description text NOT NULL
+    description text NOT NULL,
+    -- category_id is the association's primary category. All of
+    -- an association's categories are in association_categories.
+    category_id text REFERENCES categories (id) ON DELETE SET NULL,
+    source_id text REFERENCES sources (id)
+);
+
+CREATE INDEX IF NOT EXISTS associations_description_idx ON associations (description);
+CREATE INDEX IF NOT EXISTS associations_category_id_idx ON associations (category_id);
+
+CREATE TABLE IF NOT EXISTS association_categories (
+    association_id text NOT NULL REFERENCES associations (id) ON DELETE CASCADE,
+    category_id text NOT NULL REFERENCES categories (id) ON DELETE CASCADE,
+    updated_ts timestamp NOT NULL,
+    PRIMARY KEY (association_id, category_id)
 );
 
+CREATE INDEX IF NOT EXISTS association_categories_category_id_idx ON association_categories (category_id);
+
 CREATE TABLE IF NOT EXISTS individual_associations (
-    individual_id text NOT NULL,
-    association_id text NOT NULL,
+    individual_id text NOT NULL REFERENCES individuals (id) ON DELETE CASCADE,
+    association_id text NOT NULL REFERENCES associations (id) ON DELETE CASCADE,
+    updated_ts timestamp NOT NULL,
+    source_id text REFERENCES sources (id),
+    -- dates the individual held the association, if known
+    start_date date,
+    end_date date,
+    PRIMARY KEY (individual_id, association_id)
+);
+
+CREATE INDEX IF NOT EXISTS individual_associations_association_id_idx ON individual_associations (association_id);
+
+-- individual_roles is the history of individuals' roles and titles.
+-- The current role has no end_date.
+CREATE TABLE IF NOT EXISTS individual_roles (
+    id text DEFAULT nextval('next_id') PRIMARY KEY,
+    individual_id text NOT NULL REFERENCES individuals (id) ON DELETE CASCADE,
+    role text,
+    title text,
+    start_date date,
+    end_date date,
+    source_id text REFERENCES sources (id),
     updated_ts timestamp NOT NULL
 );
 
+CREATE INDEX IF NOT EXISTS individual_roles_individual_id_idx ON individual_roles (individual_id);
+
 CREATE TABLE IF NOT EXISTS contributions (
     id text DEFAULT nextval('next_id') PRIMARY KEY,
     -- reference number from CFB
-    refno text NOT NULL,
+    refno text NOT NULL UNIQUE,
     -- amount denominated in cents
     amount integer NOT NULL,
     date timestamp NOT NULL,
     -- contributor_name as reported in CFB filing
     contributor_name text NOT NULL,
     -- contributor id (individuals table)
-    contributor_id text NOT NULL,
+    contributor_id text NOT NULL REFERENCES individuals (id),
     -- recipient_name as reported in CFB filing
     recipient_name text NOT NULL,
-    -- recipient id (individuals table)
-    recipient_id text,
+    -- recipient id (individuals table), NULL if unmatched
+    recipient_id text REFERENCES individuals (id),
     -- CFB gives each recipient a recipient ID, so note this.
     cfb_recipient_id text NOT NULL,
 
@@ -71,5 +141,194 @@ CREATE TABLE IF NOT EXISTS contributions (
     state text NOT NULL,
     zip text NOT NULL,
     occupation text,
-    employer_name text
+    employer_name text,
+
+    -- sources of the contributor and recipient matches
+    contributor_source_id text REFERENCES sources (id),
+    recipient_source_id text REFERENCES sources (id)
+);
+
+CREATE INDEX IF NOT EXISTS contributions_contributor_id_idx ON contributions (contributor_id);
+CREATE INDEX IF NOT EXISTS contributions_recipient_id_idx ON contributions (recipient_id);
+
+-- audit_runs are runs of commands that changed data, e.g. an
+-- annotations sync or CFB import.
+CREATE TABLE IF NOT EXISTS audit_runs (
+    id text DEFAULT nextval('next_id') PRIMARY KEY,
+    command text NOT NULL,
+    actor text NOT NULL,
+    started_ts timestamp NOT NULL
+);
+
+-- audit_log is an append-only log of changes to individual fields.
+-- Old and new values are NULL when the field was created or removed.
+CREATE TABLE IF NOT EXISTS audit_log (
+    id bigserial PRIMARY KEY,
+    run_id text NOT NULL REFERENCES audit_runs (id),
+    entity_type text NOT NULL,
+    entity_id text NOT NULL,
+    -- individual the change concerns, if any. Not a foreign key so
+    -- the history outlives the individual.
+    individual_id text,
+    field text NOT NULL,
+    old_value text,
+    new_value text,
+    actor text NOT NULL,
+    source_id text REFERENCES sources (id),
+    changed_ts timestamp NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS audit_log_individual_id_idx ON audit_log (individual_id);
+CREATE INDEX IF NOT EXISTS audit_log_run_id_idx ON audit_log (run_id);
+
+-- api_users may make changes through the API, authenticating with a
+-- token. Only a hash of the token is stored.
+CREATE TABLE IF NOT EXISTS api_users (
+    id text DEFAULT nextval('next_id') PRIMARY KEY,
+    name text NOT NULL UNIQUE,
+    -- one of viewer, editor or admin
+    role text NOT NULL CHECK (role IN ('viewer', 'editor', 'admin')),
+    token_hash text NOT NULL UNIQUE,
+    created_ts timestamp NOT NULL,
+    revoked_ts timestamp
+);
+
+-- individual_aliases are other names an individual is known by, e.g.
+-- the names of duplicates merged into them. CFB imports match
+-- contributions on them as well as individuals.cfb_name.
+CREATE TABLE IF NOT EXISTS individual_aliases (
+    id text DEFAULT nextval('next_id') PRIMARY KEY,
+    individual_id text NOT NULL REFERENCES individuals (id) ON DELETE CASCADE,
+    first_name text NOT NULL,
+    last_name text NOT NULL,
+    cfb_name text NOT NULL,
+    source_id text REFERENCES sources (id)
+);
+
+CREATE INDEX IF NOT EXISTS individual_aliases_individual_id_idx ON individual_aliases (individual_id);
+CREATE INDEX IF NOT EXISTS individual_aliases_cfb_name_idx ON individual_aliases (cfb_name);
+
+-- individual_redirects point the IDs of merged individuals at the
+-- individual they were merged into.
+CREATE TABLE IF NOT EXISTS individual_redirects (
+    from_id text PRIMARY KEY,
+    to_id text NOT NULL REFERENCES individuals (id) ON DELETE CASCADE
+);
+
+CREATE INDEX IF NOT EXISTS individual_redirects_to_id_idx ON individual_redirects (to_id);
+
+-- individual_merges record what each merge moved, so it can be
+-- undone by a split.
+CREATE TABLE IF NOT EXISTS individual_merges (
+    id text DEFAULT nextval('next_id') PRIMARY KEY,
+    from_id text NOT NULL,
+    into_id text NOT NULL,
+    -- the merged individual's row and individual_associations rows,
+    -- as JSON
+    individual json NOT NULL,
+    associations json NOT NULL,
+    -- IDs of rows moved or added by the merge
+    contributor_ids text[] NOT NULL,
+    recipient_ids text[] NOT NULL,
+    added_association_ids text[] NOT NULL,
+    role_ids text[] NOT NULL,
+    alias_ids text[] NOT NULL,
+    added_alias_id text,
+    redirect_ids text[] NOT NULL,
+    -- columns of into_id filled in from from_id
+    filled_columns text[] NOT NULL,
+    run_id text REFERENCES audit_runs (id),
+    merged_ts timestamp NOT NULL,
+    split_ts timestamp
+);
+
+CREATE INDEX IF NOT EXISTS individual_merges_from_id_idx ON individual_merges (from_id);
+
+-- api_keys identify API clients for rate limiting. Clients without
+-- a key share the anonymous limits. Only a hash of the key is stored.
+CREATE TABLE IF NOT EXISTS api_keys (
+    id text DEFAULT nextval('next_id') PRIMARY KEY,
+    name text NOT NULL,
+    key_hash text NOT NULL UNIQUE,
+    -- sustained request rate; up to a minute's worth may be made at once
+    rate_per_minute integer NOT NULL,
+    -- requests allowed per UTC day, NULL for no limit
+    daily_quota integer,
+    created_by text NOT NULL,
+    created_ts timestamp NOT NULL,
+    revoked_ts timestamp
+);
+
+-- data_version is a counter bumped whenever the data served by the
+-- API changes, to invalidate cached responses. It has a single row.
+CREATE TABLE IF NOT EXISTS data_version (
+    id boolean PRIMARY KEY DEFAULT true CHECK (id),
+    version bigint NOT NULL,
+    updated_ts timestamp NOT NULL
+);
+
+INSERT INTO data_version (version, updated_ts) VALUES (1, current_timestamp)
+ON CONFLICT DO NOTHING;
+
+-- job_runs records the runs of background jobs such as imports, by
+-- the server's scheduler or the redstring command.
+CREATE TABLE IF NOT EXISTS job_runs (
+    id text DEFAULT nextval('next_id') PRIMARY KEY,
+    job text NOT NULL,
+    -- target is what the run worked on, e.g. the file imported
+    target text,
+    -- checksum is the SHA-256 of the file the run worked on, if any
+    checksum text,
+    status text NOT NULL CHECK (status IN ('running', 'succeeded', 'failed')),
+    -- counts are the numbers of rows read or changed, by name
+    counts json NOT NULL,
+    error text,
+    started_ts timestamp NOT NULL,
+    finished_ts timestamp
+);
+
+CREATE INDEX IF NOT EXISTS job_runs_job_started_ts_idx ON job_runs (job, started_ts);
+
+-- cfb_downloads are the CFB exports downloaded by the fetcher, by
+-- the hash of their contents, so unchanged exports are skipped.
+CREATE TABLE IF NOT EXISTS cfb_downloads (
+    sha256 text PRIMARY KEY,
+    url text NOT NULL,
+    -- file is the name the export was stored under
+    file text NOT NULL,
+    size bigint NOT NULL,
+    downloaded_ts timestamp NOT NULL
+);
+
+-- cfb_imports are reports of the CFB imports run, with counts of the
+-- rows read and how well their names matched individuals.
+CREATE TABLE IF NOT EXISTS cfb_imports (
+    id text DEFAULT nextval('next_id') PRIMARY KEY,
+    file text NOT NULL,
+    status text NOT NULL CHECK (status IN ('running', 'succeeded', 'failed')),
+    rows_read integer NOT NULL DEFAULT 0,
+    rows_inserted integer NOT NULL DEFAULT 0,
+    rows_skipped integer NOT NULL DEFAULT 0,
+    rows_errored integer NOT NULL DEFAULT 0,
+    -- The fraction of rows whose contributor and recipient matched
+    -- an individual
+    contributor_match_rate double precision NOT NULL DEFAULT 0,
+    recipient_match_rate double precision NOT NULL DEFAULT 0,
+    unmatched_recipients integer NOT NULL DEFAULT 0,
+    error text,
+    started_ts timestamp NOT NULL,
+    finished_ts timestamp
+);
+
+CREATE INDEX IF NOT EXISTS cfb_imports_started_ts_idx ON cfb_imports (started_ts);
+
+-- cfb_import_errors are the rows an import skipped because they
+-- couldn't be imported, e.g. because of an unparseable date.
+CREATE TABLE IF NOT EXISTS cfb_import_errors (
+    import_id text NOT NULL REFERENCES cfb_imports (id) ON DELETE CASCADE,
+    -- row_number is the row's number in the file, counting the header as 1
+    row_number integer NOT NULL,
+    refno text,
+    error text NOT NULL,
+    PRIMARY KEY (import_id, row_number)
 );
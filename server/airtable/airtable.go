@@ -0,0 +1,269 @@
+// Package airtable is a client for reading records from the
+// Airtable REST API.
+//
+// The client paginates through tables, stays under Airtable's
+// per-base rate limit, and retries requests that are rate limited
+// or fail with a server error.
+package airtable
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// DefaultBaseURL is the base URL of the Airtable API.
+const DefaultBaseURL = "https://api.airtable.com/v0"
+
+// RequestsPerSecond is Airtable's rate limit for each base.
+const RequestsPerSecond = 5
+
+// Record is a record in an Airtable table.
+type Record struct {
+	ID          string                 `json:"id"`
+	Fields      map[string]interface{} `json:"fields"`
+	CreatedTime string                 `json:"createdTime,omitempty"`
+}
+
+// Client reads records from an Airtable base. The zero value is not
+// usable; create clients with NewClient.
+type Client struct {
+	// BaseURL is the API URL requests are sent to, defaulting to
+	// DefaultBaseURL.
+	BaseURL string
+	BaseID  string
+	APIKey  string
+
+	// HTTPClient sends requests. NewClient sets a client with a
+	// timeout.
+	HTTPClient *http.Client
+	// MaxRetries is the number of times a failed request is
+	// retried before giving up.
+	MaxRetries int
+	// Backoff is the delay before the first retry when the
+	// response has no Retry-After header. It doubles with each
+	// retry.
+	Backoff time.Duration
+
+	mu   sync.Mutex
+	last time.Time // time of the last request
+}
+
+// NewClient returns a client for the given base with default
+// settings.
+func NewClient(baseID, apiKey string) *Client {
+	return &Client{
+		BaseURL:    DefaultBaseURL,
+		BaseID:     baseID,
+		APIKey:     apiKey,
+		HTTPClient: &http.Client{Timeout: 30 * time.Second},
+		MaxRetries: 5,
+		Backoff:    time.Second,
+	}
+}
+
+// Error is an error response from the Airtable API.
+type Error struct {
+	StatusCode int
+	Type       string
+	Message    string
+	// RetryAfter is how long Airtable asked us to wait before
+	// retrying, if it said.
+	RetryAfter time.Duration
+}
+
+func (e *Error) Error() string {
+	msg := fmt.Sprintf("airtable: %d %s", e.StatusCode, http.StatusText(e.StatusCode))
+	if e.Type != "" {
+		msg += ": " + e.Type
+	}
+	if e.Message != "" {
+		msg += ": " + e.Message
+	}
+	return msg
+}
+
+// Temporary reports whether the request may succeed if retried.
+func (e *Error) Temporary() bool {
+	return e.StatusCode == http.StatusTooManyRequests || e.StatusCode >= 500
+}
+
+// ForEachRecord calls fn with each record in the named table, in
+// the order Airtable returns them. It stops at the first error
+// returned by fn.
+func (c *Client) ForEachRecord(ctx context.Context, table string, fn func(r Record) error) error {
+	offset := ""
+	for {
+		q := url.Values{}
+		q.Set("pageSize", "100")
+		if offset != "" {
+			q.Set("offset", offset)
+		}
+		u := c.BaseURL + "/" + url.PathEscape(c.BaseID) + "/" + url.PathEscape(table) + "?" + q.Encode()
+
+		var page struct {
+			Records []Record `json:"records"`
+			Offset  string   `json:"offset"`
+		}
+		err := c.get(ctx, u, &page)
+		if err != nil {
+			return errors.Wrapf(err, "listing records in %s", table)
+		}
+		for _, r := range page.Records {
+			err := fn(r)
+			if err != nil {
+				return errors.Wrap(err, "processing record")
+			}
+		}
+		// Check offset to fetch next page of results
+		if page.Offset == "" {
+			return nil
+		}
+		offset = page.Offset
+	}
+}
+
+// get fetches u into v, retrying temporary failures.
+func (c *Client) get(ctx context.Context, u string, v interface{}) error {
+	backoff := c.Backoff
+	for attempt := 0; ; attempt++ {
+		err := c.do(ctx, u, v)
+		if err == nil || attempt >= c.MaxRetries || !temporary(err) {
+			return err
+		}
+		wait := backoff
+		if e, ok := err.(*Error); ok && e.RetryAfter > 0 {
+			wait = e.RetryAfter
+		}
+		backoff *= 2
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+func (c *Client) do(ctx context.Context, u string, v interface{}) error {
+	err := c.wait(ctx)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("GET", u, nil)
+	if err != nil {
+		return errors.Wrap(err, "creating request")
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Authorization", "Bearer "+c.APIKey)
+	resp, err := c.HTTPClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return responseError(resp)
+	}
+	err = json.NewDecoder(resp.Body).Decode(v)
+	if err != nil {
+		return errors.Wrap(err, "unmarshaling response")
+	}
+	return nil
+}
+
+// wait blocks until a request can be sent without exceeding
+// RequestsPerSecond.
+func (c *Client) wait(ctx context.Context) error {
+	const interval = time.Second / RequestsPerSecond
+	c.mu.Lock()
+	next := c.last.Add(interval)
+	now := time.Now()
+	if next.Before(now) {
+		next = now
+	}
+	c.last = next
+	c.mu.Unlock()
+
+	select {
+	case <-time.After(time.Until(next)):
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// responseError builds an *Error from a non-200 response.
+// Airtable sends either {"error": "TYPE"} or
+// {"error": {"type": "TYPE", "message": "..."}}.
+func responseError(resp *http.Response) error {
+	e := &Error{
+		StatusCode: resp.StatusCode,
+		RetryAfter: retryAfter(resp.Header.Get("Retry-After")),
+	}
+	b, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1<<16))
+	var body struct {
+		Error json.RawMessage `json:"error"`
+	}
+	if json.Unmarshal(b, &body) != nil || len(body.Error) == 0 {
+		return e
+	}
+	var detail struct {
+		Type    string `json:"type"`
+		Message string `json:"message"`
+	}
+	if json.Unmarshal(body.Error, &detail) == nil {
+		e.Type, e.Message = detail.Type, detail.Message
+	} else {
+		json.Unmarshal(body.Error, &e.Type)
+	}
+	return e
+}
+
+// retryAfter parses a Retry-After header in either seconds or as
+// an HTTP date.
+func retryAfter(h string) time.Duration {
+	if h == "" {
+		return 0
+	}
+	if secs, err := strconv.Atoi(h); err == nil {
+		return time.Duration(secs) * time.Second
+	}
+	if t, err := http.ParseTime(h); err == nil {
+		return time.Until(t)
+	}
+	return 0
+}
+
+// temporary reports whether err is worth retrying: rate limiting,
+// server errors, timeouts, and connections that failed or were cut
+// off. Other failures, such as a malformed URL or an untrusted
+// certificate, would only fail again.
+func temporary(err error) bool {
+	var apiErr *Error
+	if errors.As(err, &apiErr) {
+		return apiErr.Temporary()
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return true
+	}
+	var opErr *net.OpError
+	if errors.As(err, &opErr) {
+		switch opErr.Op {
+		case "dial", "read", "write":
+			return true
+		}
+	}
+	// The server closed the connection before responding
+	return errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF)
+}
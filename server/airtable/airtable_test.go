@@ -0,0 +1,179 @@
+package airtable_test
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/vickiniu/project-red-string/airtable"
+	"github.com/vickiniu/project-red-string/airtable/airtabletest"
+)
+
+// records returns n records with IDs rec0, rec1, ...
+func records(n int) []airtable.Record {
+	var res []airtable.Record
+	for i := 0; i < n; i++ {
+		res = append(res, airtable.Record{
+			ID:     fmt.Sprintf("rec%d", i),
+			Fields: map[string]interface{}{"Name": fmt.Sprintf("Record %d", i)},
+		})
+	}
+	return res
+}
+
+// readAll returns the IDs of the records in the table.
+func readAll(c *airtable.Client, table string) ([]string, error) {
+	var ids []string
+	err := c.ForEachRecord(context.Background(), table, func(r airtable.Record) error {
+		ids = append(ids, r.ID)
+		return nil
+	})
+	return ids, err
+}
+
+func ids(records []airtable.Record) []string {
+	var res []string
+	for _, r := range records {
+		res = append(res, r.ID)
+	}
+	return res
+}
+
+func TestForEachRecordPaginates(t *testing.T) {
+	s := airtabletest.NewServer("key")
+	defer s.Close()
+	s.PageSize = 2
+	s.AddRecords("Master List", records(5)...)
+
+	got, err := readAll(s.Client("base"), "Master List")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := ids(records(5)); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if s.Requests() != 3 {
+		t.Errorf("got %d requests, want 3 pages", s.Requests())
+	}
+}
+
+func TestRetries(t *testing.T) {
+	s := airtabletest.NewServer("key")
+	defer s.Close()
+	s.AddRecords("Master List", records(1)...)
+
+	// Server errors are retried with backoff
+	s.FailNext(http.StatusInternalServerError, "")
+	s.FailNext(http.StatusServiceUnavailable, "")
+	got, err := readAll(s.Client("base"), "Master List")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 1 || s.Requests() != 3 {
+		t.Errorf("got %v after %d requests, want the record after 3", got, s.Requests())
+	}
+
+	// Rate limited requests are retried after Retry-After, rather
+	// than the client's backoff
+	s.FailNext(http.StatusTooManyRequests, "1")
+	start := time.Now()
+	_, err = readAll(s.Client("base"), "Master List")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d := time.Since(start); d < time.Second {
+		t.Errorf("retried after %v, want Retry-After's 1s", d)
+	}
+
+	// Until the retries run out
+	c := s.Client("base")
+	c.MaxRetries = 2
+	for i := 0; i < 5; i++ {
+		s.FailNext(http.StatusBadGateway, "")
+	}
+	before := s.Requests()
+	_, err = readAll(c, "Master List")
+	var e *airtable.Error
+	if !errors.As(err, &e) || e.StatusCode != http.StatusBadGateway {
+		t.Errorf("got error %v, want a 502", err)
+	}
+	if n := s.Requests() - before; n != 3 {
+		t.Errorf("got %d requests, want 3", n)
+	}
+}
+
+func TestUnauthorized(t *testing.T) {
+	s := airtabletest.NewServer("key")
+	defer s.Close()
+	s.AddRecords("Master List", records(1)...)
+
+	c := s.Client("base")
+	c.APIKey = "wrong"
+	_, err := readAll(c, "Master List")
+	var e *airtable.Error
+	if !errors.As(err, &e) || e.StatusCode != http.StatusUnauthorized || e.Type != "AUTHENTICATION_REQUIRED" {
+		t.Fatalf("got error %v, want a 401 AUTHENTICATION_REQUIRED", err)
+	}
+	if e.Temporary() || s.Requests() != 1 {
+		t.Errorf("got %d requests, want the 401 not to be retried", s.Requests())
+	}
+}
+
+func TestRateLimited(t *testing.T) {
+	s := airtabletest.NewServer("key")
+	defer s.Close()
+	s.PageSize = 1
+	s.AddRecords("Master List", records(6)...)
+
+	// The first of 6 requests is sent at once and the rest 1/5s apart
+	start := time.Now()
+	_, err := readAll(s.Client("base"), "Master List")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d := time.Since(start); d < time.Second-10*time.Millisecond {
+		t.Errorf("made 6 requests in %v, want at least 1s at %d per second", d, airtable.RequestsPerSecond)
+	}
+}
+
+func TestNetworkErrors(t *testing.T) {
+	// The first request times out; the retry succeeds
+	var requests int32
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&requests, 1) == 1 {
+			time.Sleep(200 * time.Millisecond)
+		}
+		fmt.Fprint(w, `{"records": [{"id": "rec0", "fields": {}}]}`)
+	}))
+	defer s.Close()
+	c := airtable.NewClient("base", "key")
+	c.BaseURL = s.URL
+	c.HTTPClient = &http.Client{Timeout: 50 * time.Millisecond}
+	c.Backoff = time.Millisecond
+	got, err := readAll(c, "Master List")
+	if err != nil || len(got) != 1 {
+		t.Errorf("got %v, %v, want the record once the timeout was retried", got, err)
+	}
+
+	// Untrusted certificates and bad URLs aren't retried: with an
+	// hour's backoff, a retry would run into the deadline
+	tlsServer := httptest.NewTLSServer(http.NotFoundHandler())
+	defer tlsServer.Close()
+	for _, baseURL := range []string{tlsServer.URL, "unsupported://example.com"} {
+		c := airtable.NewClient("base", "key")
+		c.BaseURL = baseURL
+		c.Backoff = time.Hour
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		err := c.ForEachRecord(ctx, "Master List", func(airtable.Record) error { return nil })
+		cancel()
+		if err == nil || errors.Cause(err) == context.DeadlineExceeded {
+			t.Errorf("%s: got error %v, want it returned without retrying", baseURL, err)
+		}
+	}
+}
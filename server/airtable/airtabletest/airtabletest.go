@@ -0,0 +1,187 @@
+// Package airtabletest provides an in-memory Airtable API server
+// for exercising code that reads from Airtable without network
+// access.
+package airtabletest
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/vickiniu/project-red-string/airtable"
+)
+
+// Server is a fake Airtable API serving records held in memory.
+// It serves every base, checks the API key, paginates like Airtable
+// and can be told to fail requests.
+type Server struct {
+	*httptest.Server
+
+	// APIKey is the key requests must be authorized with.
+	APIKey string
+	// PageSize caps the records returned per page, regardless of
+	// the pageSize requested.
+	PageSize int
+
+	mu       sync.Mutex
+	tables   map[string][]airtable.Record
+	failures []failure
+	requests int
+}
+
+type failure struct {
+	status     int
+	retryAfter string
+}
+
+// NewServer starts a fake Airtable server accepting apiKey. Callers
+// should Close it when done.
+func NewServer(apiKey string) *Server {
+	s := &Server{
+		APIKey:   apiKey,
+		PageSize: 100,
+		tables:   make(map[string][]airtable.Record),
+	}
+	s.Server = httptest.NewServer(http.HandlerFunc(s.serveHTTP))
+	return s
+}
+
+// Client returns a client for the fake server that retries without
+// waiting.
+func (s *Server) Client(baseID string) *airtable.Client {
+	c := airtable.NewClient(baseID, s.APIKey)
+	c.BaseURL = s.URL + "/v0"
+	c.HTTPClient = s.Server.Client()
+	c.Backoff = time.Millisecond
+	return c
+}
+
+// AddRecords appends records to the named table.
+func (s *Server) AddRecords(table string, records ...airtable.Record) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.tables[table] = append(s.tables[table], records...)
+}
+
+// SetRecords replaces the records in the named table.
+func (s *Server) SetRecords(table string, records ...airtable.Record) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.tables[table] = records
+}
+
+// FailNext makes the next request fail with status. A non-empty
+// retryAfter is sent as the Retry-After header. Failures queue up,
+// so calling FailNext twice fails the next two requests.
+func (s *Server) FailNext(status int, retryAfter string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.failures = append(s.failures, failure{status: status, retryAfter: retryAfter})
+}
+
+// Requests returns the number of requests served.
+func (s *Server) Requests() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.requests
+}
+
+func (s *Server) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.requests++
+
+	if len(s.failures) > 0 {
+		f := s.failures[0]
+		s.failures = s.failures[1:]
+		if f.retryAfter != "" {
+			w.Header().Set("Retry-After", f.retryAfter)
+		}
+		writeError(w, f.status, errorType(f.status), "injected failure")
+		return
+	}
+	if r.Method != "GET" {
+		writeError(w, http.StatusMethodNotAllowed, "METHOD_NOT_ALLOWED", "")
+		return
+	}
+	if r.Header.Get("Authorization") != "Bearer "+s.APIKey {
+		writeError(w, http.StatusUnauthorized, "AUTHENTICATION_REQUIRED", "Authentication required")
+		return
+	}
+
+	// Paths are /v0/{baseID}/{table}
+	parts := strings.Split(strings.TrimPrefix(r.URL.EscapedPath(), "/v0/"), "/")
+	if len(parts) != 2 {
+		writeError(w, http.StatusNotFound, "NOT_FOUND", "")
+		return
+	}
+	table, err := url.PathUnescape(parts[1])
+	if err != nil {
+		writeError(w, http.StatusNotFound, "NOT_FOUND", "")
+		return
+	}
+	records, ok := s.tables[table]
+	if !ok {
+		writeError(w, http.StatusNotFound, "TABLE_NOT_FOUND", "Could not find table "+table)
+		return
+	}
+
+	pageSize := s.PageSize
+	if n, err := strconv.Atoi(r.URL.Query().Get("pageSize")); err == nil && n > 0 && n < pageSize {
+		pageSize = n
+	}
+	start := 0
+	if o := r.URL.Query().Get("offset"); o != "" {
+		start, err = strconv.Atoi(o)
+		if err != nil || start < 0 || start > len(records) {
+			writeError(w, http.StatusUnprocessableEntity, "LIST_RECORDS_ITERATOR_NOT_AVAILABLE", "")
+			return
+		}
+	}
+	end := start + pageSize
+	if end > len(records) {
+		end = len(records)
+	}
+	page := struct {
+		Records []airtable.Record `json:"records"`
+		Offset  string            `json:"offset,omitempty"`
+	}{
+		Records: records[start:end],
+	}
+	if end < len(records) {
+		page.Offset = strconv.Itoa(end)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(page)
+}
+
+func writeError(w http.ResponseWriter, status int, typ, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	body := map[string]interface{}{
+		"error": map[string]string{
+			"type":    typ,
+			"message": message,
+		},
+	}
+	json.NewEncoder(w).Encode(body)
+}
+
+func errorType(status int) string {
+	switch status {
+	case http.StatusUnauthorized:
+		return "AUTHENTICATION_REQUIRED"
+	case http.StatusForbidden:
+		return "NOT_AUTHORIZED"
+	case http.StatusNotFound:
+		return "NOT_FOUND"
+	case http.StatusTooManyRequests:
+		return "RATE_LIMIT_REACHED"
+	}
+	return "SERVER_ERROR"
+}
@@ -0,0 +1,141 @@
+package api
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// User roles, each allowed everything the roles before it are.
+const (
+	// RoleViewer may read the audit log.
+	RoleViewer = "viewer"
+	// RoleEditor may also create, update and merge individuals
+	// and their associations.
+	RoleEditor = "editor"
+	// RoleAdmin may also manage categories and users.
+	RoleAdmin = "admin"
+)
+
+var roleRanks = map[string]int{
+	RoleViewer: 1,
+	RoleEditor: 2,
+	RoleAdmin:  3,
+}
+
+// user is an API user, authenticated by their token.
+type user struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+	Role string `json:"role"`
+}
+
+type userKey struct{}
+
+// requestUser returns the user authenticated for the request. It
+// must only be called from handlers wrapped with requireRole.
+func requestUser(ctx context.Context) *user {
+	return ctx.Value(userKey{}).(*user)
+}
+
+// requireRole wraps h so it's only served to users with at least
+// the given role, authenticated with an "Authorization: Bearer"
+// token.
+func (s *Server) requireRole(role string, h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if token == "" {
+			resperr(w, r, statusError(http.StatusUnauthorized, "missing API token"))
+			return
+		}
+		u, err := s.store.UserByTokenHash(r.Context(), hashToken(token))
+		if err != nil {
+			resperr(w, r, errors.Wrap(err, "authenticating user"))
+			return
+		}
+		if u == nil {
+			resperr(w, r, statusError(http.StatusUnauthorized, "invalid API token"))
+			return
+		}
+		if roleRanks[u.Role] < roleRanks[role] {
+			resperr(w, r, statusError(http.StatusForbidden, fmt.Sprintf("%s role required", role)))
+			return
+		}
+		h(w, r.WithContext(context.WithValue(r.Context(), userKey{}, u)))
+	}
+}
+
+// CreateUser adds an API user with the given role and returns their
+// token. The token can't be recovered later.
+func CreateUser(ctx context.Context, db *sql.DB, name, role string) (string, error) {
+	if name == "" {
+		return "", statusError(http.StatusBadRequest, "missing user name")
+	}
+	if _, ok := roleRanks[role]; !ok {
+		return "", statusError(http.StatusBadRequest, fmt.Sprintf("unknown role %q", role))
+	}
+	token, err := newToken()
+	if err != nil {
+		return "", err
+	}
+	const insertQ = `
+		INSERT INTO api_users (
+			name,
+			role,
+			token_hash,
+			created_ts
+		) VALUES (
+			$1,
+			$2,
+			$3,
+			current_timestamp
+		)
+	`
+	_, err = db.ExecContext(ctx, insertQ, name, role, hashToken(token))
+	if err != nil {
+		return "", errors.Wrap(err, "inserting user")
+	}
+	return token, nil
+}
+
+// RevokeUser revokes the named user's token.
+func RevokeUser(ctx context.Context, db *sql.DB, name string) error {
+	const q = `
+		UPDATE api_users SET revoked_ts = current_timestamp
+		WHERE name = $1 AND revoked_ts IS NULL
+	`
+	res, err := db.ExecContext(ctx, q, name)
+	if err != nil {
+		return errors.Wrap(err, "revoking user")
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return errors.Wrap(err, "counting revoked users")
+	}
+	if n == 0 {
+		return statusError(http.StatusNotFound, fmt.Sprintf("no active user %q", name))
+	}
+	return nil
+}
+
+// newToken returns a random token for a user or API key.
+func newToken() (string, error) {
+	b := make([]byte, 32)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", errors.Wrap(err, "generating token")
+	}
+	return hex.EncodeToString(b), nil
+}
+
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,159 @@
+package api
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// versionCheckInterval is how often the data version is checked,
+	// and so how long a server may serve cached responses after
+	// another process changes the data.
+	versionCheckInterval = 5 * time.Second
+	// maxCacheEntries bounds the cache; it's emptied when full.
+	maxCacheEntries = 10000
+)
+
+// responseCache caches encoded responses for the current data
+// version. Entries are dropped whenever the version changes, which
+// happens when the importers run or data is edited through the API.
+type responseCache struct {
+	mu      sync.Mutex
+	version int64
+	checked time.Time
+	entries map[string]cachedResponse
+	now     func() time.Time
+}
+
+type cachedResponse struct {
+	body []byte
+	etag string
+}
+
+func newResponseCache() *responseCache {
+	return &responseCache{
+		entries: make(map[string]cachedResponse),
+		now:     time.Now,
+	}
+}
+
+// refresh checks the data version if it hasn't been checked
+// recently, dropping every entry if it's changed.
+func (c *responseCache) refresh(ctx context.Context, store Store) (int64, error) {
+	c.mu.Lock()
+	if c.now().Sub(c.checked) < versionCheckInterval {
+		defer c.mu.Unlock()
+		return c.version, nil
+	}
+	c.mu.Unlock()
+
+	v, err := store.DataVersion(ctx)
+	if err != nil {
+		return 0, err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if v != c.version {
+		c.version = v
+		c.entries = make(map[string]cachedResponse)
+	}
+	c.checked = c.now()
+	return v, nil
+}
+
+// invalidate makes the next lookup check the data version, after
+// this server has changed the data.
+func (c *responseCache) invalidate() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.checked = time.Time{}
+}
+
+func (c *responseCache) get(key string, version int64) (cachedResponse, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if version != c.version {
+		return cachedResponse{}, false
+	}
+	e, ok := c.entries[key]
+	return e, ok
+}
+
+func (c *responseCache) put(key string, version int64, e cachedResponse) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if version != c.version {
+		// The data changed while the response was being made
+		return
+	}
+	if len(c.entries) >= maxCacheEntries {
+		c.entries = make(map[string]cachedResponse)
+	}
+	c.entries[key] = e
+}
+
+// respcached responds with the JSON encoding of the value returned
+// by fn, caching it under key until the data changes. Responses
+// carry an ETag, so clients that send it back in If-None-Match get a
+// 304 while the data is unchanged.
+func (s *Server) respcached(w http.ResponseWriter, r *http.Request, key string, fn func() (interface{}, error)) error {
+	version, err := s.cache.refresh(r.Context(), s.store)
+	if err != nil {
+		return errors.Wrap(err, "checking cache")
+	}
+	e, ok := s.cache.get(key, version)
+	if ok {
+		s.metrics.cacheLookups.Inc("hit")
+	} else {
+		s.metrics.cacheLookups.Inc("miss")
+		v, err := fn()
+		if err != nil {
+			return err
+		}
+		b, err := json.Marshal(v)
+		if err != nil {
+			return errors.Wrap(err, "encoding response")
+		}
+		sum := sha256.Sum256(b)
+		e = cachedResponse{
+			body: append(b, '\n'),
+			etag: fmt.Sprintf(`"%d-%s"`, version, hex.EncodeToString(sum[:8])),
+		}
+		s.cache.put(key, version, e)
+	}
+
+	h := w.Header()
+	h.Set("ETag", e.etag)
+	if s.CacheMaxAge > 0 {
+		h.Set("Cache-Control", fmt.Sprintf("public, max-age=%d", seconds(s.CacheMaxAge)))
+	} else {
+		h.Set("Cache-Control", "no-cache")
+	}
+	if etagMatches(r.Header.Get("If-None-Match"), e.etag) {
+		w.WriteHeader(http.StatusNotModified)
+		return nil
+	}
+	h.Set("Content-Type", "application/json")
+	w.Write(e.body)
+	return nil
+}
+
+// etagMatches reports whether an If-None-Match header matches etag.
+func etagMatches(header, etag string) bool {
+	for _, t := range strings.Split(header, ",") {
+		t = strings.TrimPrefix(strings.TrimSpace(t), "W/")
+		if t == etag || t == "*" {
+			return true
+		}
+	}
+	return false
+}
@@ -11,7 +11,8 @@ type category struct {
 	Description string `json:"description"`
 }
 
-func (s *Server) getCategories(ctx context.Context) ([]category, error) {
+func (s *postgresStore) GetCategories(ctx context.Context) ([]category, error) {
+	defer s.metrics.timeQuery("getCategories")()
 	const q = `
 		SELECT id, description
 		FROM categories
@@ -37,15 +38,16 @@ func (s *Server) getCategories(ctx context.Context) ([]category, error) {
 	return categories, nil
 }
 
-func (s *Server) getIndividualsByCategory(ctx context.Context, categoryID string) ([]individualname, error) {
+func (s *postgresStore) GetIndividualsByCategory(ctx context.Context, categoryID string) ([]individualname, error) {
+	defer s.metrics.timeQuery("getIndividualsByCategory")()
 	const q = `
 		SELECT id, first_name, last_name
 		FROM individuals
 		JOIN individual_associations
 		ON individuals.id = individual_associations.individual_id
 		WHERE individual_associations.association_id IN (
-			SELECT id 
-			FROM associations
+			SELECT association_id
+			FROM association_categories
 			WHERE category_id = $1
 		)
 	`
@@ -70,11 +72,14 @@ func (s *Server) getIndividualsByCategory(ctx context.Context, categoryID string
 	return individuals, nil
 }
 
-func (s *Server) getAssociationsForCategory(ctx context.Context, categoryID string) ([]association, error) {
+func (s *postgresStore) GetAssociationsForCategory(ctx context.Context, categoryID string) ([]association, error) {
+	defer s.metrics.timeQuery("getAssociationsForCategory")()
 	const q = `
 		SELECT id, description
 		FROM associations
-		WHERE category_id = $1
+		JOIN association_categories
+		ON associations.id = association_categories.association_id
+		WHERE association_categories.category_id = $1
 	`
 	rows, err := s.db.QueryContext(ctx, q, categoryID)
 	if err != nil {
@@ -97,7 +102,8 @@ func (s *Server) getAssociationsForCategory(ctx context.Context, categoryID stri
 	return associations, nil
 }
 
-func (s *Server) getIndividualsByAssociation(ctx context.Context, associationID string) ([]individualname, error) {
+func (s *postgresStore) GetIndividualsByAssociation(ctx context.Context, associationID string) ([]individualname, error) {
+	defer s.metrics.timeQuery("getIndividualsByAssociation")()
 	const q = `
 		SELECT id, first_name, last_name
 		FROM individuals
@@ -125,3 +131,50 @@ func (s *Server) getIndividualsByAssociation(ctx context.Context, associationID
 	}
 	return individuals, nil
 }
+
+// uncategorizedAssociation is an association that doesn't belong
+// to any category, along with how many individuals have it.
+type uncategorizedAssociation struct {
+	ID              string `json:"id"`
+	Description     string `json:"description"`
+	IndividualCount int    `json:"individual_count"`
+}
+
+func (s *postgresStore) GetUncategorizedAssociations(ctx context.Context) ([]uncategorizedAssociation, error) {
+	defer s.metrics.timeQuery("getUncategorizedAssociations")()
+	const q = `
+		SELECT
+			associations.id,
+			associations.description,
+			count(DISTINCT individual_associations.individual_id)
+		FROM associations
+		LEFT JOIN individual_associations
+		ON associations.id = individual_associations.association_id
+		WHERE NOT EXISTS (
+			SELECT 1
+			FROM association_categories
+			WHERE association_categories.association_id = associations.id
+		)
+		GROUP BY associations.id, associations.description
+		ORDER BY associations.description
+	`
+	rows, err := s.db.QueryContext(ctx, q)
+	if err != nil {
+		return nil, errors.Wrap(err, "querying uncategorized associations from db")
+	}
+	defer rows.Close()
+
+	var associations []uncategorizedAssociation
+	for rows.Next() {
+		var a uncategorizedAssociation
+		err := rows.Scan(&a.ID, &a.Description, &a.IndividualCount)
+		if err != nil {
+			return nil, errors.Wrap(err, "scanning association row")
+		}
+		associations = append(associations, a)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, errors.Wrap(err, "reading association rows")
+	}
+	return associations, nil
+}
@@ -15,45 +15,66 @@ type contribution struct {
 	ContributorID   string    `json:"contributor_id"`
 	RecipientName   string    `json:"recipient_name"`
 	RecipientID     string    `json:"recipient_id"`
+	// Sources of the matches of the contributor and recipient to
+	// individuals
+	ContributorSource *provenance `json:"contributor_source"`
+	RecipientSource   *provenance `json:"recipient_source"`
+	// Roles the contributor and recipient held on the date of the
+	// contribution, if requested
+	ContributorRoles []activeRole `json:"contributor_roles,omitempty"`
+	RecipientRoles   []activeRole `json:"recipient_roles,omitempty"`
 
 	// TODO(vicki): optionally include other fields
 }
 
-func (s *Server) contributionsReceived(ctx context.Context, individualID string) ([]contribution, error) {
-	const q = `
+// contributionSourceColumns selects the contributor and recipient
+// match sources, and the FROM clause joining them to contributions.
+var contributionSourceColumns = sourceColumns("cs") + ", " + sourceColumns("rs") + `
+	FROM contributions
+	LEFT JOIN sources cs ON contributions.contributor_source_id = cs.id
+	LEFT JOIN sources rs ON contributions.recipient_source_id = rs.id
+`
+
+func (s *postgresStore) ContributionsReceived(ctx context.Context, individualID string, withRoles bool) ([]contribution, error) {
+	defer s.metrics.timeQuery("contributionsReceived")()
+	q := `
 		SELECT
-			id,
+			contributions.id,
 			amount,
 			date,
 			contributor_name,
 			COALESCE(contributor_id, ''),
 			recipient_name,
-			recipient_id
-		FROM contributions
+			recipient_id,
+			` + contributionSourceColumns + `
 		WHERE recipient_id = $1
 	`
-	res, err := s.getContributions(ctx, q, individualID)
+	res, err := s.getContributions(ctx, q, individualID, withRoles)
 	return res, errors.Wrap(err, "contributions received")
 }
 
-func (s *Server) contributionsGiven(ctx context.Context, individualID string) ([]contribution, error) {
-	const q = `
+func (s *postgresStore) ContributionsGiven(ctx context.Context, individualID string, withRoles bool) ([]contribution, error) {
+	defer s.metrics.timeQuery("contributionsGiven")()
+	q := `
 		SELECT
-			id,
+			contributions.id,
 			amount,
 			date,
 			contributor_name,
 			contributor_id,
 			recipient_name,
-			COALESCE(recipient_id, '')
-		FROM contributions
+			COALESCE(recipient_id, ''),
+			` + contributionSourceColumns + `
 		WHERE contributor_id = $1
 	`
-	res, err := s.getContributions(ctx, q, individualID)
+	res, err := s.getContributions(ctx, q, individualID, withRoles)
 	return res, errors.Wrap(err, "contributions given")
 }
 
-func (s *Server) getContributions(ctx context.Context, query string, individualID string) ([]contribution, error) {
+// getContributions runs a contributions query for the individual. If
+// withRoles is set, each contribution is annotated with the roles its
+// contributor and recipient held at the time.
+func (s *postgresStore) getContributions(ctx context.Context, query string, individualID string, withRoles bool) ([]contribution, error) {
 	rows, err := s.db.QueryContext(ctx, query, individualID)
 	if err != nil {
 		return nil, errors.Wrap(err, "querying contributions from db")
@@ -62,15 +83,30 @@ func (s *Server) getContributions(ctx context.Context, query string, individualI
 
 	var res []contribution
 	for rows.Next() {
-		var c contribution
-		err := rows.Scan(&c.ID, &c.Amount, &c.Date, &c.ContributorName, &c.ContributorID, &c.RecipientName, &c.RecipientID)
+		var (
+			c                      contribution
+			contributorSrc, recSrc nullProvenance
+		)
+		dest := []interface{}{&c.ID, &c.Amount, &c.Date, &c.ContributorName, &c.ContributorID, &c.RecipientName, &c.RecipientID}
+		dest = append(dest, contributorSrc.dest()...)
+		dest = append(dest, recSrc.dest()...)
+		err := rows.Scan(dest...)
 		if err != nil {
 			return nil, errors.Wrap(err, "scanning contribution row")
 		}
+		c.ContributorSource = contributorSrc.provenance()
+		c.RecipientSource = recSrc.provenance()
 		res = append(res, c)
 	}
 	if err := rows.Err(); err != nil {
 		return nil, errors.Wrap(err, "reading contribution rows")
 	}
+	if withRoles {
+		roles, err := s.getDatedRoles(ctx, contributionParties(res))
+		if err != nil {
+			return nil, errors.Wrap(err, "annotating roles")
+		}
+		annotateRoles(res, roles)
+	}
 	return res, nil
 }
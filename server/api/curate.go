@@ -0,0 +1,681 @@
+package api
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+	"github.com/pkg/errors"
+	"github.com/vickiniu/project-red-string/audit"
+	"github.com/vickiniu/project-red-string/dataversion"
+	"github.com/vickiniu/project-red-string/internal/sqlutil"
+	prov "github.com/vickiniu/project-red-string/provenance"
+)
+
+// editableColumns are the individuals columns that can be set
+// through the API.
+var editableColumns = []string{"first_name", "last_name", "zip", "role", "title", "twitter", "notes"}
+
+// individualFields are the fields of an individual set by a create
+// or update request. Fields left out are left unchanged.
+type individualFields struct {
+	FirstName *string  `json:"first_name"`
+	LastName  *string  `json:"last_name"`
+	ZIP       *string  `json:"zip"`
+	Role      *string  `json:"role"`
+	Title     *string  `json:"title"`
+	Twitter   *string  `json:"twitter"`
+	Notes     *string  `json:"notes"`
+	Sources   []string `json:"sources"`
+}
+
+// columns returns the fields keyed on their column, nil if unset.
+func (f individualFields) columns() map[string]*string {
+	return map[string]*string{
+		"first_name": f.FirstName,
+		"last_name":  f.LastName,
+		"zip":        f.ZIP,
+		"role":       f.Role,
+		"title":      f.Title,
+		"twitter":    f.Twitter,
+		"notes":      f.Notes,
+	}
+}
+
+// edit is a change made by an API user, applied in a single
+// transaction. Everything it changes is recorded in the audit log
+// and attributed to a manual source added by the user.
+type edit struct {
+	tx       *sql.Tx
+	run      *audit.Run
+	sourceID string
+}
+
+// edit runs fn as the request's user, committing its changes if it
+// succeeds. note is recorded with the source of the changes.
+func (s *Server) edit(ctx context.Context, command, note string, fn func(e *edit) error) error {
+	defer s.metrics.timeQuery("edit " + command)()
+	u := requestUser(ctx)
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return errors.Wrap(err, "beginning transaction")
+	}
+	defer tx.Rollback()
+	run, err := audit.StartRunBy(ctx, tx, "api "+command, u.Name)
+	if err != nil {
+		return err
+	}
+	sourceID, err := prov.Insert(ctx, tx, prov.Source{
+		Type:    prov.TypeManual,
+		Note:    note,
+		AddedBy: u.Name,
+	})
+	if err != nil {
+		return err
+	}
+	err = fn(&edit{tx: tx, run: run, sourceID: sourceID})
+	if err != nil {
+		return err
+	}
+	err = dataversion.Bump(ctx, tx)
+	if err != nil {
+		return err
+	}
+	err = tx.Commit()
+	if err != nil {
+		return errors.Wrap(err, "committing edit")
+	}
+	s.cache.invalidate()
+	return nil
+}
+
+func (e *edit) record(ctx context.Context, changes ...audit.Change) error {
+	return e.run.Record(ctx, e.tx, e.sourceID, changes...)
+}
+
+func individualChange(individualID, field, old, new string) audit.Change {
+	return audit.Change{
+		Entity:       audit.EntityIndividual,
+		EntityID:     individualID,
+		IndividualID: individualID,
+		Field:        field,
+		Old:          old,
+		New:          new,
+	}
+}
+
+func (s *Server) createIndividual(ctx context.Context, f individualFields, note string) (string, error) {
+	if f.FirstName == nil || *f.FirstName == "" || f.LastName == nil || *f.LastName == "" {
+		return "", statusError(http.StatusBadRequest, "first_name and last_name are required")
+	}
+	var individualID string
+	err := s.edit(ctx, "create individual", note, func(e *edit) error {
+		var (
+			cols   []string
+			params []string
+			args   []interface{}
+		)
+		values := f.columns()
+		for _, c := range editableColumns {
+			if values[c] == nil {
+				continue
+			}
+			args = append(args, sqlutil.NullString(*values[c]))
+			cols = append(cols, c)
+			params = append(params, "$"+strconv.Itoa(len(args)))
+		}
+		args = append(args, sqlutil.CFBName(*f.FirstName, *f.LastName), pq.StringArray(f.Sources), e.sourceID)
+		cols = append(cols, "cfb_name", "source_urls", "source_id")
+		for i := len(params); i < len(args); i++ {
+			params = append(params, "$"+strconv.Itoa(i+1))
+		}
+		insertQ := `
+			INSERT INTO individuals (
+				` + strings.Join(cols, ", ") + `,
+				updated_ts
+			) VALUES (
+				` + strings.Join(params, ", ") + `,
+				current_timestamp
+			) RETURNING id
+		`
+		err := e.tx.QueryRowContext(ctx, insertQ, args...).Scan(&individualID)
+		if err != nil {
+			return errors.Wrap(err, "inserting individual")
+		}
+		var changes []audit.Change
+		for _, c := range editableColumns {
+			if values[c] != nil {
+				changes = append(changes, individualChange(individualID, c, "", *values[c]))
+			}
+		}
+		changes = append(changes, individualChange(individualID, "source_urls", "", strings.Join(f.Sources, "\n")))
+		err = e.record(ctx, changes...)
+		if err != nil {
+			return err
+		}
+		return e.changeRole(ctx, individualID, stringValue(f.Role), stringValue(f.Title), nil)
+	})
+	return individualID, err
+}
+
+func (s *Server) updateIndividual(ctx context.Context, individualID string, f individualFields, note string) error {
+	return s.edit(ctx, "update individual", note, func(e *edit) error {
+		selectList := "source_urls"
+		for _, c := range editableColumns {
+			selectList += ", COALESCE(" + c + ", '')"
+		}
+		current := make([]string, len(editableColumns))
+		var sources pq.StringArray
+		dest := []interface{}{&sources}
+		for i := range current {
+			dest = append(dest, &current[i])
+		}
+		q := `SELECT ` + selectList + ` FROM individuals WHERE id = $1 FOR UPDATE`
+		err := e.tx.QueryRowContext(ctx, q, individualID).Scan(dest...)
+		if err == sql.ErrNoRows {
+			return statusError(http.StatusNotFound, "individual not found")
+		} else if err != nil {
+			return errors.Wrap(err, "querying individual")
+		}
+
+		var (
+			changes []audit.Change
+			sets    []string
+			args    = []interface{}{individualID}
+			updated = make(map[string]string)
+		)
+		values := f.columns()
+		for i, c := range editableColumns {
+			updated[c] = current[i]
+			v := values[c]
+			if v == nil || *v == current[i] {
+				continue
+			}
+			if (c == "first_name" || c == "last_name") && *v == "" {
+				return statusError(http.StatusBadRequest, c+" can't be empty")
+			}
+			updated[c] = *v
+			args = append(args, sqlutil.NullString(*v))
+			sets = append(sets, c+" = $"+strconv.Itoa(len(args)))
+			changes = append(changes, individualChange(individualID, c, current[i], *v))
+		}
+		if f.Sources != nil && strings.Join(f.Sources, "\n") != strings.Join(sources, "\n") {
+			args = append(args, pq.StringArray(f.Sources))
+			sets = append(sets, "source_urls = $"+strconv.Itoa(len(args)))
+			changes = append(changes, individualChange(individualID, "source_urls", strings.Join(sources, "\n"), strings.Join(f.Sources, "\n")))
+		}
+		if len(changes) == 0 {
+			return nil
+		}
+		args = append(args, sqlutil.CFBName(updated["first_name"], updated["last_name"]), e.sourceID)
+		sets = append(sets, "cfb_name = $"+strconv.Itoa(len(args)-1), "source_id = $"+strconv.Itoa(len(args)))
+		updateQ := `
+			UPDATE individuals SET
+				` + strings.Join(sets, ", ") + `,
+				updated_ts = current_timestamp
+			WHERE id = $1
+		`
+		_, err = e.tx.ExecContext(ctx, updateQ, args...)
+		if err != nil {
+			return errors.Wrap(err, "updating individual")
+		}
+		err = e.record(ctx, changes...)
+		if err != nil {
+			return err
+		}
+		if f.Role == nil && f.Title == nil {
+			return nil
+		}
+		today := time.Now()
+		return e.changeRole(ctx, individualID, updated["role"], updated["title"], &today)
+	})
+}
+
+// changeRole ends the individual's current role and starts a new
+// one on the given date, if their role or title changed.
+func (e *edit) changeRole(ctx context.Context, individualID, role, title string, on *time.Time) error {
+	const currentQ = `
+		SELECT id, COALESCE(role, ''), COALESCE(title, '')
+		FROM individual_roles
+		WHERE individual_id = $1 AND end_date IS NULL
+		ORDER BY start_date DESC NULLS LAST
+		LIMIT 1
+	`
+	var roleID, currentRole, currentTitle string
+	err := e.tx.QueryRowContext(ctx, currentQ, individualID).Scan(&roleID, &currentRole, &currentTitle)
+	if err == nil {
+		if role == currentRole && title == currentTitle {
+			return nil
+		}
+		const endQ = `
+			UPDATE individual_roles SET
+				end_date = $2,
+				updated_ts = current_timestamp
+			WHERE id = $1
+		`
+		_, err := e.tx.ExecContext(ctx, endQ, roleID, on)
+		if err != nil {
+			return errors.Wrap(err, "ending role")
+		}
+		err = e.record(ctx, roleChange(individualID, roleID, "end_date", "", sqlutil.FormatDate(on)))
+		if err != nil {
+			return err
+		}
+	} else if err != sql.ErrNoRows {
+		return errors.Wrap(err, "querying current role")
+	}
+	if role == "" && title == "" {
+		return nil
+	}
+	const insertQ = `
+		INSERT INTO individual_roles (
+			individual_id,
+			role,
+			title,
+			start_date,
+			source_id,
+			updated_ts
+		) VALUES (
+			$1,
+			$2,
+			$3,
+			$4,
+			$5,
+			current_timestamp
+		) RETURNING id
+	`
+	err = e.tx.QueryRowContext(ctx, insertQ, individualID, sqlutil.NullString(role), sqlutil.NullString(title), on, e.sourceID).Scan(&roleID)
+	if err != nil {
+		return errors.Wrap(err, "inserting role")
+	}
+	return e.record(ctx,
+		roleChange(individualID, roleID, "role", "", role),
+		roleChange(individualID, roleID, "title", "", title),
+		roleChange(individualID, roleID, "start_date", "", sqlutil.FormatDate(on)),
+	)
+}
+
+func roleChange(individualID, roleID, field, old, new string) audit.Change {
+	return audit.Change{
+		Entity:       audit.EntityIndividualRole,
+		EntityID:     roleID,
+		IndividualID: individualID,
+		Field:        field,
+		Old:          old,
+		New:          new,
+	}
+}
+
+// addIndividualAssociation adds an association to an individual, or
+// updates its dates if they already have it. The association is
+// given by ID or by description, in which case it's created if
+// needed. It returns the association's ID.
+func (s *Server) addIndividualAssociation(ctx context.Context, individualID, associationID, description string, start, end *time.Time, note string) (string, error) {
+	if associationID == "" && description == "" {
+		return "", statusError(http.StatusBadRequest, "association_id or description is required")
+	}
+	err := s.edit(ctx, "add individual association", note, func(e *edit) error {
+		err := e.exists(ctx, "individuals", individualID)
+		if err != nil {
+			return err
+		}
+		if associationID != "" {
+			err := e.tx.QueryRowContext(ctx, `SELECT description FROM associations WHERE id = $1`, associationID).Scan(&description)
+			if err == sql.ErrNoRows {
+				return statusError(http.StatusNotFound, "association not found")
+			} else if err != nil {
+				return errors.Wrap(err, "querying association")
+			}
+		} else {
+			err := e.tx.QueryRowContext(ctx, `SELECT id FROM associations WHERE description = $1`, description).Scan(&associationID)
+			if err == sql.ErrNoRows {
+				const insertQ = `
+					INSERT INTO associations (
+						description,
+						source_id
+					) VALUES (
+						$1,
+						$2
+					) RETURNING id
+				`
+				err := e.tx.QueryRowContext(ctx, insertQ, description, e.sourceID).Scan(&associationID)
+				if err != nil {
+					return errors.Wrap(err, "inserting association")
+				}
+				err = e.record(ctx, audit.Change{
+					Entity:   audit.EntityAssociation,
+					EntityID: associationID,
+					Field:    "description",
+					New:      description,
+				})
+				if err != nil {
+					return err
+				}
+			} else if err != nil {
+				return errors.Wrap(err, "querying association")
+			}
+		}
+
+		const existingQ = `
+			SELECT start_date, end_date
+			FROM individual_associations
+			WHERE individual_id = $1 AND association_id = $2
+		`
+		var (
+			currentStart, currentEnd sql.NullTime
+			changes                  []audit.Change
+		)
+		err = e.tx.QueryRowContext(ctx, existingQ, individualID, associationID).Scan(&currentStart, &currentEnd)
+		if err == sql.ErrNoRows {
+			changes = append(changes, linkChange(individualID, associationID, "association", "", description))
+		} else if err != nil {
+			return errors.Wrap(err, "querying individual association")
+		}
+		changes = append(changes,
+			linkChange(individualID, associationID, "start_date", formatNullDate(currentStart), sqlutil.FormatDate(start)),
+			linkChange(individualID, associationID, "end_date", formatNullDate(currentEnd), sqlutil.FormatDate(end)),
+		)
+		const upsertQ = `
+			INSERT INTO individual_associations (
+				individual_id,
+				association_id,
+				start_date,
+				end_date,
+				source_id,
+				updated_ts
+			) VALUES (
+				$1,
+				$2,
+				$3,
+				$4,
+				$5,
+				current_timestamp
+			)
+			ON CONFLICT (individual_id, association_id) DO UPDATE SET
+				start_date = excluded.start_date,
+				end_date = excluded.end_date,
+				source_id = excluded.source_id,
+				updated_ts = excluded.updated_ts
+		`
+		_, err = e.tx.ExecContext(ctx, upsertQ, individualID, associationID, start, end, e.sourceID)
+		if err != nil {
+			return errors.Wrap(err, "upserting individual association")
+		}
+		return e.record(ctx, changes...)
+	})
+	return associationID, err
+}
+
+func (s *Server) removeIndividualAssociation(ctx context.Context, individualID, associationID, note string) error {
+	return s.edit(ctx, "remove individual association", note, func(e *edit) error {
+		const deleteQ = `
+			DELETE FROM individual_associations
+			USING associations
+			WHERE individual_id = $1 AND association_id = $2 AND associations.id = association_id
+			RETURNING associations.description, start_date, end_date
+		`
+		var (
+			description string
+			start, end  sql.NullTime
+		)
+		err := e.tx.QueryRowContext(ctx, deleteQ, individualID, associationID).Scan(&description, &start, &end)
+		if err == sql.ErrNoRows {
+			return statusError(http.StatusNotFound, "individual association not found")
+		} else if err != nil {
+			return errors.Wrap(err, "deleting individual association")
+		}
+		return e.record(ctx,
+			linkChange(individualID, associationID, "association", description, ""),
+			linkChange(individualID, associationID, "start_date", formatNullDate(start), ""),
+			linkChange(individualID, associationID, "end_date", formatNullDate(end), ""),
+		)
+	})
+}
+
+func linkChange(individualID, associationID, field, old, new string) audit.Change {
+	return audit.Change{
+		Entity:       audit.EntityIndividualAssociation,
+		EntityID:     associationID,
+		IndividualID: individualID,
+		Field:        field,
+		Old:          old,
+		New:          new,
+	}
+}
+
+// Categories created through the API have no Airtable ID, so the
+// annotations sync leaves them alone.
+
+func (s *Server) createCategory(ctx context.Context, description, note string) (string, error) {
+	if description == "" {
+		return "", statusError(http.StatusBadRequest, "description is required")
+	}
+	var categoryID string
+	err := s.edit(ctx, "create category", note, func(e *edit) error {
+		const insertQ = `INSERT INTO categories (description) VALUES ($1) RETURNING id`
+		err := e.tx.QueryRowContext(ctx, insertQ, description).Scan(&categoryID)
+		if err != nil {
+			return errors.Wrap(err, "inserting category")
+		}
+		return e.record(ctx, categoryChange(categoryID, "description", "", description))
+	})
+	return categoryID, err
+}
+
+func (s *Server) updateCategory(ctx context.Context, categoryID, description, note string) error {
+	if description == "" {
+		return statusError(http.StatusBadRequest, "description is required")
+	}
+	return s.edit(ctx, "update category", note, func(e *edit) error {
+		var current string
+		err := e.tx.QueryRowContext(ctx, `SELECT description FROM categories WHERE id = $1 FOR UPDATE`, categoryID).Scan(&current)
+		if err == sql.ErrNoRows {
+			return statusError(http.StatusNotFound, "category not found")
+		} else if err != nil {
+			return errors.Wrap(err, "querying category")
+		}
+		_, err = e.tx.ExecContext(ctx, `UPDATE categories SET description = $2 WHERE id = $1`, categoryID, description)
+		if err != nil {
+			return errors.Wrap(err, "updating category")
+		}
+		return e.record(ctx, categoryChange(categoryID, "description", current, description))
+	})
+}
+
+func (s *Server) deleteCategory(ctx context.Context, categoryID, note string) error {
+	return s.edit(ctx, "delete category", note, func(e *edit) error {
+		const deleteLinksQ = `DELETE FROM association_categories WHERE category_id = $1 RETURNING association_id`
+		associationIDs, err := queryIDs(ctx, e.tx, deleteLinksQ, categoryID)
+		if err != nil {
+			return errors.Wrap(err, "deleting association categories")
+		}
+		var description string
+		err = e.tx.QueryRowContext(ctx, `DELETE FROM categories WHERE id = $1 RETURNING description`, categoryID).Scan(&description)
+		if err == sql.ErrNoRows {
+			return statusError(http.StatusNotFound, "category not found")
+		} else if err != nil {
+			return errors.Wrap(err, "deleting category")
+		}
+		changes := []audit.Change{categoryChange(categoryID, "description", description, "")}
+		for _, id := range associationIDs {
+			changes = append(changes, associationCategoryChange(id, categoryID, ""))
+			err := e.updatePrimaryCategory(ctx, id)
+			if err != nil {
+				return err
+			}
+		}
+		return e.record(ctx, changes...)
+	})
+}
+
+func (s *Server) addAssociationCategory(ctx context.Context, associationID, categoryID, note string) error {
+	return s.edit(ctx, "add association category", note, func(e *edit) error {
+		err := e.exists(ctx, "associations", associationID)
+		if err != nil {
+			return err
+		}
+		err = e.exists(ctx, "categories", categoryID)
+		if err != nil {
+			return err
+		}
+		const insertQ = `
+			INSERT INTO association_categories (
+				association_id,
+				category_id,
+				updated_ts
+			) VALUES (
+				$1,
+				$2,
+				current_timestamp
+			)
+			ON CONFLICT DO NOTHING
+		`
+		res, err := e.tx.ExecContext(ctx, insertQ, associationID, categoryID)
+		if err != nil {
+			return errors.Wrap(err, "inserting association category")
+		}
+		n, err := res.RowsAffected()
+		if err != nil {
+			return errors.Wrap(err, "counting inserted association categories")
+		}
+		if n == 0 {
+			// Already in the category
+			return nil
+		}
+		err = e.updatePrimaryCategory(ctx, associationID)
+		if err != nil {
+			return err
+		}
+		return e.record(ctx, associationCategoryChange(associationID, "", categoryID))
+	})
+}
+
+func (s *Server) removeAssociationCategory(ctx context.Context, associationID, categoryID, note string) error {
+	return s.edit(ctx, "remove association category", note, func(e *edit) error {
+		const deleteQ = `DELETE FROM association_categories WHERE association_id = $1 AND category_id = $2`
+		res, err := e.tx.ExecContext(ctx, deleteQ, associationID, categoryID)
+		if err != nil {
+			return errors.Wrap(err, "deleting association category")
+		}
+		n, err := res.RowsAffected()
+		if err != nil {
+			return errors.Wrap(err, "counting deleted association categories")
+		}
+		if n == 0 {
+			return statusError(http.StatusNotFound, "association category not found")
+		}
+		err = e.updatePrimaryCategory(ctx, associationID)
+		if err != nil {
+			return err
+		}
+		return e.record(ctx, associationCategoryChange(associationID, categoryID, ""))
+	})
+}
+
+// updatePrimaryCategory sets the association's category_id to its
+// lowest category ID, as the annotations sync does.
+func (e *edit) updatePrimaryCategory(ctx context.Context, associationID string) error {
+	const q = `
+		UPDATE associations SET category_id = (
+			SELECT min(category_id)
+			FROM association_categories
+			WHERE association_categories.association_id = associations.id
+		)
+		WHERE id = $1
+	`
+	_, err := e.tx.ExecContext(ctx, q, associationID)
+	return errors.Wrap(err, "updating primary category")
+}
+
+func categoryChange(categoryID, field, old, new string) audit.Change {
+	return audit.Change{
+		Entity:   audit.EntityCategory,
+		EntityID: categoryID,
+		Field:    field,
+		Old:      old,
+		New:      new,
+	}
+}
+
+func associationCategoryChange(associationID, old, new string) audit.Change {
+	return audit.Change{
+		Entity:   audit.EntityAssociationCategory,
+		EntityID: associationID,
+		Field:    "category_id",
+		Old:      old,
+		New:      new,
+	}
+}
+
+// exists returns a not found error unless table has a row with id.
+func (e *edit) exists(ctx context.Context, table, id string) error {
+	var ok bool
+	err := e.tx.QueryRowContext(ctx, `SELECT EXISTS (SELECT 1 FROM `+table+` WHERE id = $1)`, id).Scan(&ok)
+	if err != nil {
+		return errors.Wrapf(err, "querying %s", table)
+	}
+	if !ok {
+		return statusError(http.StatusNotFound, fmt.Sprintf("%s %s not found", strings.TrimSuffix(table, "s"), id))
+	}
+	return nil
+}
+
+// queryIDs returns the single column of IDs returned by q, never
+// nil so it can be stored in a NOT NULL array column.
+func queryIDs(ctx context.Context, tx *sql.Tx, q string, args ...interface{}) ([]string, error) {
+	rows, err := tx.QueryContext(ctx, q, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	ids := []string{}
+	for rows.Next() {
+		var id string
+		err := rows.Scan(&id)
+		if err != nil {
+			return nil, errors.Wrap(err, "scanning ID")
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
+
+// parseDate parses an optional YYYY-MM-DD date from a request.
+func parseDate(field, s string) (*time.Time, error) {
+	if s == "" {
+		return nil, nil
+	}
+	t, err := time.Parse("2006-01-02", s)
+	if err != nil {
+		return nil, statusError(http.StatusBadRequest, fmt.Sprintf("%s must be a YYYY-MM-DD date", field))
+	}
+	return &t, nil
+}
+
+func formatNullDate(t sql.NullTime) string {
+	if !t.Valid {
+		return ""
+	}
+	return t.Time.Format("2006-01-02")
+}
+
+func stringValue(s *string) string {
+	if s == nil {
+		return ""
+	}
+	return *s
+}
+
+func contains(l []string, s string) bool {
+	for _, e := range l {
+		if e == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,338 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/pkg/errors"
+)
+
+// Write endpoints take an optional "note" describing the change,
+// which is recorded with its source.
+
+func (s *Server) handleCreateIndividual(w http.ResponseWriter, r *http.Request) {
+	body := struct {
+		individualFields
+		Note string `json:"note"`
+	}{}
+	err := json.NewDecoder(r.Body).Decode(&body)
+	if err != nil {
+		resperr(w, r, errors.Wrap(err, "handleCreateIndividual: unmarshaling request body"))
+		return
+	}
+	id, err := s.createIndividual(r.Context(), body.individualFields, body.Note)
+	if err != nil {
+		resperr(w, r, errors.Wrap(err, "handleCreateIndividual: creating individual"))
+		return
+	}
+	i, err := s.store.GetIndividual(r.Context(), id)
+	if err != nil {
+		resperr(w, r, errors.Wrap(err, "handleCreateIndividual: getting individual"))
+		return
+	}
+	respsuccess(w, r, i)
+}
+
+func (s *Server) handleUpdateIndividual(w http.ResponseWriter, r *http.Request) {
+	body := struct {
+		ID string `json:"id"`
+		individualFields
+		Note string `json:"note"`
+	}{}
+	err := json.NewDecoder(r.Body).Decode(&body)
+	if err != nil {
+		resperr(w, r, errors.Wrap(err, "handleUpdateIndividual: unmarshaling request body"))
+		return
+	}
+	err = s.updateIndividual(r.Context(), body.ID, body.individualFields, body.Note)
+	if err != nil {
+		resperr(w, r, errors.Wrap(err, "handleUpdateIndividual: updating individual"))
+		return
+	}
+	i, err := s.store.GetIndividual(r.Context(), body.ID)
+	if err != nil {
+		resperr(w, r, errors.Wrap(err, "handleUpdateIndividual: getting individual"))
+		return
+	}
+	respsuccess(w, r, i)
+}
+
+func (s *Server) handleMergeIndividuals(w http.ResponseWriter, r *http.Request) {
+	body := struct {
+		FromID string `json:"from_id"`
+		IntoID string `json:"into_id"`
+		Note   string `json:"note"`
+	}{}
+	err := json.NewDecoder(r.Body).Decode(&body)
+	if err != nil {
+		resperr(w, r, errors.Wrap(err, "handleMergeIndividuals: unmarshaling request body"))
+		return
+	}
+	err = s.mergeIndividuals(r.Context(), body.FromID, body.IntoID, body.Note)
+	if err != nil {
+		resperr(w, r, errors.Wrap(err, "handleMergeIndividuals: merging individuals"))
+		return
+	}
+	i, err := s.store.GetIndividual(r.Context(), body.IntoID)
+	if err != nil {
+		resperr(w, r, errors.Wrap(err, "handleMergeIndividuals: getting individual"))
+		return
+	}
+	respsuccess(w, r, i)
+}
+
+func (s *Server) handleSplitIndividual(w http.ResponseWriter, r *http.Request) {
+	body := struct {
+		ID   string `json:"id"`
+		Note string `json:"note"`
+	}{}
+	err := json.NewDecoder(r.Body).Decode(&body)
+	if err != nil {
+		resperr(w, r, errors.Wrap(err, "handleSplitIndividual: unmarshaling request body"))
+		return
+	}
+	_, err = s.splitIndividual(r.Context(), body.ID, body.Note)
+	if err != nil {
+		resperr(w, r, errors.Wrap(err, "handleSplitIndividual: splitting individual"))
+		return
+	}
+	i, err := s.store.GetIndividual(r.Context(), body.ID)
+	if err != nil {
+		resperr(w, r, errors.Wrap(err, "handleSplitIndividual: getting individual"))
+		return
+	}
+	respsuccess(w, r, i)
+}
+
+func (s *Server) handleGetDuplicateIndividuals(w http.ResponseWriter, r *http.Request) {
+	resp, err := s.getDuplicateCandidates(r.Context())
+	if err != nil {
+		resperr(w, r, errors.Wrap(err, "handleGetDuplicateIndividuals: getting duplicates"))
+		return
+	}
+	respsuccess(w, r, resp)
+}
+
+func (s *Server) handleAddIndividualAssociation(w http.ResponseWriter, r *http.Request) {
+	body := struct {
+		IndividualID  string `json:"individual_id"`
+		AssociationID string `json:"association_id"`
+		Description   string `json:"description"`
+		StartDate     string `json:"start_date"`
+		EndDate       string `json:"end_date"`
+		Note          string `json:"note"`
+	}{}
+	err := json.NewDecoder(r.Body).Decode(&body)
+	if err != nil {
+		resperr(w, r, errors.Wrap(err, "handleAddIndividualAssociation: unmarshaling request body"))
+		return
+	}
+	start, err := parseDate("start_date", body.StartDate)
+	if err != nil {
+		resperr(w, r, err)
+		return
+	}
+	end, err := parseDate("end_date", body.EndDate)
+	if err != nil {
+		resperr(w, r, err)
+		return
+	}
+	id, err := s.addIndividualAssociation(r.Context(), body.IndividualID, body.AssociationID, body.Description, start, end, body.Note)
+	if err != nil {
+		resperr(w, r, errors.Wrap(err, "handleAddIndividualAssociation: adding association"))
+		return
+	}
+	respsuccess(w, r, map[string]string{"association_id": id})
+}
+
+func (s *Server) handleRemoveIndividualAssociation(w http.ResponseWriter, r *http.Request) {
+	body := struct {
+		IndividualID  string `json:"individual_id"`
+		AssociationID string `json:"association_id"`
+		Note          string `json:"note"`
+	}{}
+	err := json.NewDecoder(r.Body).Decode(&body)
+	if err != nil {
+		resperr(w, r, errors.Wrap(err, "handleRemoveIndividualAssociation: unmarshaling request body"))
+		return
+	}
+	err = s.removeIndividualAssociation(r.Context(), body.IndividualID, body.AssociationID, body.Note)
+	if err != nil {
+		resperr(w, r, errors.Wrap(err, "handleRemoveIndividualAssociation: removing association"))
+		return
+	}
+	respsuccess(w, r, struct{}{})
+}
+
+func (s *Server) handleCreateCategory(w http.ResponseWriter, r *http.Request) {
+	body := struct {
+		Description string `json:"description"`
+		Note        string `json:"note"`
+	}{}
+	err := json.NewDecoder(r.Body).Decode(&body)
+	if err != nil {
+		resperr(w, r, errors.Wrap(err, "handleCreateCategory: unmarshaling request body"))
+		return
+	}
+	id, err := s.createCategory(r.Context(), body.Description, body.Note)
+	if err != nil {
+		resperr(w, r, errors.Wrap(err, "handleCreateCategory: creating category"))
+		return
+	}
+	respsuccess(w, r, category{ID: id, Description: body.Description})
+}
+
+func (s *Server) handleUpdateCategory(w http.ResponseWriter, r *http.Request) {
+	body := struct {
+		ID          string `json:"id"`
+		Description string `json:"description"`
+		Note        string `json:"note"`
+	}{}
+	err := json.NewDecoder(r.Body).Decode(&body)
+	if err != nil {
+		resperr(w, r, errors.Wrap(err, "handleUpdateCategory: unmarshaling request body"))
+		return
+	}
+	err = s.updateCategory(r.Context(), body.ID, body.Description, body.Note)
+	if err != nil {
+		resperr(w, r, errors.Wrap(err, "handleUpdateCategory: updating category"))
+		return
+	}
+	respsuccess(w, r, category{ID: body.ID, Description: body.Description})
+}
+
+func (s *Server) handleDeleteCategory(w http.ResponseWriter, r *http.Request) {
+	body := struct {
+		ID   string `json:"id"`
+		Note string `json:"note"`
+	}{}
+	err := json.NewDecoder(r.Body).Decode(&body)
+	if err != nil {
+		resperr(w, r, errors.Wrap(err, "handleDeleteCategory: unmarshaling request body"))
+		return
+	}
+	err = s.deleteCategory(r.Context(), body.ID, body.Note)
+	if err != nil {
+		resperr(w, r, errors.Wrap(err, "handleDeleteCategory: deleting category"))
+		return
+	}
+	respsuccess(w, r, struct{}{})
+}
+
+func (s *Server) handleAddAssociationCategory(w http.ResponseWriter, r *http.Request) {
+	body := struct {
+		AssociationID string `json:"association_id"`
+		CategoryID    string `json:"category_id"`
+		Note          string `json:"note"`
+	}{}
+	err := json.NewDecoder(r.Body).Decode(&body)
+	if err != nil {
+		resperr(w, r, errors.Wrap(err, "handleAddAssociationCategory: unmarshaling request body"))
+		return
+	}
+	err = s.addAssociationCategory(r.Context(), body.AssociationID, body.CategoryID, body.Note)
+	if err != nil {
+		resperr(w, r, errors.Wrap(err, "handleAddAssociationCategory: adding category"))
+		return
+	}
+	respsuccess(w, r, struct{}{})
+}
+
+func (s *Server) handleRemoveAssociationCategory(w http.ResponseWriter, r *http.Request) {
+	body := struct {
+		AssociationID string `json:"association_id"`
+		CategoryID    string `json:"category_id"`
+		Note          string `json:"note"`
+	}{}
+	err := json.NewDecoder(r.Body).Decode(&body)
+	if err != nil {
+		resperr(w, r, errors.Wrap(err, "handleRemoveAssociationCategory: unmarshaling request body"))
+		return
+	}
+	err = s.removeAssociationCategory(r.Context(), body.AssociationID, body.CategoryID, body.Note)
+	if err != nil {
+		resperr(w, r, errors.Wrap(err, "handleRemoveAssociationCategory: removing category"))
+		return
+	}
+	respsuccess(w, r, struct{}{})
+}
+
+func (s *Server) handleCreateUser(w http.ResponseWriter, r *http.Request) {
+	body := struct {
+		Name string `json:"name"`
+		Role string `json:"role"`
+	}{}
+	err := json.NewDecoder(r.Body).Decode(&body)
+	if err != nil {
+		resperr(w, r, errors.Wrap(err, "handleCreateUser: unmarshaling request body"))
+		return
+	}
+	token, err := CreateUser(r.Context(), s.db, body.Name, body.Role)
+	if err != nil {
+		resperr(w, r, errors.Wrap(err, "handleCreateUser: creating user"))
+		return
+	}
+	respsuccess(w, r, map[string]string{"name": body.Name, "role": body.Role, "token": token})
+}
+
+func (s *Server) handleRevokeUser(w http.ResponseWriter, r *http.Request) {
+	body := struct {
+		Name string `json:"name"`
+	}{}
+	err := json.NewDecoder(r.Body).Decode(&body)
+	if err != nil {
+		resperr(w, r, errors.Wrap(err, "handleRevokeUser: unmarshaling request body"))
+		return
+	}
+	err = RevokeUser(r.Context(), s.db, body.Name)
+	if err != nil {
+		resperr(w, r, errors.Wrap(err, "handleRevokeUser: revoking user"))
+		return
+	}
+	respsuccess(w, r, struct{}{})
+}
+
+func (s *Server) handleCreateAPIKey(w http.ResponseWriter, r *http.Request) {
+	body := struct {
+		Name          string `json:"name"`
+		RatePerMinute int    `json:"rate_per_minute"`
+		DailyQuota    int    `json:"daily_quota"`
+	}{}
+	err := json.NewDecoder(r.Body).Decode(&body)
+	if err != nil {
+		resperr(w, r, errors.Wrap(err, "handleCreateAPIKey: unmarshaling request body"))
+		return
+	}
+	key, err := s.createAPIKey(r.Context(), body.Name, body.RatePerMinute, body.DailyQuota)
+	if err != nil {
+		resperr(w, r, errors.Wrap(err, "handleCreateAPIKey: creating key"))
+		return
+	}
+	respsuccess(w, r, map[string]string{"name": body.Name, "key": key})
+}
+
+func (s *Server) handleRevokeAPIKey(w http.ResponseWriter, r *http.Request) {
+	body := struct {
+		ID string `json:"id"`
+	}{}
+	err := json.NewDecoder(r.Body).Decode(&body)
+	if err != nil {
+		resperr(w, r, errors.Wrap(err, "handleRevokeAPIKey: unmarshaling request body"))
+		return
+	}
+	err = s.revokeAPIKey(r.Context(), body.ID)
+	if err != nil {
+		resperr(w, r, errors.Wrap(err, "handleRevokeAPIKey: revoking key"))
+		return
+	}
+	respsuccess(w, r, struct{}{})
+}
+
+func (s *Server) handleGetAPIKeys(w http.ResponseWriter, r *http.Request) {
+	resp, err := s.getAPIKeys(r.Context())
+	if err != nil {
+		resperr(w, r, errors.Wrap(err, "handleGetAPIKeys: getting keys"))
+		return
+	}
+	respsuccess(w, r, resp)
+}
@@ -0,0 +1,76 @@
+package api
+
+import (
+	"context"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// change is an entry in the audit log.
+type change struct {
+	Entity   string `json:"entity"`
+	EntityID string `json:"entity_id"`
+	Field    string `json:"field"`
+	// OldValue and NewValue are null when the field was created or
+	// removed
+	OldValue  *string   `json:"old_value"`
+	NewValue  *string   `json:"new_value"`
+	Actor     string    `json:"actor"`
+	RunID     string    `json:"run_id"`
+	Command   string    `json:"command"`
+	ChangedTS time.Time `json:"changed_ts"`
+	// Source is where the new value came from
+	Source *provenance `json:"source"`
+}
+
+// GetIndividualHistory returns the changes to an individual, their
+// associations and roles, and contributions matched to them, most
+// recent first.
+func (s *postgresStore) GetIndividualHistory(ctx context.Context, individualID string) ([]change, error) {
+	defer s.metrics.timeQuery("getIndividualHistory")()
+	q := `
+		SELECT
+			entity_type,
+			entity_id,
+			field,
+			old_value,
+			new_value,
+			actor,
+			run_id,
+			audit_runs.command,
+			changed_ts,
+			` + sourceColumns("sources") + `
+		FROM audit_log
+		JOIN audit_runs
+		ON audit_log.run_id = audit_runs.id
+		LEFT JOIN sources
+		ON audit_log.source_id = sources.id
+		WHERE audit_log.individual_id = $1
+		ORDER BY audit_log.id DESC
+	`
+	rows, err := s.db.QueryContext(ctx, q, individualID)
+	if err != nil {
+		return nil, errors.Wrap(err, "querying audit log from db")
+	}
+	defer rows.Close()
+
+	res := []change{}
+	for rows.Next() {
+		var (
+			c      change
+			source nullProvenance
+		)
+		dest := []interface{}{&c.Entity, &c.EntityID, &c.Field, &c.OldValue, &c.NewValue, &c.Actor, &c.RunID, &c.Command, &c.ChangedTS}
+		err := rows.Scan(append(dest, source.dest()...)...)
+		if err != nil {
+			return nil, errors.Wrap(err, "scanning audit log row")
+		}
+		c.Source = source.provenance()
+		res = append(res, c)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, errors.Wrap(err, "reading audit log rows")
+	}
+	return res, nil
+}
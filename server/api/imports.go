@@ -0,0 +1,35 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/pkg/errors"
+	"github.com/vickiniu/project-red-string/data/cfb"
+)
+
+// maxImportReports is the most reports returned by /cfb-imports.
+const maxImportReports = 100
+
+func (s *Server) handleGetCFBImports(w http.ResponseWriter, r *http.Request) {
+	body := struct {
+		Limit int `json:"limit"`
+	}{}
+	err := json.NewDecoder(r.Body).Decode(&body)
+	if err != nil {
+		resperr(w, r, errors.Wrap(err, "handleGetCFBImports: unmarshaling request body"))
+		return
+	}
+	if body.Limit <= 0 {
+		body.Limit = 20
+	} else if body.Limit > maxImportReports {
+		body.Limit = maxImportReports
+	}
+	defer s.metrics.timeQuery("getCFBImports")()
+	resp, err := cfb.Reports(r.Context(), s.db, body.Limit)
+	if err != nil {
+		resperr(w, r, errors.Wrap(err, "handleGetCFBImports: getting import reports"))
+		return
+	}
+	respsuccess(w, r, resp)
+}
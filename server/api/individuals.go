@@ -2,6 +2,8 @@ package api
 
 import (
 	"context"
+	"database/sql"
+	"net/http"
 	"time"
 
 	"github.com/lib/pq"
@@ -17,43 +19,98 @@ type individual struct {
 	Role      string    `json:"role"`
 	Title     string    `json:"title"`
 	Twitter   string    `json:"twitter"`
+	Notes     string    `json:"notes"`
+	Sources   []string  `json:"sources"`
+	// Source is where the individual's annotation came from
+	Source *provenance `json:"source"`
 
 	Associations []association `json:"associations"`
+	// Roles is the history of the individual's roles, most recent
+	// first
+	Roles []role `json:"roles"`
+	// Aliases are other names the individual is known by
+	Aliases []alias `json:"aliases"`
+	// RedirectedFrom is the ID requested, if it's the ID of an
+	// individual merged into this one
+	RedirectedFrom string `json:"redirected_from,omitempty"`
+}
+
+type alias struct {
+	FirstName string `json:"first_name"`
+	LastName  string `json:"last_name"`
+	CFBName   string `json:"cfb_name"`
 }
 
 type association struct {
 	ID          string `json:"id"`
 	Description string `json:"description"`
+	// When listed as one of an individual's associations, Source
+	// is where it came from and the dates are when they held it,
+	// if known
+	Source    *provenance `json:"source,omitempty"`
+	StartDate *time.Time  `json:"start_date,omitempty"`
+	EndDate   *time.Time  `json:"end_date,omitempty"`
 }
 
-func (s *Server) getIndividual(ctx context.Context, id string) (*individual, error) {
+func (s *postgresStore) GetIndividual(ctx context.Context, id string) (*individual, error) {
+	defer s.metrics.timeQuery("getIndividual")()
 	i := &individual{}
-	const q = `
+	// Merged individuals redirect to the individual they were
+	// merged into
+	const redirectQ = `SELECT to_id FROM individual_redirects WHERE from_id = $1`
+	var to string
+	err := s.db.QueryRowContext(ctx, redirectQ, id).Scan(&to)
+	if err == nil {
+		i.RedirectedFrom = id
+		id = to
+	} else if err != sql.ErrNoRows {
+		return nil, errors.Wrap(err, "querying redirect")
+	}
+	q := `
 		SELECT
-			id,
+			individuals.id,
 			first_name,
 			last_name,
 			COALESCE(zip, ''),
 			updated_ts,
 			COALESCE(role, ''),
 			COALESCE(title, ''),
-			COALESCE(twitter, '')
+			COALESCE(twitter, ''),
+			COALESCE(notes, ''),
+			source_urls,
+			` + sourceColumns("sources") + `
 		FROM individuals
-		WHERE id = $1
+		LEFT JOIN sources
+		ON individuals.source_id = sources.id
+		WHERE individuals.id = $1
 	`
-	err := s.db.QueryRowContext(ctx, q, id).Scan(
-		&i.ID, &i.FirstName, &i.LastName, &i.ZIP, &i.UpdatedTS, &i.Role, &i.Title, &i.Twitter,
+	var (
+		sources pq.StringArray
+		source  nullProvenance
 	)
-	if err != nil {
+	dest := append([]interface{}{
+		&i.ID, &i.FirstName, &i.LastName, &i.ZIP, &i.UpdatedTS, &i.Role, &i.Title, &i.Twitter, &i.Notes, &sources,
+	}, source.dest()...)
+	err = s.db.QueryRowContext(ctx, q, id).Scan(dest...)
+	if err == sql.ErrNoRows {
+		return nil, statusError(http.StatusNotFound, "individual not found")
+	} else if err != nil {
 		return nil, errors.Wrap(err, "querying individual from db")
 	}
-	const associationsQ = `
+	i.Sources = sources
+	i.Source = source.provenance()
+	associationsQ := `
 		SELECT
-			id,
-			description
+			associations.id,
+			associations.description,
+			individual_associations.start_date,
+			individual_associations.end_date,
+			` + sourceColumns("sources") + `
 		FROM associations
 		JOIN individual_associations
 		ON associations.id = individual_associations.association_id
+		LEFT JOIN sources
+		ON individual_associations.source_id = sources.id
 		WHERE individual_associations.individual_id = $1
 	`
 	rows, err := s.db.QueryContext(ctx, associationsQ, id)
@@ -62,19 +119,59 @@ func (s *Server) getIndividual(ctx context.Context, id string) (*individual, err
 	}
 	defer rows.Close()
 	for rows.Next() {
-		var a association
-		err := rows.Scan(&a.ID, &a.Description)
+		var (
+			a      association
+			source nullProvenance
+		)
+		err := rows.Scan(append([]interface{}{&a.ID, &a.Description, &a.StartDate, &a.EndDate}, source.dest()...)...)
 		if err != nil {
 			return nil, errors.Wrap(err, "scanning association row")
 		}
+		a.Source = source.provenance()
 		i.Associations = append(i.Associations, a)
 	}
 	if err := rows.Err(); err != nil {
 		return nil, errors.Wrap(err, "reading association rows")
 	}
+	i.Roles, err = s.getRoles(ctx, id)
+	if err != nil {
+		return nil, errors.Wrap(err, "getting roles")
+	}
+	i.Aliases, err = s.getAliases(ctx, id)
+	if err != nil {
+		return nil, errors.Wrap(err, "getting aliases")
+	}
 	return i, nil
 }
 
+func (s *postgresStore) getAliases(ctx context.Context, individualID string) ([]alias, error) {
+	defer s.metrics.timeQuery("getAliases")()
+	const q = `
+		SELECT first_name, last_name, cfb_name
+		FROM individual_aliases
+		WHERE individual_id = $1
+		ORDER BY cfb_name
+	`
+	rows, err := s.db.QueryContext(ctx, q, individualID)
+	if err != nil {
+		return nil, errors.Wrap(err, "querying aliases from db")
+	}
+	defer rows.Close()
+	aliases := []alias{}
+	for rows.Next() {
+		var a alias
+		err := rows.Scan(&a.FirstName, &a.LastName, &a.CFBName)
+		if err != nil {
+			return nil, errors.Wrap(err, "scanning alias row")
+		}
+		aliases = append(aliases, a)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, errors.Wrap(err, "reading alias rows")
+	}
+	return aliases, nil
+}
+
 // individualname contains only the ID and full name of an
 // individual. Used to return list results from search queries
 type individualname struct {
@@ -83,7 +180,8 @@ type individualname struct {
 	LastName  string `json:"last_name"`
 }
 
-func (s *Server) searchIndividuals(ctx context.Context, query string) ([]individualname, error) {
+func (s *postgresStore) SearchIndividuals(ctx context.Context, query string) ([]individualname, error) {
+	defer s.metrics.timeQuery("searchIndividuals")()
 	// Don't start showing suggestions until query is at least 3 chars
 	if len(query) < 3 {
 		return nil, nil
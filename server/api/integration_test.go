@@ -0,0 +1,246 @@
+package api
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"reflect"
+	"testing"
+
+	"github.com/vickiniu/project-red-string/data/cfb"
+	"github.com/vickiniu/project-red-string/internal/testdb"
+	"github.com/vickiniu/project-red-string/jobs"
+)
+
+// The integration tests run the API against the fixtures in
+// internal/testdb, which mirror newTestStore with IDs offset by 1000.
+
+func TestIntegrationRead(t *testing.T) {
+	db, cleanup := testdb.New(t)
+	defer cleanup()
+	testdb.LoadFixtures(t, db)
+	h := NewServer(db).API()
+
+	var i individual
+	decode(t, post(t, h, "/get-individual", map[string]string{"id": "1001"}), http.StatusOK, &i)
+	if i.FirstName != "Jane" || i.LastName != "Doe" || len(i.Associations) != 2 || len(i.Roles) != 1 {
+		t.Errorf("got %+v, want Jane Doe with 2 associations and 1 role", i)
+	}
+	w := post(t, h, "/get-individual", map[string]string{"id": "404"})
+	if w.Code != http.StatusNotFound {
+		t.Errorf("got status %d for a missing individual, want 404", w.Code)
+	}
+
+	var found []individualname
+	decode(t, post(t, h, "/search-individuals", map[string]string{"query": "doe"}), http.StatusOK, &found)
+	if len(found) != 1 || found[0].ID != "1001" {
+		t.Errorf("search: got %+v, want Jane Doe", found)
+	}
+
+	var received []contribution
+	decode(t, post(t, h, "/individual-contributions-received", map[string]interface{}{"individual_id": "1001", "with_roles": true}), http.StatusOK, &received)
+	want := map[string]string{
+		"1040": "Community Board 3",
+		"1041": "District 3, Council Member",
+	}
+	if len(received) != len(want) {
+		t.Fatalf("got %d contributions received, want %d", len(received), len(want))
+	}
+	for _, c := range received {
+		if len(c.RecipientRoles) != 1 || c.RecipientRoles[0].Description != want[c.ID] {
+			t.Errorf("contribution %s: got recipient roles %+v, want %s", c.ID, c.RecipientRoles, want[c.ID])
+		}
+	}
+
+	var given []contribution
+	decode(t, post(t, h, "/individual-contributions-given", map[string]interface{}{"individual_id": "1001"}), http.StatusOK, &given)
+	if len(given) != 1 || given[0].ID != "1042" || given[0].RecipientID != "" {
+		t.Errorf("got %+v, want contribution 1042 to an unmatched recipient", given)
+	}
+
+	ids := func(path string, body interface{}, header ...string) []string {
+		var resp []struct {
+			ID string `json:"id"`
+		}
+		decode(t, post(t, h, path, body, header...), http.StatusOK, &resp)
+		var res []string
+		for _, r := range resp {
+			res = append(res, r.ID)
+		}
+		return res
+	}
+	tests := []struct {
+		path string
+		body interface{}
+		want []string
+	}{
+		{"/categories", nil, []string{"1020"}},
+		{"/individual-categories", map[string]string{"category_id": "1020"}, []string{"1001"}},
+		{"/category-associations", map[string]string{"category_id": "1020"}, []string{"1010"}},
+	}
+	for _, tt := range tests {
+		if got := ids(tt.path, tt.body); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s %v: got %v, want %v", tt.path, tt.body, got, tt.want)
+		}
+	}
+
+	admin, err := CreateUser(context.Background(), db, "admin", RoleAdmin)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := ids("/uncategorized-associations", nil, "Authorization", "Bearer "+admin)
+	if want := []string{"1012", "1011"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("/uncategorized-associations: got %v, want %v", got, want)
+	}
+}
+
+func TestIntegrationCuration(t *testing.T) {
+	db, cleanup := testdb.New(t)
+	defer cleanup()
+	testdb.LoadFixtures(t, db)
+	h := NewServer(db).API()
+
+	token, err := CreateUser(context.Background(), db, "editor", RoleEditor)
+	if err != nil {
+		t.Fatal(err)
+	}
+	auth := []string{"Authorization", "Bearer " + token}
+	body := map[string]string{"id": "1002", "role": "Tenant Organizer", "note": "test"}
+	if w := post(t, h, "/update-individual", body); w.Code != http.StatusUnauthorized {
+		t.Errorf("got status %d without a token, want 401", w.Code)
+	}
+
+	// Read first, so the edit has to invalidate the cached response
+	var i individual
+	decode(t, post(t, h, "/get-individual", map[string]string{"id": "1002"}), http.StatusOK, &i)
+	decode(t, post(t, h, "/update-individual", body, auth...), http.StatusOK, &i)
+	if i.Role != "Tenant Organizer" {
+		t.Errorf("got role %q after the update, want Tenant Organizer", i.Role)
+	}
+	decode(t, post(t, h, "/get-individual", map[string]string{"id": "1002"}), http.StatusOK, &i)
+	if i.Role != "Tenant Organizer" {
+		t.Errorf("got role %q reading after the update, want Tenant Organizer", i.Role)
+	}
+
+	var history []change
+	decode(t, post(t, h, "/individual-history", map[string]string{"individual_id": "1002"}, auth...), http.StatusOK, &history)
+	var recorded bool
+	for _, c := range history {
+		if c.Field == "role" && c.Actor == "editor" && c.NewValue != nil && *c.NewValue == "Tenant Organizer" {
+			recorded = true
+		}
+	}
+	if !recorded {
+		t.Errorf("got history %+v, want the role change by editor", history)
+	}
+}
+
+func TestIntegrationMergeHistory(t *testing.T) {
+	db, cleanup := testdb.New(t)
+	defer cleanup()
+	testdb.LoadFixtures(t, db)
+	h := NewServer(db).API()
+
+	token, err := CreateUser(context.Background(), db, "editor", RoleEditor)
+	if err != nil {
+		t.Fatal(err)
+	}
+	auth := []string{"Authorization", "Bearer " + token}
+	// associationChanges returns the individual's association changes
+	// as "old -> new"
+	associationChanges := func(individualID string) []string {
+		var history []change
+		decode(t, post(t, h, "/individual-history", map[string]string{"individual_id": individualID}, auth...), http.StatusOK, &history)
+		var res []string
+		for _, c := range history {
+			if c.Entity != "individual_association" || c.Field == "start_date" || c.Field == "end_date" {
+				continue
+			}
+			value := func(v *string) string {
+				if v == nil {
+					return ""
+				}
+				return *v
+			}
+			res = append(res, c.Field+": "+value(c.OldValue)+" -> "+value(c.NewValue))
+		}
+		return res
+	}
+
+	// John gets Jane's Community Board 3, and loses it when they're
+	// split, recorded by description as edits through the API are
+	body := map[string]string{"from_id": "1001", "into_id": "1002", "note": "test"}
+	decode(t, post(t, h, "/merge-individuals", body, auth...), http.StatusOK, &individual{})
+	decode(t, post(t, h, "/split-individual", map[string]string{"id": "1001", "note": "test"}, auth...), http.StatusOK, &individual{})
+	got := associationChanges("1002")
+	want := []string{"association: Community Board 3 -> ", "association:  -> Community Board 3"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got John's changes %q, want %q", got, want)
+	}
+	for _, c := range associationChanges("1001") {
+		if c != "association:  -> Community Board 3" && c != "association:  -> Tenants Union" {
+			t.Errorf("got Jane's change %q, want her associations restored by description", c)
+		}
+	}
+}
+
+func TestIntegrationJobRuns(t *testing.T) {
+	db, cleanup := testdb.New(t)
+	defer cleanup()
+	h := NewServer(db).API()
+	ctx := context.Background()
+
+	err := jobs.Run(ctx, db, "import cfb", "CFB_sample.csv", func(ctx context.Context) (jobs.Counts, error) {
+		return jobs.Counts{"inserted": 2}, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	admin, err := CreateUser(ctx, db, "admin", RoleAdmin)
+	if err != nil {
+		t.Fatal(err)
+	}
+	editor, err := CreateUser(ctx, db, "editor", RoleEditor)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w := post(t, h, "/job-runs", map[string]string{}, "Authorization", "Bearer "+editor)
+	if w.Code != http.StatusForbidden {
+		t.Errorf("got status %d for an editor, want 403", w.Code)
+	}
+	var runs []jobs.RunRecord
+	decode(t, post(t, h, "/job-runs", map[string]string{"job": "import cfb"}, "Authorization", "Bearer "+admin), http.StatusOK, &runs)
+	if len(runs) != 1 || runs[0].Status != jobs.StatusSucceeded || runs[0].Counts["inserted"] != 2 {
+		t.Errorf("got %+v, want the import run", runs)
+	}
+}
+
+func TestIntegrationCFBImports(t *testing.T) {
+	db, cleanup := testdb.New(t)
+	defer cleanup()
+	testdb.LoadFixtures(t, db)
+	h := NewServer(db).API()
+	ctx := context.Background()
+
+	f, err := os.Open(testdb.Path("CFB_sample.csv"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	_, err = cfb.Import(ctx, db, "CFB_sample.csv", f, cfb.Options{})
+	if err != nil {
+		t.Fatalf("importing: %v", err)
+	}
+	admin, err := CreateUser(ctx, db, "admin", RoleAdmin)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var reports []cfb.Report
+	decode(t, post(t, h, "/cfb-imports", map[string]string{}, "Authorization", "Bearer "+admin), http.StatusOK, &reports)
+	if len(reports) != 1 || reports[0].File != "CFB_sample.csv" || reports[0].Inserted != 2 ||
+		reports[0].RecipientMatchRate != 0.75 || len(reports[0].Errors) != 0 {
+		t.Errorf("got %+v, want the import of CFB_sample.csv", reports)
+	}
+}
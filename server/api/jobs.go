@@ -0,0 +1,37 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/pkg/errors"
+	"github.com/vickiniu/project-red-string/jobs"
+)
+
+// maxJobRuns is the most job runs returned by /job-runs.
+const maxJobRuns = 500
+
+func (s *Server) handleGetJobRuns(w http.ResponseWriter, r *http.Request) {
+	body := struct {
+		// Job is the job to list runs of, or empty for every job
+		Job   string `json:"job"`
+		Limit int    `json:"limit"`
+	}{}
+	err := json.NewDecoder(r.Body).Decode(&body)
+	if err != nil {
+		resperr(w, r, errors.Wrap(err, "handleGetJobRuns: unmarshaling request body"))
+		return
+	}
+	if body.Limit <= 0 {
+		body.Limit = 50
+	} else if body.Limit > maxJobRuns {
+		body.Limit = maxJobRuns
+	}
+	defer s.metrics.timeQuery("getJobRuns")()
+	resp, err := jobs.History(r.Context(), s.db, body.Job, body.Limit)
+	if err != nil {
+		resperr(w, r, errors.Wrap(err, "handleGetJobRuns: getting job runs"))
+		return
+	}
+	respsuccess(w, r, resp)
+}
@@ -0,0 +1,163 @@
+package api
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// keyCacheTTL is how long API keys are cached, and so how long a
+// revoked key may still be accepted by other servers.
+const keyCacheTTL = time.Minute
+
+// apiKey is an API client's key.
+type apiKey struct {
+	ID            string     `json:"id"`
+	Name          string     `json:"name"`
+	RatePerMinute int        `json:"rate_per_minute"`
+	DailyQuota    int        `json:"daily_quota,omitempty"`
+	CreatedBy     string     `json:"created_by"`
+	CreatedTS     time.Time  `json:"created_ts"`
+	RevokedTS     *time.Time `json:"revoked_ts,omitempty"`
+
+	limit RateLimit
+}
+
+// keyCache caches API keys by hash, so rate limited requests don't
+// each query the database.
+type keyCache struct {
+	mu      sync.Mutex
+	entries map[string]keyCacheEntry
+}
+
+type keyCacheEntry struct {
+	key     *apiKey // nil if there's no such key
+	fetched time.Time
+}
+
+func newKeyCache() *keyCache {
+	return &keyCache{entries: make(map[string]keyCacheEntry)}
+}
+
+// lookup returns the active API key, or nil if the key is unknown
+// or revoked.
+func (c *keyCache) lookup(ctx context.Context, store Store, key string) (*apiKey, error) {
+	hash := hashToken(key)
+	c.mu.Lock()
+	e, ok := c.entries[hash]
+	c.mu.Unlock()
+	if ok && time.Since(e.fetched) < keyCacheTTL {
+		return e.key, nil
+	}
+
+	k, err := store.APIKeyByHash(ctx, hash)
+	if err != nil {
+		return nil, err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	// Drop expired entries so unknown keys don't accumulate
+	for h, e := range c.entries {
+		if time.Since(e.fetched) >= keyCacheTTL {
+			delete(c.entries, h)
+		}
+	}
+	c.entries[hash] = keyCacheEntry{key: k, fetched: time.Now()}
+	return k, nil
+}
+
+// forget drops all cached keys, e.g. after one is revoked.
+func (c *keyCache) forget() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries = make(map[string]keyCacheEntry)
+}
+
+// createAPIKey issues a key for a client and returns it. The key
+// can't be recovered later.
+func (s *Server) createAPIKey(ctx context.Context, name string, ratePerMinute, dailyQuota int) (string, error) {
+	if name == "" {
+		return "", statusError(http.StatusBadRequest, "name is required")
+	}
+	if ratePerMinute <= 0 || dailyQuota < 0 {
+		return "", statusError(http.StatusBadRequest, "rate_per_minute must be positive and daily_quota not negative")
+	}
+	key, err := newToken()
+	if err != nil {
+		return "", err
+	}
+	const insertQ = `
+		INSERT INTO api_keys (
+			name,
+			key_hash,
+			rate_per_minute,
+			daily_quota,
+			created_by,
+			created_ts
+		) VALUES (
+			$1,
+			$2,
+			$3,
+			NULLIF($4, 0),
+			$5,
+			current_timestamp
+		)
+	`
+	_, err = s.db.ExecContext(ctx, insertQ, name, hashToken(key), ratePerMinute, dailyQuota, requestUser(ctx).Name)
+	if err != nil {
+		return "", errors.Wrap(err, "inserting API key")
+	}
+	return key, nil
+}
+
+func (s *Server) revokeAPIKey(ctx context.Context, id string) error {
+	const q = `
+		UPDATE api_keys SET revoked_ts = current_timestamp
+		WHERE id = $1 AND revoked_ts IS NULL
+	`
+	res, err := s.db.ExecContext(ctx, q, id)
+	if err != nil {
+		return errors.Wrap(err, "revoking API key")
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return errors.Wrap(err, "counting revoked API keys")
+	}
+	if n == 0 {
+		return statusError(http.StatusNotFound, "no active API key "+id)
+	}
+	s.keys.forget()
+	return nil
+}
+
+func (s *Server) getAPIKeys(ctx context.Context) ([]apiKey, error) {
+	defer s.metrics.timeQuery("getAPIKeys")()
+	const q = `
+		SELECT id, name, rate_per_minute, COALESCE(daily_quota, 0), created_by, created_ts, revoked_ts
+		FROM api_keys
+		ORDER BY created_ts
+	`
+	rows, err := s.db.QueryContext(ctx, q)
+	if err != nil {
+		return nil, errors.Wrap(err, "querying API keys from db")
+	}
+	defer rows.Close()
+
+	keys := []apiKey{}
+	for rows.Next() {
+		var k apiKey
+		err := rows.Scan(&k.ID, &k.Name, &k.RatePerMinute, &k.DailyQuota, &k.CreatedBy, &k.CreatedTS, &k.RevokedTS)
+		if err != nil {
+			return nil, errors.Wrap(err, "scanning API key row")
+		}
+		keys = append(keys, k)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, errors.Wrap(err, "reading API key rows")
+	}
+	return keys, nil
+}
@@ -0,0 +1,319 @@
+package api
+
+import (
+	"context"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/vickiniu/project-red-string/internal/sqlutil"
+)
+
+// memoryStore is a Store serving a dataset held in memory, for
+// testing handlers without a database. It's filled with the add
+// methods, whose arguments are stored as the Postgres store would
+// return them.
+type memoryStore struct {
+	mu sync.RWMutex
+	// individuals are kept in the order they're added, with their
+	// associations, roles and aliases
+	individuals []individual
+	redirects   map[string]string
+	// associations are all the associations, whether or not anyone
+	// has them
+	associations []association
+	categories   []category
+	// categoryAssociations are the IDs of each category's
+	// associations
+	categoryAssociations map[string][]string
+	contributions        []contribution
+	history              map[string][]change
+	// users and keys are keyed on the hash of their token or key
+	users   map[string]*user
+	keys    map[string]*apiKey
+	version int64
+}
+
+func newMemoryStore() *memoryStore {
+	return &memoryStore{
+		redirects:            make(map[string]string),
+		categoryAssociations: make(map[string][]string),
+		history:              make(map[string][]change),
+		users:                make(map[string]*user),
+		keys:                 make(map[string]*apiKey),
+		version:              1,
+	}
+}
+
+func (m *memoryStore) addIndividual(i individual) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.individuals = append(m.individuals, i)
+}
+
+func (m *memoryStore) addAssociation(a association) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.associations = append(m.associations, a)
+}
+
+func (m *memoryStore) addCategory(c category, associationIDs ...string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.categories = append(m.categories, c)
+	m.categoryAssociations[c.ID] = associationIDs
+}
+
+func (m *memoryStore) addContribution(c contribution) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.contributions = append(m.contributions, c)
+}
+
+// addRedirect redirects an individual merged away to the one they
+// were merged into.
+func (m *memoryStore) addRedirect(fromID, toID string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.redirects[fromID] = toID
+}
+
+// addChange adds an entry to the individual's history; entries are
+// returned most recent, i.e. last added, first.
+func (m *memoryStore) addChange(individualID string, c change) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.history[individualID] = append([]change{c}, m.history[individualID]...)
+}
+
+func (m *memoryStore) addUser(token string, u user) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.users[hashToken(token)] = &u
+}
+
+func (m *memoryStore) addAPIKey(key string, k apiKey) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	k.limit = RateLimit{PerMinute: k.RatePerMinute, Daily: k.DailyQuota}
+	m.keys[hashToken(key)] = &k
+}
+
+// bumpVersion changes the data version, as an import would.
+func (m *memoryStore) bumpVersion() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.version++
+}
+
+// individual returns the individual with the ID, or nil.
+func (m *memoryStore) individual(id string) *individual {
+	for i := range m.individuals {
+		if m.individuals[i].ID == id {
+			return &m.individuals[i]
+		}
+	}
+	return nil
+}
+
+func (m *memoryStore) GetIndividual(ctx context.Context, id string) (*individual, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	var redirectedFrom string
+	if to, ok := m.redirects[id]; ok {
+		redirectedFrom, id = id, to
+	}
+	found := m.individual(id)
+	if found == nil {
+		return nil, statusError(http.StatusNotFound, "individual not found")
+	}
+	i := *found
+	i.RedirectedFrom = redirectedFrom
+	if i.Aliases == nil {
+		i.Aliases = []alias{}
+	}
+	return &i, nil
+}
+
+func (m *memoryStore) SearchIndividuals(ctx context.Context, query string) ([]individualname, error) {
+	if len(query) < 3 {
+		return nil, nil
+	}
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	contains := func(s string) bool {
+		return strings.Contains(strings.ToLower(s), strings.ToLower(query))
+	}
+	var res []individualname
+	for _, i := range m.individuals {
+		if contains(sqlutil.CFBName(i.FirstName, i.LastName)) || contains(i.FirstName) || contains(i.LastName) {
+			res = append(res, nameOf(i))
+		}
+	}
+	return res, nil
+}
+
+func (m *memoryStore) ContributionsReceived(ctx context.Context, individualID string, withRoles bool) ([]contribution, error) {
+	return m.contributionsWhere(func(c contribution) bool { return c.RecipientID == individualID }, withRoles), nil
+}
+
+func (m *memoryStore) ContributionsGiven(ctx context.Context, individualID string, withRoles bool) ([]contribution, error) {
+	return m.contributionsWhere(func(c contribution) bool { return c.ContributorID == individualID }, withRoles), nil
+}
+
+func (m *memoryStore) contributionsWhere(match func(contribution) bool, withRoles bool) []contribution {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	var res []contribution
+	for _, c := range m.contributions {
+		if match(c) {
+			res = append(res, c)
+		}
+	}
+	if withRoles {
+		annotateRoles(res, m.datedRoles(contributionParties(res)))
+	}
+	return res
+}
+
+// datedRoles is the memory store's getDatedRoles.
+func (m *memoryStore) datedRoles(individualIDs []string) map[string][]activeRole {
+	roles := make(map[string][]activeRole)
+	for _, id := range individualIDs {
+		i := m.individual(id)
+		if i == nil || roles[id] != nil {
+			continue
+		}
+		for _, r := range i.Roles {
+			if r.StartDate == nil {
+				continue
+			}
+			description := r.Title + ", " + r.Role
+			if r.Title == "" {
+				description = r.Role
+			} else if r.Role == "" {
+				description = r.Title
+			}
+			roles[id] = append(roles[id], activeRole{Kind: "role", Description: description, StartDate: *r.StartDate, EndDate: r.EndDate, individualID: id})
+		}
+		for _, a := range i.Associations {
+			if a.StartDate == nil {
+				continue
+			}
+			roles[id] = append(roles[id], activeRole{Kind: "association", Description: a.Description, StartDate: *a.StartDate, EndDate: a.EndDate, individualID: id})
+		}
+	}
+	return roles
+}
+
+func (m *memoryStore) GetCategories(ctx context.Context) ([]category, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return append([]category(nil), m.categories...), nil
+}
+
+func (m *memoryStore) GetIndividualsByCategory(ctx context.Context, categoryID string) ([]individualname, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	var res []individualname
+	for _, i := range m.individuals {
+		for _, a := range i.Associations {
+			if contains(m.categoryAssociations[categoryID], a.ID) {
+				res = append(res, nameOf(i))
+				break
+			}
+		}
+	}
+	return res, nil
+}
+
+func (m *memoryStore) GetAssociationsForCategory(ctx context.Context, categoryID string) ([]association, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	var res []association
+	for _, a := range m.associations {
+		if contains(m.categoryAssociations[categoryID], a.ID) {
+			res = append(res, association{ID: a.ID, Description: a.Description})
+		}
+	}
+	return res, nil
+}
+
+func (m *memoryStore) GetIndividualsByAssociation(ctx context.Context, associationID string) ([]individualname, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	var res []individualname
+	for _, i := range m.individuals {
+		for _, a := range i.Associations {
+			if a.ID == associationID {
+				res = append(res, nameOf(i))
+				break
+			}
+		}
+	}
+	return res, nil
+}
+
+func (m *memoryStore) GetUncategorizedAssociations(ctx context.Context) ([]uncategorizedAssociation, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	categorized := make(map[string]bool)
+	for _, ids := range m.categoryAssociations {
+		for _, id := range ids {
+			categorized[id] = true
+		}
+	}
+	var res []uncategorizedAssociation
+	for _, a := range m.associations {
+		if categorized[a.ID] {
+			continue
+		}
+		n := 0
+		for _, i := range m.individuals {
+			for _, ia := range i.Associations {
+				if ia.ID == a.ID {
+					n++
+					break
+				}
+			}
+		}
+		res = append(res, uncategorizedAssociation{ID: a.ID, Description: a.Description, IndividualCount: n})
+	}
+	sort.SliceStable(res, func(i, j int) bool {
+		return res[i].Description < res[j].Description
+	})
+	return res, nil
+}
+
+func (m *memoryStore) GetIndividualHistory(ctx context.Context, individualID string) ([]change, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return append([]change{}, m.history[individualID]...), nil
+}
+
+func (m *memoryStore) UserByTokenHash(ctx context.Context, hash string) (*user, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.users[hash], nil
+}
+
+func (m *memoryStore) APIKeyByHash(ctx context.Context, hash string) (*apiKey, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.keys[hash], nil
+}
+
+func (m *memoryStore) DataVersion(ctx context.Context) (int64, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.version, nil
+}
+
+func (m *memoryStore) Ping(ctx context.Context) error {
+	return nil
+}
+
+func nameOf(i individual) individualname {
+	return individualname{ID: i.ID, FirstName: i.FirstName, LastName: i.LastName}
+}
@@ -0,0 +1,591 @@
+package api
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/lib/pq"
+	"github.com/pkg/errors"
+	"github.com/vickiniu/project-red-string/audit"
+)
+
+// mergedIndividual is the state of an individual being merged.
+type mergedIndividual struct {
+	airtableID string
+	cfbName    string
+	sources    pq.StringArray
+	values     []string // editableColumns
+}
+
+func (e *edit) mergedIndividual(ctx context.Context, id string) (*mergedIndividual, error) {
+	selectList := "COALESCE(airtable_id, ''), cfb_name, source_urls"
+	for _, c := range editableColumns {
+		selectList += ", COALESCE(" + c + ", '')"
+	}
+	m := &mergedIndividual{values: make([]string, len(editableColumns))}
+	dest := []interface{}{&m.airtableID, &m.cfbName, &m.sources}
+	for i := range m.values {
+		dest = append(dest, &m.values[i])
+	}
+	q := `SELECT ` + selectList + ` FROM individuals WHERE id = $1 FOR UPDATE`
+	err := e.tx.QueryRowContext(ctx, q, id).Scan(dest...)
+	if err == sql.ErrNoRows {
+		return nil, statusError(http.StatusNotFound, fmt.Sprintf("individual %s not found", id))
+	} else if err != nil {
+		return nil, errors.Wrap(err, "querying individual")
+	}
+	return m, nil
+}
+
+// mergeIndividuals merges the duplicate individual fromID into
+// intoID. Their contributions, associations, roles and aliases are
+// moved over, fields missing from intoID are filled in from fromID,
+// fromID's name becomes an alias of intoID and fromID is deleted,
+// leaving a redirect to intoID. What was moved is recorded in
+// individual_merges so the merge can be undone by splitIndividual.
+func (s *Server) mergeIndividuals(ctx context.Context, fromID, intoID, note string) error {
+	if fromID == "" || intoID == "" || fromID == intoID {
+		return statusError(http.StatusBadRequest, "from_id and into_id must be two different individuals")
+	}
+	return s.edit(ctx, "merge individuals", note, func(e *edit) error {
+		from, err := e.mergedIndividual(ctx, fromID)
+		if err != nil {
+			return err
+		}
+		into, err := e.mergedIndividual(ctx, intoID)
+		if err != nil {
+			return err
+		}
+		if from.airtableID != "" && into.airtableID != "" {
+			return statusError(http.StatusBadRequest, "both individuals are synced from Airtable; merge their records in Airtable instead")
+		}
+
+		var snapshot, associations string
+		const snapshotQ = `SELECT row_to_json(individuals)::text FROM individuals WHERE id = $1`
+		err = e.tx.QueryRowContext(ctx, snapshotQ, fromID).Scan(&snapshot)
+		if err != nil {
+			return errors.Wrap(err, "saving merged individual")
+		}
+		const associationsSnapshotQ = `
+			SELECT COALESCE(json_agg(individual_associations), '[]')::text
+			FROM individual_associations
+			WHERE individual_id = $1
+		`
+		err = e.tx.QueryRowContext(ctx, associationsSnapshotQ, fromID).Scan(&associations)
+		if err != nil {
+			return errors.Wrap(err, "saving merged individual associations")
+		}
+
+		var changes []audit.Change
+		moved := make(map[string][]string)
+		for _, column := range []string{"contributor_id", "recipient_id"} {
+			updateQ := `UPDATE contributions SET ` + column + ` = $2 WHERE ` + column + ` = $1 RETURNING id`
+			ids, err := queryIDs(ctx, e.tx, updateQ, fromID, intoID)
+			if err != nil {
+				return errors.Wrap(err, "moving contributions")
+			}
+			moved[column] = ids
+			for _, id := range ids {
+				changes = append(changes, contributionChange(intoID, id, column, fromID, intoID))
+			}
+		}
+
+		// Associations intoID already has keep their dates
+		const associationsQ = `
+			INSERT INTO individual_associations (
+				individual_id,
+				association_id,
+				start_date,
+				end_date,
+				source_id,
+				updated_ts
+			)
+			SELECT $2, association_id, start_date, end_date, source_id, current_timestamp
+			FROM individual_associations
+			WHERE individual_id = $1
+			ON CONFLICT DO NOTHING
+			RETURNING association_id
+		`
+		addedAssociations, err := queryIDs(ctx, e.tx, associationsQ, fromID, intoID)
+		if err != nil {
+			return errors.Wrap(err, "moving associations")
+		}
+		linked, err := associationChanges(ctx, e.tx, intoID, addedAssociations, true)
+		if err != nil {
+			return err
+		}
+		changes = append(changes, linked...)
+
+		const rolesQ = `UPDATE individual_roles SET individual_id = $2 WHERE individual_id = $1 RETURNING id`
+		roles, err := queryIDs(ctx, e.tx, rolesQ, fromID, intoID)
+		if err != nil {
+			return errors.Wrap(err, "moving roles")
+		}
+		for _, id := range roles {
+			changes = append(changes, roleChange(intoID, id, "individual_id", fromID, intoID))
+		}
+
+		const aliasesQ = `UPDATE individual_aliases SET individual_id = $2 WHERE individual_id = $1 RETURNING id`
+		aliases, err := queryIDs(ctx, e.tx, aliasesQ, fromID, intoID)
+		if err != nil {
+			return errors.Wrap(err, "moving aliases")
+		}
+		var addedAlias sql.NullString
+		if from.cfbName != into.cfbName {
+			const aliasQ = `
+				INSERT INTO individual_aliases (
+					individual_id,
+					first_name,
+					last_name,
+					cfb_name,
+					source_id
+				)
+				SELECT $1, first_name, last_name, cfb_name, $3
+				FROM individuals
+				WHERE id = $2 AND NOT EXISTS (
+					SELECT 1
+					FROM individual_aliases
+					WHERE individual_id = $1 AND cfb_name = individuals.cfb_name
+				)
+				RETURNING id
+			`
+			err := e.tx.QueryRowContext(ctx, aliasQ, intoID, fromID, e.sourceID).Scan(&addedAlias)
+			if err == nil {
+				changes = append(changes, individualChange(intoID, "alias", "", from.cfbName))
+			} else if err != sql.ErrNoRows {
+				return errors.Wrap(err, "adding alias")
+			}
+		}
+
+		// Individuals merged into fromID now redirect to intoID
+		const redirectsQ = `UPDATE individual_redirects SET to_id = $2 WHERE to_id = $1 RETURNING from_id`
+		redirects, err := queryIDs(ctx, e.tx, redirectsQ, fromID, intoID)
+		if err != nil {
+			return errors.Wrap(err, "updating redirects")
+		}
+
+		// Delete fromID before taking its Airtable ID, which is
+		// unique
+		_, err = e.tx.ExecContext(ctx, `DELETE FROM individuals WHERE id = $1`, fromID)
+		if err != nil {
+			return errors.Wrap(err, "deleting merged individual")
+		}
+		const redirectQ = `INSERT INTO individual_redirects (from_id, to_id) VALUES ($1, $2)`
+		_, err = e.tx.ExecContext(ctx, redirectQ, fromID, intoID)
+		if err != nil {
+			return errors.Wrap(err, "adding redirect")
+		}
+		changes = append(changes,
+			individualChange(fromID, "merged_into", "", intoID),
+			individualChange(intoID, "merged_from", "", fromID),
+		)
+
+		var (
+			sets   []string
+			args   = []interface{}{intoID}
+			filled = pq.StringArray{}
+		)
+		for i, c := range editableColumns {
+			if into.values[i] != "" || from.values[i] == "" {
+				continue
+			}
+			args = append(args, from.values[i])
+			sets = append(sets, c+" = $"+strconv.Itoa(len(args)))
+			filled = append(filled, c)
+			changes = append(changes, individualChange(intoID, c, "", from.values[i]))
+		}
+		sources := append([]string(nil), into.sources...)
+		for _, u := range from.sources {
+			if !contains(sources, u) {
+				sources = append(sources, u)
+			}
+		}
+		if len(sources) > len(into.sources) {
+			args = append(args, pq.StringArray(sources))
+			sets = append(sets, "source_urls = $"+strconv.Itoa(len(args)))
+			changes = append(changes, individualChange(intoID, "source_urls", strings.Join(into.sources, "\n"), strings.Join(sources, "\n")))
+		}
+		if from.airtableID != "" {
+			args = append(args, from.airtableID)
+			sets = append(sets, "airtable_id = $"+strconv.Itoa(len(args)))
+			changes = append(changes, individualChange(intoID, "airtable_id", "", from.airtableID))
+		}
+		if len(sets) > 0 {
+			updateQ := `
+				UPDATE individuals SET
+					` + strings.Join(sets, ", ") + `,
+					updated_ts = current_timestamp
+				WHERE id = $1
+			`
+			_, err = e.tx.ExecContext(ctx, updateQ, args...)
+			if err != nil {
+				return errors.Wrap(err, "updating merged individual")
+			}
+		}
+
+		const mergeQ = `
+			INSERT INTO individual_merges (
+				from_id,
+				into_id,
+				individual,
+				associations,
+				contributor_ids,
+				recipient_ids,
+				added_association_ids,
+				role_ids,
+				alias_ids,
+				added_alias_id,
+				redirect_ids,
+				filled_columns,
+				run_id,
+				merged_ts
+			) VALUES (
+				$1,
+				$2,
+				$3,
+				$4,
+				$5,
+				$6,
+				$7,
+				$8,
+				$9,
+				$10,
+				$11,
+				$12,
+				$13,
+				current_timestamp
+			)
+		`
+		_, err = e.tx.ExecContext(
+			ctx,
+			mergeQ,
+			fromID,
+			intoID,
+			snapshot,
+			associations,
+			pq.StringArray(moved["contributor_id"]),
+			pq.StringArray(moved["recipient_id"]),
+			pq.StringArray(addedAssociations),
+			pq.StringArray(roles),
+			pq.StringArray(aliases),
+			addedAlias,
+			pq.StringArray(redirects),
+			filled,
+			e.run.ID,
+		)
+		if err != nil {
+			return errors.Wrap(err, "recording merge")
+		}
+		return e.record(ctx, changes...)
+	})
+}
+
+// splitIndividual undoes the latest merge of the individual
+// individualID into another, recreating them and moving back what
+// the merge moved. It returns the ID of the individual they were
+// split from. Changes made since the merge to what it moved are
+// kept: e.g. a contribution matched to someone else isn't moved
+// back.
+func (s *Server) splitIndividual(ctx context.Context, individualID, note string) (string, error) {
+	var intoID string
+	err := s.edit(ctx, "split individual", note, func(e *edit) error {
+		const mergeQ = `
+			SELECT
+				id,
+				into_id,
+				individual::text,
+				associations::text,
+				contributor_ids,
+				recipient_ids,
+				added_association_ids,
+				role_ids,
+				alias_ids,
+				COALESCE(added_alias_id, ''),
+				redirect_ids,
+				filled_columns
+			FROM individual_merges
+			WHERE from_id = $1 AND split_ts IS NULL
+			ORDER BY merged_ts DESC
+			LIMIT 1
+			FOR UPDATE
+		`
+		var (
+			mergeID, snapshot, associations, addedAlias                                    string
+			contributors, recipients, addedAssociations, roles, aliases, redirects, filled pq.StringArray
+		)
+		err := e.tx.QueryRowContext(ctx, mergeQ, individualID).Scan(
+			&mergeID, &intoID, &snapshot, &associations, &contributors, &recipients,
+			&addedAssociations, &roles, &aliases, &addedAlias, &redirects, &filled,
+		)
+		if err == sql.ErrNoRows {
+			return statusError(http.StatusNotFound, "individual hasn't been merged")
+		} else if err != nil {
+			return errors.Wrap(err, "querying merge")
+		}
+		err = e.exists(ctx, "individuals", intoID)
+		if he, ok := errors.Cause(err).(httpError); ok && he.status == http.StatusNotFound {
+			return statusError(http.StatusConflict, fmt.Sprintf("individual %s has since been merged into another; split it first", intoID))
+		} else if err != nil {
+			return err
+		}
+		var values map[string]interface{}
+		err = json.Unmarshal([]byte(snapshot), &values)
+		if err != nil {
+			return errors.Wrap(err, "unmarshaling merged individual")
+		}
+
+		// Give back what was filled in from the merged individual,
+		// unless it's been changed since
+		for _, c := range filled {
+			if !contains(editableColumns, c) {
+				return fmt.Errorf("unknown filled column %q", c)
+			}
+			v := fmt.Sprint(values[c])
+			updateQ := `UPDATE individuals SET ` + c + ` = NULL WHERE id = $1 AND ` + c + ` = $2`
+			_, err := e.tx.ExecContext(ctx, updateQ, intoID, v)
+			if err != nil {
+				return errors.Wrap(err, "clearing filled column")
+			}
+		}
+		if airtableID, ok := values["airtable_id"].(string); ok && airtableID != "" {
+			const airtableQ = `UPDATE individuals SET airtable_id = NULL WHERE id = $1 AND airtable_id = $2`
+			_, err := e.tx.ExecContext(ctx, airtableQ, intoID, airtableID)
+			if err != nil {
+				return errors.Wrap(err, "clearing Airtable ID")
+			}
+		}
+
+		_, err = e.tx.ExecContext(ctx, `DELETE FROM individual_redirects WHERE from_id = $1`, individualID)
+		if err != nil {
+			return errors.Wrap(err, "deleting redirect")
+		}
+		const individualQ = `INSERT INTO individuals SELECT * FROM json_populate_record(NULL::individuals, $1::json)`
+		_, err = e.tx.ExecContext(ctx, individualQ, snapshot)
+		if err != nil {
+			return errors.Wrap(err, "recreating individual")
+		}
+		changes := []audit.Change{
+			individualChange(individualID, "split_from", "", intoID),
+			individualChange(intoID, "split_off", "", individualID),
+		}
+
+		for column, ids := range map[string]pq.StringArray{"contributor_id": contributors, "recipient_id": recipients} {
+			updateQ := `UPDATE contributions SET ` + column + ` = $1 WHERE ` + column + ` = $2 AND id = ANY($3::text[]) RETURNING id`
+			moved, err := queryIDs(ctx, e.tx, updateQ, individualID, intoID, ids)
+			if err != nil {
+				return errors.Wrap(err, "moving contributions back")
+			}
+			for _, id := range moved {
+				changes = append(changes, contributionChange(individualID, id, column, intoID, individualID))
+			}
+		}
+
+		const deleteAssociationsQ = `
+			DELETE FROM individual_associations
+			WHERE individual_id = $1 AND association_id = ANY($2::text[])
+			RETURNING association_id
+		`
+		removed, err := queryIDs(ctx, e.tx, deleteAssociationsQ, intoID, addedAssociations)
+		if err != nil {
+			return errors.Wrap(err, "removing merged associations")
+		}
+		unlinked, err := associationChanges(ctx, e.tx, intoID, removed, false)
+		if err != nil {
+			return err
+		}
+		changes = append(changes, unlinked...)
+		// Associations deleted since the merge are left out
+		const associationsQ = `
+			INSERT INTO individual_associations
+			SELECT *
+			FROM json_populate_recordset(NULL::individual_associations, $1::json)
+			WHERE association_id IN (SELECT id FROM associations)
+			RETURNING association_id
+		`
+		restored, err := queryIDs(ctx, e.tx, associationsQ, associations)
+		if err != nil {
+			return errors.Wrap(err, "restoring associations")
+		}
+		linked, err := associationChanges(ctx, e.tx, individualID, restored, true)
+		if err != nil {
+			return err
+		}
+		changes = append(changes, linked...)
+
+		const rolesQ = `
+			UPDATE individual_roles SET individual_id = $1
+			WHERE individual_id = $2 AND id = ANY($3::text[])
+			RETURNING id
+		`
+		movedRoles, err := queryIDs(ctx, e.tx, rolesQ, individualID, intoID, roles)
+		if err != nil {
+			return errors.Wrap(err, "moving roles back")
+		}
+		for _, id := range movedRoles {
+			changes = append(changes, roleChange(individualID, id, "individual_id", intoID, individualID))
+		}
+
+		const aliasesQ = `UPDATE individual_aliases SET individual_id = $1 WHERE individual_id = $2 AND id = ANY($3::text[])`
+		_, err = e.tx.ExecContext(ctx, aliasesQ, individualID, intoID, aliases)
+		if err != nil {
+			return errors.Wrap(err, "moving aliases back")
+		}
+		if addedAlias != "" {
+			var cfbName string
+			err := e.tx.QueryRowContext(ctx, `DELETE FROM individual_aliases WHERE id = $1 RETURNING cfb_name`, addedAlias).Scan(&cfbName)
+			if err == nil {
+				changes = append(changes, individualChange(intoID, "alias", cfbName, ""))
+			} else if err != sql.ErrNoRows {
+				return errors.Wrap(err, "removing alias")
+			}
+		}
+		const redirectsQ = `UPDATE individual_redirects SET to_id = $1 WHERE to_id = $2 AND from_id = ANY($3::text[])`
+		_, err = e.tx.ExecContext(ctx, redirectsQ, individualID, intoID, redirects)
+		if err != nil {
+			return errors.Wrap(err, "moving redirects back")
+		}
+
+		_, err = e.tx.ExecContext(ctx, `UPDATE individual_merges SET split_ts = current_timestamp WHERE id = $1`, mergeID)
+		if err != nil {
+			return errors.Wrap(err, "recording split")
+		}
+		return e.record(ctx, changes...)
+	})
+	return intoID, err
+}
+
+func contributionChange(individualID, contributionID, field, old, new string) audit.Change {
+	return audit.Change{
+		Entity:       audit.EntityContribution,
+		EntityID:     contributionID,
+		IndividualID: individualID,
+		Field:        field,
+		Old:          old,
+		New:          new,
+	}
+}
+
+// duplicateCandidate is a pair of individuals that may be the same
+// person.
+type duplicateCandidate struct {
+	Individuals [2]individualname `json:"individuals"`
+	// Reason is why they may be duplicates: "same name" (ignoring
+	// case and spacing), "same twitter" or "same last name and
+	// first initial"
+	Reason string `json:"reason"`
+}
+
+// getDuplicateCandidates returns likely duplicate individuals, most
+// likely first. Pairs that were merged and then split again are
+// known to be different people and left out.
+func (s *Server) getDuplicateCandidates(ctx context.Context) ([]duplicateCandidate, error) {
+	defer s.metrics.timeQuery("getDuplicateCandidates")()
+	const q = `
+		WITH names AS (
+			SELECT
+				id,
+				first_name,
+				last_name,
+				lower(trim(first_name)) AS first,
+				lower(trim(last_name)) AS last,
+				lower(NULLIF(trim(twitter), '')) AS twitter
+			FROM individuals
+		), pairs AS (
+			SELECT
+				a.id AS a_id, a.first_name AS a_first_name, a.last_name AS a_last_name,
+				b.id AS b_id, b.first_name AS b_first_name, b.last_name AS b_last_name,
+				CASE
+					WHEN a.first = b.first AND a.last = b.last THEN 1
+					WHEN a.twitter = b.twitter THEN 2
+					ELSE 3
+				END AS rank
+			FROM names a
+			JOIN names b
+			ON a.id < b.id AND (
+				(a.last = b.last AND left(a.first, 1) = left(b.first, 1)) OR
+				a.twitter = b.twitter
+			)
+		)
+		SELECT a_id, a_first_name, a_last_name, b_id, b_first_name, b_last_name, rank
+		FROM pairs
+		WHERE NOT EXISTS (
+			SELECT 1
+			FROM individual_merges
+			WHERE split_ts IS NOT NULL AND (
+				(from_id = a_id AND into_id = b_id) OR
+				(from_id = b_id AND into_id = a_id)
+			)
+		)
+		ORDER BY rank, a_last_name, a_first_name
+	`
+	rows, err := s.db.QueryContext(ctx, q)
+	if err != nil {
+		return nil, errors.Wrap(err, "querying duplicate individuals from db")
+	}
+	defer rows.Close()
+
+	reasons := map[int]string{
+		1: "same name",
+		2: "same twitter",
+		3: "same last name and first initial",
+	}
+	res := []duplicateCandidate{}
+	for rows.Next() {
+		var (
+			d    duplicateCandidate
+			rank int
+		)
+		a, b := &d.Individuals[0], &d.Individuals[1]
+		err := rows.Scan(&a.ID, &a.FirstName, &a.LastName, &b.ID, &b.FirstName, &b.LastName, &rank)
+		if err != nil {
+			return nil, errors.Wrap(err, "scanning duplicate row")
+		}
+		d.Reason = reasons[rank]
+		res = append(res, d)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, errors.Wrap(err, "reading duplicate rows")
+	}
+	return res, nil
+}
+
+// associationChanges returns the changes linking the individual to
+// the associations, or unlinking them, recorded by description as
+// addIndividualAssociation and removeIndividualAssociation do.
+func associationChanges(ctx context.Context, tx *sql.Tx, individualID string, associationIDs []string, linked bool) ([]audit.Change, error) {
+	if len(associationIDs) == 0 {
+		return nil, nil
+	}
+	const q = `SELECT id, description FROM associations WHERE id = ANY($1::text[])`
+	rows, err := tx.QueryContext(ctx, q, pq.StringArray(associationIDs))
+	if err != nil {
+		return nil, errors.Wrap(err, "querying association descriptions")
+	}
+	defer rows.Close()
+	descriptions := make(map[string]string)
+	for rows.Next() {
+		var id, description string
+		err := rows.Scan(&id, &description)
+		if err != nil {
+			return nil, errors.Wrap(err, "scanning association description")
+		}
+		descriptions[id] = description
+	}
+	if err := rows.Err(); err != nil {
+		return nil, errors.Wrap(err, "reading association descriptions")
+	}
+	var changes []audit.Change
+	for _, id := range associationIDs {
+		if linked {
+			changes = append(changes, linkChange(individualID, id, "association", "", descriptions[id]))
+		} else {
+			changes = append(changes, linkChange(individualID, id, "association", descriptions[id], ""))
+		}
+	}
+	return changes, nil
+}
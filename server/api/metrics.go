@@ -0,0 +1,129 @@
+package api
+
+import (
+	"context"
+	"database/sql"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/vickiniu/project-red-string/logging"
+	"github.com/vickiniu/project-red-string/metrics"
+)
+
+// readyTimeout bounds the database ping made by /readyz.
+const readyTimeout = 2 * time.Second
+
+// serverMetrics are the metrics served at /metrics.
+type serverMetrics struct {
+	registry        *metrics.Registry
+	requests        *metrics.CounterVec
+	requestDuration *metrics.HistogramVec
+	queryDuration   *metrics.HistogramVec
+	cacheLookups    *metrics.CounterVec
+}
+
+// newServerMetrics returns the server's metrics, including the stats
+// of db's connection pool if it's set.
+func newServerMetrics(db *sql.DB) *serverMetrics {
+	reg := metrics.NewRegistry()
+	m := &serverMetrics{
+		registry: reg,
+		requests: reg.Counter("redstring_http_requests_total",
+			"HTTP requests served, by route, method and status.",
+			"route", "method", "status"),
+		requestDuration: reg.Histogram("redstring_http_request_duration_seconds",
+			"Time taken to serve HTTP requests, by route.",
+			metrics.DefaultBuckets, "route"),
+		queryDuration: reg.Histogram("redstring_db_query_duration_seconds",
+			"Time taken by the API's database queries, by query.",
+			metrics.DefaultBuckets, "query"),
+		cacheLookups: reg.Counter("redstring_cache_lookups_total",
+			"Lookups in the response cache, by result: hit or miss.",
+			"result"),
+	}
+	if db == nil {
+		return m
+	}
+
+	// Connection pool stats are read from the pool when scraped
+	stat := func(f func(sql.DBStats) float64) func() float64 {
+		return func() float64 { return f(db.Stats()) }
+	}
+	reg.GaugeFunc("redstring_db_max_open_connections", "Maximum number of open database connections.",
+		stat(func(s sql.DBStats) float64 { return float64(s.MaxOpenConnections) }))
+	reg.GaugeFunc("redstring_db_open_connections", "Open database connections, in use or idle.",
+		stat(func(s sql.DBStats) float64 { return float64(s.OpenConnections) }))
+	reg.GaugeFunc("redstring_db_in_use_connections", "Database connections in use.",
+		stat(func(s sql.DBStats) float64 { return float64(s.InUse) }))
+	reg.GaugeFunc("redstring_db_idle_connections", "Idle database connections.",
+		stat(func(s sql.DBStats) float64 { return float64(s.Idle) }))
+	reg.CounterFunc("redstring_db_wait_count_total", "Times a query waited for a database connection.",
+		stat(func(s sql.DBStats) float64 { return float64(s.WaitCount) }))
+	reg.CounterFunc("redstring_db_wait_duration_seconds_total", "Time spent waiting for database connections.",
+		stat(func(s sql.DBStats) float64 { return s.WaitDuration.Seconds() }))
+	reg.CounterFunc("redstring_db_max_idle_closed_total", "Connections closed because the pool had too many idle.",
+		stat(func(s sql.DBStats) float64 { return float64(s.MaxIdleClosed) }))
+	reg.CounterFunc("redstring_db_max_lifetime_closed_total", "Connections closed for reaching their maximum lifetime.",
+		stat(func(s sql.DBStats) float64 { return float64(s.MaxLifetimeClosed) }))
+	return m
+}
+
+// timeQuery starts timing the named query, returning a function to
+// call when it's done:
+//
+//	defer s.metrics.timeQuery("getIndividual")()
+//
+// Queries aren't timed if m is nil.
+func (m *serverMetrics) timeQuery(name string) func() {
+	if m == nil {
+		return func() {}
+	}
+	start := time.Now()
+	return func() {
+		m.queryDuration.Observe(time.Since(start).Seconds(), name)
+	}
+}
+
+// instrument returns middleware counting and timing requests by the
+// mux route they're for. Requests for unknown paths are counted
+// together, so arbitrary paths don't each get a series.
+func (s *Server) instrument(mux *http.ServeMux) middleware {
+	return func(h http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			_, route := mux.Handler(r)
+			if route == "" {
+				route = "other"
+			}
+			start := time.Now()
+			rec := &statusRecorder{ResponseWriter: w}
+			h.ServeHTTP(rec, r)
+			if rec.status == 0 {
+				rec.status = http.StatusOK
+			}
+			s.metrics.requests.Inc(route, r.Method, strconv.Itoa(rec.status))
+			s.metrics.requestDuration.Observe(time.Since(start).Seconds(), route)
+		})
+	}
+}
+
+// handleHealthz reports that the server is up, for liveness probes.
+func (s *Server) handleHealthz(w http.ResponseWriter, r *http.Request) {
+	respsuccess(w, r, map[string]string{"status": "ok"})
+}
+
+// handleReadyz reports whether the server can serve requests, for
+// readiness probes: it can't without its database.
+func (s *Server) handleReadyz(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), readyTimeout)
+	defer cancel()
+	err := s.store.Ping(ctx)
+	if err != nil {
+		logging.Warn(r.Context(), "readiness check failed", "error", err)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusServiceUnavailable)
+		respsuccess(w, r, map[string]string{"status": "unavailable", "error": "database unreachable"})
+		return
+	}
+	respsuccess(w, r, map[string]string{"status": "ok"})
+}
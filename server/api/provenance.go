@@ -0,0 +1,64 @@
+package api
+
+import (
+	"database/sql"
+	"time"
+)
+
+// provenance describes where a fact came from: the source it was
+// taken from, who added it and when.
+type provenance struct {
+	SourceType       string    `json:"source_type"`
+	URL              string    `json:"url,omitempty"`
+	AirtableRecordID string    `json:"airtable_record_id,omitempty"`
+	File             string    `json:"file,omitempty"`
+	CFBRefNo         string    `json:"cfb_refno,omitempty"`
+	Note             string    `json:"note,omitempty"`
+	AddedBy          string    `json:"added_by"`
+	AddedTS          time.Time `json:"added_ts"`
+}
+
+// sourceColumns returns the sources columns scanned by
+// nullProvenance, for the sources table joined as alias.
+func sourceColumns(alias string) string {
+	return alias + ".id, " +
+		alias + ".source_type, " +
+		alias + ".url, " +
+		alias + ".airtable_record_id, " +
+		alias + ".file, " +
+		alias + ".cfb_refno, " +
+		alias + ".note, " +
+		alias + ".added_by, " +
+		alias + ".added_ts"
+}
+
+// nullProvenance scans a sources row that may be missing, e.g. from
+// a LEFT JOIN.
+type nullProvenance struct {
+	id, sourceType, url, airtableRecordID, file, cfbRefNo, note, addedBy sql.NullString
+	addedTS                                                              sql.NullTime
+}
+
+func (n *nullProvenance) dest() []interface{} {
+	return []interface{}{
+		&n.id, &n.sourceType, &n.url, &n.airtableRecordID, &n.file, &n.cfbRefNo, &n.note, &n.addedBy, &n.addedTS,
+	}
+}
+
+// provenance returns the scanned provenance, or nil if there was
+// no sources row.
+func (n *nullProvenance) provenance() *provenance {
+	if !n.id.Valid {
+		return nil
+	}
+	return &provenance{
+		SourceType:       n.sourceType.String,
+		URL:              n.url.String,
+		AirtableRecordID: n.airtableRecordID.String,
+		File:             n.file.String,
+		CFBRefNo:         n.cfbRefNo.String,
+		Note:             n.note.String,
+		AddedBy:          n.addedBy.String,
+		AddedTS:          n.addedTS.Time,
+	}
+}
@@ -0,0 +1,239 @@
+package api
+
+import (
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// RateLimit limits the requests of a client.
+type RateLimit struct {
+	// PerMinute is the sustained request rate. Up to a minute's
+	// worth of requests can be made at once. 0 means no limit per
+	// minute, though Daily may still cap requests.
+	PerMinute int
+	// Daily caps the requests made per UTC day, or is 0 for no
+	// cap.
+	Daily int
+}
+
+// DefaultAnonymousLimit is the limit shared by each address making
+// requests without an API key.
+var DefaultAnonymousLimit = RateLimit{PerMinute: 60, Daily: 5000}
+
+// bucket is a token bucket, refilled at the limit's rate, plus a
+// count of requests made on the current day.
+type bucket struct {
+	limit   RateLimit
+	tokens  float64
+	updated time.Time
+	day     string
+	used    int
+}
+
+// limiter holds a bucket per client.
+type limiter struct {
+	mu        sync.Mutex
+	buckets   map[string]*bucket
+	lastSweep time.Time
+	now       func() time.Time
+}
+
+func newLimiter() *limiter {
+	return &limiter{
+		buckets: make(map[string]*bucket),
+		now:     time.Now,
+	}
+}
+
+// quota is a client's remaining allowance after a request.
+type quota struct {
+	limit     RateLimit
+	remaining int
+	// reset is when the bucket will be full again
+	reset time.Duration
+	// dailyRemaining and dailyReset are only set when the limit
+	// has a daily cap
+	dailyRemaining int
+	dailyReset     time.Duration
+	// retryAfter is set if the request isn't allowed
+	retryAfter time.Duration
+}
+
+// take takes a token from the client's bucket, reporting whether
+// the request is allowed and the client's remaining quota.
+func (l *limiter) take(client string, limit RateLimit) (bool, quota) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := l.now().UTC()
+	l.sweep(now)
+
+	b, ok := l.buckets[client]
+	if !ok || b.limit != limit {
+		// New clients, and clients whose limit changed, start
+		// with a full bucket
+		b = &bucket{limit: limit, tokens: float64(limit.PerMinute), updated: now}
+		l.buckets[client] = b
+	}
+	rate := float64(limit.PerMinute) / 60 // per second
+	if limit.PerMinute > 0 {
+		b.tokens = math.Min(float64(limit.PerMinute), b.tokens+now.Sub(b.updated).Seconds()*rate)
+	}
+	b.updated = now
+	if day := now.Format("2006-01-02"); b.day != day {
+		b.day = day
+		b.used = 0
+	}
+
+	q := quota{limit: limit}
+	midnight := time.Date(now.Year(), now.Month(), now.Day()+1, 0, 0, 0, 0, time.UTC)
+	allowed := true
+	switch {
+	case limit.Daily > 0 && b.used >= limit.Daily:
+		allowed = false
+		q.retryAfter = midnight.Sub(now)
+	case limit.PerMinute > 0 && b.tokens < 1:
+		allowed = false
+		q.retryAfter = time.Duration((1 - b.tokens) / rate * float64(time.Second))
+	case limit.PerMinute > 0:
+		b.tokens--
+		b.used++
+	default:
+		b.used++
+	}
+	if limit.PerMinute > 0 {
+		q.remaining = int(b.tokens)
+		q.reset = time.Duration((float64(limit.PerMinute) - b.tokens) / rate * float64(time.Second))
+	}
+	if limit.Daily > 0 {
+		q.dailyRemaining = limit.Daily - b.used
+		q.dailyReset = midnight.Sub(now)
+	}
+	return allowed, q
+}
+
+// sweep drops the buckets of clients that have been idle long
+// enough for their bucket to fill up and their day to end, so
+// anonymous clients don't accumulate.
+func (l *limiter) sweep(now time.Time) {
+	if now.Sub(l.lastSweep) < time.Minute {
+		return
+	}
+	l.lastSweep = now
+	day := now.Format("2006-01-02")
+	for client, b := range l.buckets {
+		if now.Sub(b.updated) > time.Minute && b.day != day {
+			delete(l.buckets, client)
+		}
+	}
+}
+
+func (q quota) setHeaders(h http.Header) {
+	if q.limit.PerMinute > 0 {
+		h.Set("X-RateLimit-Limit", strconv.Itoa(q.limit.PerMinute))
+		h.Set("X-RateLimit-Remaining", strconv.Itoa(q.remaining))
+		h.Set("X-RateLimit-Reset", strconv.Itoa(seconds(q.reset)))
+	}
+	if q.limit.Daily > 0 {
+		h.Set("X-Quota-Limit", strconv.Itoa(q.limit.Daily))
+		h.Set("X-Quota-Remaining", strconv.Itoa(q.dailyRemaining))
+		h.Set("X-Quota-Reset", strconv.Itoa(seconds(q.dailyReset)))
+	}
+	if q.retryAfter > 0 {
+		h.Set("Retry-After", strconv.Itoa(seconds(q.retryAfter)))
+	}
+}
+
+// seconds rounds d up to whole seconds.
+func seconds(d time.Duration) int {
+	return int(math.Ceil(d.Seconds()))
+}
+
+// clientAddr returns the address of the client making the request.
+// Requests from a trusted proxy are from the last address in
+// X-Forwarded-For that isn't also a trusted proxy: proxies append the
+// address they received the request from, so addresses before it may
+// have been made up by the client.
+func (s *Server) clientAddr(r *http.Request) string {
+	addr, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		addr = r.RemoteAddr
+	}
+	if !s.trustedProxy(addr) {
+		return addr
+	}
+	var forwarded []string
+	for _, h := range r.Header["X-Forwarded-For"] {
+		forwarded = append(forwarded, strings.Split(h, ",")...)
+	}
+	for i := len(forwarded) - 1; i >= 0; i-- {
+		a := strings.TrimSpace(forwarded[i])
+		if net.ParseIP(a) == nil {
+			break
+		}
+		addr = a
+		if !s.trustedProxy(a) {
+			break
+		}
+	}
+	return addr
+}
+
+// trustedProxy reports whether addr is one of s.TrustedProxies.
+func (s *Server) trustedProxy(addr string) bool {
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return false
+	}
+	for _, n := range s.TrustedProxies {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// rateLimit wraps h, limiting the requests of each API key, or of
+// each address for requests without one. Keys are passed in the
+// X-API-Key header.
+func (s *Server) rateLimit(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var (
+			client string
+			limit  = s.AnonymousLimit
+		)
+		if key := r.Header.Get("X-API-Key"); key != "" {
+			k, err := s.keys.lookup(r.Context(), s.store, key)
+			if err != nil {
+				resperr(w, r, errors.Wrap(err, "rateLimit: looking up API key"))
+				return
+			}
+			if k == nil {
+				resperr(w, r, statusError(http.StatusUnauthorized, "invalid API key"))
+				return
+			}
+			client = "key:" + k.ID
+			limit = k.limit
+		} else {
+			client = "addr:" + s.clientAddr(r)
+		}
+		if limit.PerMinute <= 0 && limit.Daily <= 0 {
+			// Unlimited
+			h.ServeHTTP(w, r)
+			return
+		}
+		allowed, q := s.limiter.take(client, limit)
+		q.setHeaders(w.Header())
+		if !allowed {
+			resperr(w, r, statusError(http.StatusTooManyRequests, "rate limit exceeded"))
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
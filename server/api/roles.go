@@ -0,0 +1,162 @@
+package api
+
+import (
+	"context"
+	"time"
+
+	"github.com/lib/pq"
+	"github.com/pkg/errors"
+)
+
+// role is one of an individual's roles and titles over time. The
+// current role has no end date.
+type role struct {
+	Role      string      `json:"role"`
+	Title     string      `json:"title"`
+	StartDate *time.Time  `json:"start_date"`
+	EndDate   *time.Time  `json:"end_date"`
+	Source    *provenance `json:"source"`
+}
+
+func (s *postgresStore) getRoles(ctx context.Context, individualID string) ([]role, error) {
+	defer s.metrics.timeQuery("getRoles")()
+	q := `
+		SELECT
+			COALESCE(role, ''),
+			COALESCE(title, ''),
+			start_date,
+			end_date,
+			` + sourceColumns("sources") + `
+		FROM individual_roles
+		LEFT JOIN sources
+		ON individual_roles.source_id = sources.id
+		WHERE individual_roles.individual_id = $1
+		ORDER BY start_date DESC NULLS LAST
+	`
+	rows, err := s.db.QueryContext(ctx, q, individualID)
+	if err != nil {
+		return nil, errors.Wrap(err, "querying roles from db")
+	}
+	defer rows.Close()
+
+	var roles []role
+	for rows.Next() {
+		var (
+			r      role
+			source nullProvenance
+		)
+		err := rows.Scan(append([]interface{}{&r.Role, &r.Title, &r.StartDate, &r.EndDate}, source.dest()...)...)
+		if err != nil {
+			return nil, errors.Wrap(err, "scanning role row")
+		}
+		r.Source = source.provenance()
+		roles = append(roles, r)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, errors.Wrap(err, "reading role rows")
+	}
+	return roles, nil
+}
+
+// activeRole is a role or association an individual held on a given
+// date.
+type activeRole struct {
+	// Kind is "role" or "association"
+	Kind        string     `json:"kind"`
+	Description string     `json:"description"`
+	StartDate   time.Time  `json:"start_date"`
+	EndDate     *time.Time `json:"end_date"`
+
+	individualID string
+}
+
+func (r activeRole) activeOn(t time.Time) bool {
+	// Dates cover the whole day
+	return !t.Before(r.StartDate) && (r.EndDate == nil || t.Before(r.EndDate.AddDate(0, 0, 1)))
+}
+
+// getDatedRoles returns the roles and associations of the given
+// individuals that have a known start date, keyed on individual ID.
+// Undated roles are left out since we can't say when they were held.
+func (s *postgresStore) getDatedRoles(ctx context.Context, individualIDs []string) (map[string][]activeRole, error) {
+	defer s.metrics.timeQuery("getDatedRoles")()
+	const q = `
+		SELECT
+			individual_id,
+			'role',
+			CASE
+				WHEN COALESCE(title, '') = '' THEN role
+				WHEN COALESCE(role, '') = '' THEN title
+				ELSE title || ', ' || role
+			END,
+			start_date,
+			end_date
+		FROM individual_roles
+		WHERE individual_id = ANY($1::text[]) AND start_date IS NOT NULL
+		UNION ALL
+		SELECT
+			individual_id,
+			'association',
+			associations.description,
+			start_date,
+			end_date
+		FROM individual_associations
+		JOIN associations
+		ON individual_associations.association_id = associations.id
+		WHERE individual_id = ANY($1::text[]) AND start_date IS NOT NULL
+	`
+	rows, err := s.db.QueryContext(ctx, q, pq.StringArray(individualIDs))
+	if err != nil {
+		return nil, errors.Wrap(err, "querying dated roles from db")
+	}
+	defer rows.Close()
+
+	roles := make(map[string][]activeRole)
+	for rows.Next() {
+		var r activeRole
+		err := rows.Scan(&r.individualID, &r.Kind, &r.Description, &r.StartDate, &r.EndDate)
+		if err != nil {
+			return nil, errors.Wrap(err, "scanning role row")
+		}
+		roles[r.individualID] = append(roles[r.individualID], r)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, errors.Wrap(err, "reading role rows")
+	}
+	return roles, nil
+}
+
+// annotateRoles sets the roles the contributor and recipient of each
+// contribution held on the date it was made, given the dated roles
+// of each.
+func annotateRoles(contributions []contribution, roles map[string][]activeRole) {
+	active := func(individualID string, t time.Time) []activeRole {
+		res := []activeRole{}
+		for _, r := range roles[individualID] {
+			if r.activeOn(t) {
+				res = append(res, r)
+			}
+		}
+		return res
+	}
+	for i := range contributions {
+		c := &contributions[i]
+		c.ContributorRoles = active(c.ContributorID, c.Date)
+		if c.RecipientID != "" {
+			c.RecipientRoles = active(c.RecipientID, c.Date)
+		}
+	}
+}
+
+// contributionParties returns the IDs of the contributors and
+// matched recipients of contributions.
+func contributionParties(contributions []contribution) []string {
+	var ids []string
+	for _, c := range contributions {
+		ids = append(ids, c.ContributorID)
+		if c.RecipientID != "" {
+			ids = append(ids, c.RecipientID)
+		}
+	}
+	return ids
+}
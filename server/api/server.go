@@ -3,30 +3,80 @@ package api
 import (
 	"database/sql"
 	"encoding/json"
-	"log"
+	"net"
 	"net/http"
+	"strconv"
+	"time"
 
 	"github.com/pkg/errors"
+	"github.com/vickiniu/project-red-string/logging"
 )
 
 // Server handles API requests and manages
 // server state
 type Server struct {
+	store Store
+	// db is written to by curation endpoints, which aren't served
+	// if it's nil
 	db *sql.DB
+
+	// AnonymousLimit limits each address making requests without
+	// an API key
+	AnonymousLimit RateLimit
+	// TrustedProxies are the networks of proxies in front of the
+	// server. Requests through them are taken to be from the address
+	// they give in X-Forwarded-For.
+	TrustedProxies []*net.IPNet
+	// AllowedOrigins are the origins allowed to make cross-origin
+	// requests, or "*" for any
+	AllowedOrigins []string
+	// CacheMaxAge is how long clients may reuse cached responses
+	// without revalidating them. If it's 0 they must always
+	// revalidate, using the response's ETag.
+	CacheMaxAge time.Duration
+
+	cache   *responseCache
+	keys    *keyCache
+	limiter *limiter
+	metrics *serverMetrics
 }
 
-// NewServer returns a new Server object
+// NewServer returns a new Server object, serving the database and
+// letting authenticated users curate it
 func NewServer(db *sql.DB) *Server {
+	store := &postgresStore{db: db}
+	s := newServer(store, db)
+	store.metrics = s.metrics
+	return s
+}
+
+// NewStoreServer returns a Server serving the store's data read-only,
+// without the curation endpoints
+func NewStoreServer(store Store) *Server {
+	return newServer(store, nil)
+}
+
+func newServer(store Store, db *sql.DB) *Server {
 	return &Server{
-		db,
+		store:          store,
+		db:             db,
+		AnonymousLimit: DefaultAnonymousLimit,
+		AllowedOrigins: []string{"*"},
+		cache:          newResponseCache(),
+		keys:           newKeyCache(),
+		limiter:        newLimiter(),
+		metrics:        newServerMetrics(db),
 	}
 }
 
-// API returns an http.Handler implementing the Red String API
+// API returns an http.Handler implementing the Red String API, and
+// serving health checks at /healthz and /readyz and, to admins,
+// metrics at /metrics
 func (s *Server) API() http.Handler {
 	mux := http.NewServeMux()
 	mux.HandleFunc("/get-individual", s.handleGetIndividual)
 	mux.HandleFunc("/search-individuals", s.handleSearchIndividuals)
+	mux.HandleFunc("/individual-history", s.requireRole(RoleViewer, s.handleGetIndividualHistory))
 	mux.HandleFunc("/individual-contributions-received", s.handleIndividualContributionsReceived)
 	mux.HandleFunc("/individual-contributions-given", s.handleIndividualContributionsGiven)
 
@@ -34,7 +84,45 @@ func (s *Server) API() http.Handler {
 	mux.HandleFunc("/individual-categories", s.handleGetIndividualsByCategory)
 	mux.HandleFunc("/category-associations", s.handleGetAssociationsForCategory)
 	mux.HandleFunc("/individual-associations", s.handleGetIndividualsByAssociation)
-	return http.Handler(mux)
+	// Associations waiting to be categorized, for admins curating
+	// categories
+	mux.HandleFunc("/uncategorized-associations", s.requireRole(RoleAdmin, s.handleGetUncategorizedAssociations))
+
+	// Curation, by authenticated users
+	if s.db != nil {
+		s.curationAPI(mux)
+	}
+
+	// Probes and metrics scrapes aren't logged or rate limited
+	ops := http.NewServeMux()
+	ops.HandleFunc("/healthz", s.handleHealthz)
+	ops.HandleFunc("/readyz", s.handleReadyz)
+	ops.HandleFunc("/metrics", s.requireRole(RoleAdmin, s.metrics.registry.Handler().ServeHTTP))
+	ops.Handle("/", chain(mux, requestID, accessLog, s.instrument(mux), securityHeaders, s.cors, s.rateLimit))
+	return ops
+}
+
+// curationAPI adds the endpoints for editing data to mux.
+func (s *Server) curationAPI(mux *http.ServeMux) {
+	mux.HandleFunc("/create-individual", s.requireRole(RoleEditor, s.handleCreateIndividual))
+	mux.HandleFunc("/update-individual", s.requireRole(RoleEditor, s.handleUpdateIndividual))
+	mux.HandleFunc("/merge-individuals", s.requireRole(RoleEditor, s.handleMergeIndividuals))
+	mux.HandleFunc("/split-individual", s.requireRole(RoleEditor, s.handleSplitIndividual))
+	mux.HandleFunc("/duplicate-individuals", s.requireRole(RoleEditor, s.handleGetDuplicateIndividuals))
+	mux.HandleFunc("/add-individual-association", s.requireRole(RoleEditor, s.handleAddIndividualAssociation))
+	mux.HandleFunc("/remove-individual-association", s.requireRole(RoleEditor, s.handleRemoveIndividualAssociation))
+	mux.HandleFunc("/create-category", s.requireRole(RoleAdmin, s.handleCreateCategory))
+	mux.HandleFunc("/update-category", s.requireRole(RoleAdmin, s.handleUpdateCategory))
+	mux.HandleFunc("/delete-category", s.requireRole(RoleAdmin, s.handleDeleteCategory))
+	mux.HandleFunc("/add-association-category", s.requireRole(RoleAdmin, s.handleAddAssociationCategory))
+	mux.HandleFunc("/remove-association-category", s.requireRole(RoleAdmin, s.handleRemoveAssociationCategory))
+	mux.HandleFunc("/create-user", s.requireRole(RoleAdmin, s.handleCreateUser))
+	mux.HandleFunc("/revoke-user", s.requireRole(RoleAdmin, s.handleRevokeUser))
+	mux.HandleFunc("/api-keys", s.requireRole(RoleAdmin, s.handleGetAPIKeys))
+	mux.HandleFunc("/create-api-key", s.requireRole(RoleAdmin, s.handleCreateAPIKey))
+	mux.HandleFunc("/revoke-api-key", s.requireRole(RoleAdmin, s.handleRevokeAPIKey))
+	mux.HandleFunc("/job-runs", s.requireRole(RoleAdmin, s.handleGetJobRuns))
+	mux.HandleFunc("/cfb-imports", s.requireRole(RoleAdmin, s.handleGetCFBImports))
 }
 
 func (s *Server) handleGetIndividual(w http.ResponseWriter, r *http.Request) {
@@ -46,12 +134,12 @@ func (s *Server) handleGetIndividual(w http.ResponseWriter, r *http.Request) {
 		resperr(w, r, errors.Wrap(err, "handleGetIndividual: unmarshaling request body"))
 		return
 	}
-	i, err := s.getIndividual(r.Context(), body.ID)
+	err = s.respcached(w, r, "individual:"+body.ID, func() (interface{}, error) {
+		return s.store.GetIndividual(r.Context(), body.ID)
+	})
 	if err != nil {
 		resperr(w, r, errors.Wrap(err, "handleGetIndividual: getting individual"))
-		return
 	}
-	respsuccess(w, r, i)
 	return
 }
 
@@ -64,7 +152,7 @@ func (s *Server) handleSearchIndividuals(w http.ResponseWriter, r *http.Request)
 		resperr(w, r, errors.Wrap(err, "handleSearchIndividuals: unmarshaling request body"))
 		return
 	}
-	resp, err := s.searchIndividuals(r.Context(), body.Query)
+	resp, err := s.store.SearchIndividuals(r.Context(), body.Query)
 	if err != nil {
 		resperr(w, r, errors.Wrap(err, "handleSearchIndividuals: getting search responses"))
 		return
@@ -72,47 +160,66 @@ func (s *Server) handleSearchIndividuals(w http.ResponseWriter, r *http.Request)
 	respsuccess(w, r, resp)
 }
 
+func (s *Server) handleGetIndividualHistory(w http.ResponseWriter, r *http.Request) {
+	body := struct {
+		IndividualID string `json:"individual_id"`
+	}{}
+	err := json.NewDecoder(r.Body).Decode(&body)
+	if err != nil {
+		resperr(w, r, errors.Wrap(err, "handleGetIndividualHistory: unmarshaling request body"))
+		return
+	}
+	resp, err := s.store.GetIndividualHistory(r.Context(), body.IndividualID)
+	if err != nil {
+		resperr(w, r, errors.Wrap(err, "handleGetIndividualHistory: getting history"))
+		return
+	}
+	respsuccess(w, r, resp)
+}
+
 func (s *Server) handleIndividualContributionsReceived(w http.ResponseWriter, r *http.Request) {
 	body := struct {
 		IndividualID string `json:"individual_id"`
+		WithRoles    bool   `json:"with_roles"`
 	}{}
 	err := json.NewDecoder(r.Body).Decode(&body)
 	if err != nil {
 		resperr(w, r, errors.Wrap(err, "handleIndividualContributionsReceived: unmarshaling request body"))
 		return
 	}
-	resp, err := s.contributionsReceived(r.Context(), body.IndividualID)
+	err = s.respcached(w, r, "contributions-received:"+body.IndividualID+":"+strconv.FormatBool(body.WithRoles), func() (interface{}, error) {
+		return s.store.ContributionsReceived(r.Context(), body.IndividualID, body.WithRoles)
+	})
 	if err != nil {
 		resperr(w, r, errors.Wrap(err, "handleIndividualContributionsReceived: getting search responses"))
-		return
 	}
-	respsuccess(w, r, resp)
 }
 
 func (s *Server) handleIndividualContributionsGiven(w http.ResponseWriter, r *http.Request) {
 	body := struct {
 		IndividualID string `json:"individual_id"`
+		WithRoles    bool   `json:"with_roles"`
 	}{}
 	err := json.NewDecoder(r.Body).Decode(&body)
 	if err != nil {
 		resperr(w, r, errors.Wrap(err, "handleIndividualContributionsGiven: unmarshaling request body"))
 		return
 	}
-	resp, err := s.contributionsGiven(r.Context(), body.IndividualID)
+	err = s.respcached(w, r, "contributions-given:"+body.IndividualID+":"+strconv.FormatBool(body.WithRoles), func() (interface{}, error) {
+		return s.store.ContributionsGiven(r.Context(), body.IndividualID, body.WithRoles)
+	})
 	if err != nil {
 		resperr(w, r, errors.Wrap(err, "handleIndividualContributionsGiven: getting search responses"))
-		return
 	}
-	respsuccess(w, r, resp)
 }
 
 func (s *Server) handleGetCategories(w http.ResponseWriter, r *http.Request) {
-	resp, err := s.getCategories(r.Context())
+	err := s.respcached(w, r, "categories", func() (interface{}, error) {
+		return s.store.GetCategories(r.Context())
+	})
 	if err != nil {
 		resperr(w, r, errors.Wrap(err, "handleGetCategories: getting categories"))
-		return
 	}
-	respsuccess(w, r, resp)
 }
 
 func (s *Server) handleGetIndividualsByCategory(w http.ResponseWriter, r *http.Request) {
@@ -124,11 +231,12 @@ func (s *Server) handleGetIndividualsByCategory(w http.ResponseWriter, r *http.R
 		resperr(w, r, errors.Wrap(err, "handleGetIndividualsByCategory: unmarshaling request body"))
 		return
 	}
-	resp, err := s.getIndividualsByCategory(r.Context(), body.CategoryID)
+	err = s.respcached(w, r, "individual-categories:"+body.CategoryID, func() (interface{}, error) {
+		return s.store.GetIndividualsByCategory(r.Context(), body.CategoryID)
+	})
 	if err != nil {
 		resperr(w, r, errors.Wrap(err, "handleGetIndividualsByCategory: getting individuals"))
 	}
-	respsuccess(w, r, resp)
 }
 
 func (s *Server) handleGetAssociationsForCategory(w http.ResponseWriter, r *http.Request) {
@@ -140,11 +248,12 @@ func (s *Server) handleGetAssociationsForCategory(w http.ResponseWriter, r *http
 		resperr(w, r, errors.Wrap(err, "handleGetAssociationsForCategory: unmarshaling request body"))
 		return
 	}
-	resp, err := s.getAssociationsForCategory(r.Context(), body.CategoryID)
+	err = s.respcached(w, r, "category-associations:"+body.CategoryID, func() (interface{}, error) {
+		return s.store.GetAssociationsForCategory(r.Context(), body.CategoryID)
+	})
 	if err != nil {
 		resperr(w, r, errors.Wrap(err, "handleGetAssociationsForCategory: getting individuals"))
 	}
-	respsuccess(w, r, resp)
 }
 
 func (s *Server) handleGetIndividualsByAssociation(w http.ResponseWriter, r *http.Request) {
@@ -156,23 +265,59 @@ func (s *Server) handleGetIndividualsByAssociation(w http.ResponseWriter, r *htt
 		resperr(w, r, errors.Wrap(err, "handleGetIndividualsByAssociation: unmarshaling request body"))
 		return
 	}
-	resp, err := s.getIndividualsByAssociation(r.Context(), body.AssociationID)
+	resp, err := s.store.GetIndividualsByAssociation(r.Context(), body.AssociationID)
 	if err != nil {
 		resperr(w, r, errors.Wrap(err, "handleGetIndividualsByAssociation: getting individuals"))
+		return
+	}
+	respsuccess(w, r, resp)
+}
+
+func (s *Server) handleGetUncategorizedAssociations(w http.ResponseWriter, r *http.Request) {
+	resp, err := s.store.GetUncategorizedAssociations(r.Context())
+	if err != nil {
+		resperr(w, r, errors.Wrap(err, "handleGetUncategorizedAssociations: getting associations"))
+		return
 	}
 	respsuccess(w, r, resp)
 }
 
+// httpError is an error caused by the request, such as a missing
+// field, whose message is returned to the client.
+type httpError struct {
+	status  int
+	message string
+}
+
+func (e httpError) Error() string {
+	return e.message
+}
+
+func statusError(status int, message string) error {
+	return httpError{status: status, message: message}
+}
+
+// resperr responds with err. Errors caused by the request are
+// returned to the client; others are logged and reported as internal
+// errors. Either way the body includes the request ID to quote when
+// reporting problems.
 func resperr(w http.ResponseWriter, r *http.Request, err error) {
-	// TODO(vicki): better error instrumentation + logging
-	log.Println("error: ", err)
-	w.WriteHeader(500)
-	w.Header().Set("Access-Control-Allow-Origin", "*")
-	json.NewEncoder(w).Encode(err)
+	status, message := http.StatusInternalServerError, "internal server error"
+	if e, ok := errors.Cause(err).(httpError); ok {
+		status, message = e.status, e.message
+		logging.Debug(r.Context(), "request rejected", "status", status, "error", err)
+	} else {
+		logging.Error(r.Context(), "request failed", "path", r.URL.Path, "error", err)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]string{
+		"error":      message,
+		"request_id": logging.RequestID(r.Context()),
+	})
 }
 
 func respsuccess(w http.ResponseWriter, r *http.Request, b interface{}) {
 	w.Header().Set("Content-Type", "application/json")
-	w.Header().Set("Access-Control-Allow-Origin", "*")
 	json.NewEncoder(w).Encode(b)
 }
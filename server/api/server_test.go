@@ -0,0 +1,522 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/vickiniu/project-red-string/internal/testdb"
+	"github.com/vickiniu/project-red-string/logging"
+)
+
+func TestMain(m *testing.M) {
+	logging.Default = logging.New(ioutil.Discard, logging.LevelError)
+	os.Exit(testdb.Run(m))
+}
+
+func date(s string) *time.Time {
+	t, err := time.Parse("2006-01-02", s)
+	if err != nil {
+		panic(err)
+	}
+	return &t
+}
+
+// newTestStore returns a memory store holding a small dataset:
+//
+//   - Jane Doe (1), a council member since 2018 who was on Community
+//     Board 3 from 2015 to 2017 and is in the Tenants Union; 3 was
+//     merged into her
+//   - John Smith (2), also in the Tenants Union, who gave to Jane in
+//     2016 and 2019
+//   - Community Boards, a category of Community Board 3; nobody is
+//     in the Block Association
+func newTestStore() *memoryStore {
+	m := newMemoryStore()
+	cb3 := association{ID: "10", Description: "Community Board 3"}
+	union := association{ID: "11", Description: "Tenants Union"}
+	block := association{ID: "12", Description: "Block Association"}
+	m.addAssociation(cb3)
+	m.addAssociation(union)
+	m.addAssociation(block)
+	m.addCategory(category{ID: "20", Description: "Community Boards"}, cb3.ID)
+
+	janeCB3 := cb3
+	janeCB3.StartDate, janeCB3.EndDate = date("2015-01-01"), date("2017-12-31")
+	m.addIndividual(individual{
+		ID:           "1",
+		FirstName:    "Jane",
+		LastName:     "Doe",
+		Role:         "Council Member",
+		Title:        "District 3",
+		Associations: []association{janeCB3, union},
+		Roles: []role{
+			{Role: "Council Member", Title: "District 3", StartDate: date("2018-01-01")},
+		},
+		Aliases: []alias{{FirstName: "Jane Q", LastName: "Doe", CFBName: "Doe, Jane Q"}},
+	})
+	m.addIndividual(individual{
+		ID:           "2",
+		FirstName:    "John",
+		LastName:     "Smith",
+		Associations: []association{union},
+	})
+	m.addRedirect("3", "1")
+
+	m.addContribution(contribution{ID: "30", Amount: 100, Date: *date("2016-06-01"), ContributorName: "Smith, John", ContributorID: "2", RecipientName: "Doe, Jane", RecipientID: "1"})
+	m.addContribution(contribution{ID: "31", Amount: 250, Date: *date("2019-03-01"), ContributorName: "Smith, John", ContributorID: "2", RecipientName: "Doe, Jane", RecipientID: "1"})
+	m.addContribution(contribution{ID: "32", Amount: 50, Date: *date("2019-05-01"), ContributorName: "Doe, Jane", ContributorID: "1", RecipientName: "Friends of Someone"})
+
+	newRole := "Council Member"
+	m.addChange("1", change{Entity: "individual", EntityID: "1", Field: "role", NewValue: &newRole, Actor: "sync"})
+	joined := "Tenants Union"
+	m.addChange("1", change{Entity: "individual_association", EntityID: "11", Field: "association", NewValue: &joined, Actor: "editor"})
+
+	m.addUser("viewer-token", user{ID: "50", Name: "viewer", Role: RoleViewer})
+	m.addUser("admin-token", user{ID: "51", Name: "admin", Role: RoleAdmin})
+	m.addAPIKey("test-key", apiKey{ID: "60", Name: "test", RatePerMinute: 5})
+	return m
+}
+
+// request makes a request to h with the JSON body and headers given
+// as alternating names and values.
+func request(t *testing.T, h http.Handler, method, path string, body interface{}, header ...string) *httptest.ResponseRecorder {
+	t.Helper()
+	var b []byte
+	if body != nil {
+		var err error
+		b, err = json.Marshal(body)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	r := httptest.NewRequest(method, path, bytes.NewReader(b))
+	r.RemoteAddr = "192.0.2.1:1234"
+	for i := 0; i+1 < len(header); i += 2 {
+		r.Header.Set(header[i], header[i+1])
+	}
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	return w
+}
+
+func post(t *testing.T, h http.Handler, path string, body interface{}, header ...string) *httptest.ResponseRecorder {
+	t.Helper()
+	return request(t, h, http.MethodPost, path, body, header...)
+}
+
+// decode decodes the response body into v, failing unless the
+// response has the wanted status.
+func decode(t *testing.T, w *httptest.ResponseRecorder, status int, v interface{}) {
+	t.Helper()
+	if w.Code != status {
+		t.Fatalf("got status %d, want %d: %s", w.Code, status, w.Body)
+	}
+	err := json.Unmarshal(w.Body.Bytes(), v)
+	if err != nil {
+		t.Fatalf("decoding %q: %v", w.Body, err)
+	}
+}
+
+func TestGetIndividual(t *testing.T) {
+	h := NewStoreServer(newTestStore()).API()
+	tests := []struct {
+		id             string
+		wantName       string
+		redirectedFrom string
+	}{
+		{id: "1", wantName: "Jane Doe"},
+		{id: "2", wantName: "John Smith"},
+		{id: "3", wantName: "Jane Doe", redirectedFrom: "3"},
+	}
+	for _, tt := range tests {
+		var i individual
+		decode(t, post(t, h, "/get-individual", map[string]string{"id": tt.id}), http.StatusOK, &i)
+		if got := i.FirstName + " " + i.LastName; got != tt.wantName {
+			t.Errorf("individual %s: got %s, want %s", tt.id, got, tt.wantName)
+		}
+		if i.RedirectedFrom != tt.redirectedFrom {
+			t.Errorf("individual %s: got redirected_from %q, want %q", tt.id, i.RedirectedFrom, tt.redirectedFrom)
+		}
+	}
+
+	var i individual
+	decode(t, post(t, h, "/get-individual", map[string]string{"id": "1"}), http.StatusOK, &i)
+	if len(i.Associations) != 2 || len(i.Roles) != 1 || len(i.Aliases) != 1 {
+		t.Errorf("got %d associations, %d roles and %d aliases, want 2, 1 and 1", len(i.Associations), len(i.Roles), len(i.Aliases))
+	}
+
+	w := post(t, h, "/get-individual", map[string]string{"id": "404"})
+	var resp struct {
+		Error     string `json:"error"`
+		RequestID string `json:"request_id"`
+	}
+	decode(t, w, http.StatusNotFound, &resp)
+	if resp.Error != "individual not found" || resp.RequestID == "" {
+		t.Errorf("got error response %+v", resp)
+	}
+	if id := w.Header().Get("X-Request-ID"); id != resp.RequestID {
+		t.Errorf("got X-Request-ID %q, want %q", id, resp.RequestID)
+	}
+}
+
+func TestSearchIndividuals(t *testing.T) {
+	h := NewStoreServer(newTestStore()).API()
+	tests := []struct {
+		query string
+		want  []string
+	}{
+		{query: "Do", want: nil},
+		{query: "doe", want: []string{"1"}},
+		{query: "smith, j", want: []string{"2"}},
+		{query: "nobody", want: nil},
+	}
+	for _, tt := range tests {
+		var resp []individualname
+		decode(t, post(t, h, "/search-individuals", map[string]string{"query": tt.query}), http.StatusOK, &resp)
+		var got []string
+		for _, i := range resp {
+			got = append(got, i.ID)
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("search %q: got %v, want %v", tt.query, got, tt.want)
+		}
+	}
+}
+
+func TestContributions(t *testing.T) {
+	h := NewStoreServer(newTestStore()).API()
+
+	var received []contribution
+	decode(t, post(t, h, "/individual-contributions-received", map[string]interface{}{"individual_id": "1"}), http.StatusOK, &received)
+	if len(received) != 2 || received[0].ContributorRoles != nil {
+		t.Fatalf("got %+v, want 2 contributions without roles", received)
+	}
+
+	decode(t, post(t, h, "/individual-contributions-received", map[string]interface{}{"individual_id": "1", "with_roles": true}), http.StatusOK, &received)
+	descriptions := func(roles []activeRole) []string {
+		res := []string{}
+		for _, r := range roles {
+			res = append(res, r.Description)
+		}
+		return res
+	}
+	want := map[string][]string{
+		// On the community board in 2016, on the council in 2019
+		"30": {"Community Board 3"},
+		"31": {"District 3, Council Member"},
+	}
+	for _, c := range received {
+		if got := descriptions(c.RecipientRoles); !reflect.DeepEqual(got, want[c.ID]) {
+			t.Errorf("contribution %s: got recipient roles %v, want %v", c.ID, got, want[c.ID])
+		}
+		if got := descriptions(c.ContributorRoles); len(got) != 0 {
+			t.Errorf("contribution %s: got contributor roles %v, want none", c.ID, got)
+		}
+	}
+
+	var given []contribution
+	decode(t, post(t, h, "/individual-contributions-given", map[string]interface{}{"individual_id": "1", "with_roles": true}), http.StatusOK, &given)
+	if len(given) != 1 || given[0].ID != "32" || given[0].RecipientID != "" || given[0].RecipientRoles != nil {
+		t.Errorf("got %+v, want contribution 32 to an unmatched recipient", given)
+	}
+}
+
+func TestCategories(t *testing.T) {
+	h := NewStoreServer(newTestStore()).API()
+	ids := func(path string, body interface{}, header ...string) []string {
+		var resp []struct {
+			ID string `json:"id"`
+		}
+		decode(t, post(t, h, path, body, header...), http.StatusOK, &resp)
+		var res []string
+		for _, r := range resp {
+			res = append(res, r.ID)
+		}
+		return res
+	}
+	tests := []struct {
+		path string
+		body interface{}
+		want []string
+	}{
+		{"/categories", nil, []string{"20"}},
+		{"/individual-categories", map[string]string{"category_id": "20"}, []string{"1"}},
+		{"/category-associations", map[string]string{"category_id": "20"}, []string{"10"}},
+		{"/individual-associations", map[string]string{"association_id": "11"}, []string{"1", "2"}},
+	}
+	for _, tt := range tests {
+		if got := ids(tt.path, tt.body); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s %v: got %v, want %v", tt.path, tt.body, got, tt.want)
+		}
+	}
+
+	// The curation queue is only for admins
+	if w := post(t, h, "/uncategorized-associations", nil); w.Code != http.StatusUnauthorized {
+		t.Errorf("got status %d without a token, want 401", w.Code)
+	}
+	admin := []string{"Authorization", "Bearer admin-token"}
+	if got, want := ids("/uncategorized-associations", nil, admin...), []string{"12", "11"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("/uncategorized-associations: got %v, want %v", got, want)
+	}
+	var uncategorized []uncategorizedAssociation
+	decode(t, post(t, h, "/uncategorized-associations", nil, admin...), http.StatusOK, &uncategorized)
+	if uncategorized[1].IndividualCount != 2 {
+		t.Errorf("got %d individuals in the Tenants Union, want 2", uncategorized[1].IndividualCount)
+	}
+}
+
+func TestIndividualHistoryAuth(t *testing.T) {
+	h := NewStoreServer(newTestStore()).API()
+	body := map[string]string{"individual_id": "1"}
+	tests := []struct {
+		token  string
+		status int
+	}{
+		{"", http.StatusUnauthorized},
+		{"wrong-token", http.StatusUnauthorized},
+		{"viewer-token", http.StatusOK},
+	}
+	for _, tt := range tests {
+		w := post(t, h, "/individual-history", body, "Authorization", "Bearer "+tt.token)
+		if w.Code != tt.status {
+			t.Errorf("token %q: got status %d, want %d", tt.token, w.Code, tt.status)
+		}
+	}
+
+	var history []change
+	decode(t, post(t, h, "/individual-history", body, "Authorization", "Bearer viewer-token"), http.StatusOK, &history)
+	if len(history) != 2 || history[0].Actor != "editor" {
+		t.Errorf("got %+v, want 2 changes, most recent first", history)
+	}
+}
+
+func TestCurationNotServed(t *testing.T) {
+	h := NewStoreServer(newTestStore()).API()
+	w := post(t, h, "/create-individual", map[string]string{"first_name": "Jo"}, "Authorization", "Bearer viewer-token")
+	if w.Code != http.StatusNotFound {
+		t.Errorf("got status %d, want 404 from a read-only server", w.Code)
+	}
+}
+
+// failingStore is a Store whose association listing fails.
+type failingStore struct {
+	Store
+}
+
+func (failingStore) GetIndividualsByAssociation(ctx context.Context, associationID string) ([]individualname, error) {
+	return nil, errors.New("connection refused")
+}
+
+func TestStoreError(t *testing.T) {
+	h := NewStoreServer(failingStore{newTestStore()}).API()
+	w := post(t, h, "/individual-associations", map[string]string{"association_id": "11"})
+	// Only the error is written, not an empty listing after it
+	var resp map[string]string
+	decode(t, w, http.StatusInternalServerError, &resp)
+	if resp["error"] != "internal server error" {
+		t.Errorf("got %v, want an internal server error", resp)
+	}
+}
+
+func TestCaching(t *testing.T) {
+	store := newTestStore()
+	s := NewStoreServer(store)
+	now := time.Now()
+	s.cache.now = func() time.Time { return now }
+	h := s.API()
+	body := map[string]string{"id": "1"}
+
+	w := post(t, h, "/get-individual", body)
+	etag := w.Header().Get("ETag")
+	if w.Code != http.StatusOK || etag == "" {
+		t.Fatalf("got status %d and ETag %q, want 200 and an ETag", w.Code, etag)
+	}
+	if cc := w.Header().Get("Cache-Control"); cc != "no-cache" {
+		t.Errorf("got Cache-Control %q, want no-cache", cc)
+	}
+
+	w = post(t, h, "/get-individual", body, "If-None-Match", etag)
+	if w.Code != http.StatusNotModified || w.Body.Len() != 0 {
+		t.Errorf("got status %d with %d bytes, want an empty 304", w.Code, w.Body.Len())
+	}
+
+	// The data version isn't checked again until the interval's up
+	store.bumpVersion()
+	w = post(t, h, "/get-individual", body, "If-None-Match", etag)
+	if w.Code != http.StatusNotModified {
+		t.Errorf("got status %d within the check interval, want 304", w.Code)
+	}
+	now = now.Add(versionCheckInterval)
+	w = post(t, h, "/get-individual", body, "If-None-Match", etag)
+	if w.Code != http.StatusOK || w.Header().Get("ETag") == etag {
+		t.Errorf("got status %d and ETag %q after the data changed, want 200 and a new ETag", w.Code, w.Header().Get("ETag"))
+	}
+}
+
+func TestRateLimit(t *testing.T) {
+	s := NewStoreServer(newTestStore())
+	s.AnonymousLimit = RateLimit{PerMinute: 2}
+	h := s.API()
+
+	for i := 0; i < 2; i++ {
+		if w := post(t, h, "/categories", nil); w.Code != http.StatusOK {
+			t.Fatalf("request %d: got status %d, want 200", i, w.Code)
+		}
+	}
+	w := post(t, h, "/categories", nil)
+	if w.Code != http.StatusTooManyRequests || w.Header().Get("Retry-After") == "" {
+		t.Errorf("got status %d and Retry-After %q, want 429 with Retry-After", w.Code, w.Header().Get("Retry-After"))
+	}
+
+	// Keys have their own limits
+	w = post(t, h, "/categories", nil, "X-API-Key", "test-key")
+	if w.Code != http.StatusOK || w.Header().Get("X-RateLimit-Limit") != "5" || w.Header().Get("X-RateLimit-Remaining") != "4" {
+		t.Errorf("got status %d and limit headers %v, want 200 with 4 of 5 remaining", w.Code, w.Header())
+	}
+	w = post(t, h, "/categories", nil, "X-API-Key", "wrong-key")
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("got status %d for an unknown key, want 401", w.Code)
+	}
+}
+
+func TestDailyQuotaOnly(t *testing.T) {
+	s := NewStoreServer(newTestStore())
+	s.AnonymousLimit = RateLimit{Daily: 2}
+	h := s.API()
+
+	// Without a rate per minute, the daily quota still applies
+	for i, remaining := range []string{"1", "0"} {
+		w := post(t, h, "/categories", nil)
+		if w.Code != http.StatusOK || w.Header().Get("X-Quota-Remaining") != remaining || w.Header().Get("X-RateLimit-Limit") != "" {
+			t.Errorf("request %d: got status %d and limit headers %v, want 200 with %s of the quota remaining",
+				i, w.Code, w.Header(), remaining)
+		}
+	}
+	w := post(t, h, "/categories", nil)
+	if w.Code != http.StatusTooManyRequests || w.Header().Get("Retry-After") == "" {
+		t.Errorf("got status %d and Retry-After %q, want 429 with Retry-After", w.Code, w.Header().Get("Retry-After"))
+	}
+
+	// Without either, requests aren't limited
+	s = NewStoreServer(newTestStore())
+	s.AnonymousLimit = RateLimit{}
+	h = s.API()
+	for i := 0; i < 3; i++ {
+		w := post(t, h, "/categories", nil)
+		if w.Code != http.StatusOK || w.Header().Get("X-Quota-Limit") != "" {
+			t.Errorf("request %d: got status %d and limit headers %v, want 200 unlimited", i, w.Code, w.Header())
+		}
+	}
+}
+
+func TestRateLimitBehindProxy(t *testing.T) {
+	s := NewStoreServer(newTestStore())
+	s.AnonymousLimit = RateLimit{PerMinute: 1}
+	_, proxies, _ := net.ParseCIDR("192.0.2.0/24")
+	s.TrustedProxies = []*net.IPNet{proxies}
+	h := s.API()
+
+	// Requests all come from the proxy at 192.0.2.1, but clients
+	// forwarded from different addresses have their own limits
+	tests := []struct {
+		forwarded string
+		status    int
+	}{
+		{"198.51.100.1", http.StatusOK},
+		{"198.51.100.2", http.StatusOK},
+		{"198.51.100.1", http.StatusTooManyRequests},
+		// Addresses the client made up before the proxy's are ignored
+		{"203.0.113.9, 198.51.100.2", http.StatusTooManyRequests},
+		// As are trusted proxies after it
+		{"198.51.100.3, 192.0.2.2", http.StatusOK},
+	}
+	for _, tt := range tests {
+		w := post(t, h, "/categories", nil, "X-Forwarded-For", tt.forwarded)
+		if w.Code != tt.status {
+			t.Errorf("forwarded for %s: got status %d, want %d", tt.forwarded, w.Code, tt.status)
+		}
+	}
+
+	// Without trusted proxies, X-Forwarded-For is ignored
+	s = NewStoreServer(newTestStore())
+	s.AnonymousLimit = RateLimit{PerMinute: 1}
+	h = s.API()
+	post(t, h, "/categories", nil, "X-Forwarded-For", "198.51.100.1")
+	if w := post(t, h, "/categories", nil, "X-Forwarded-For", "198.51.100.2"); w.Code != http.StatusTooManyRequests {
+		t.Errorf("got status %d from an untrusted proxy, want 429", w.Code)
+	}
+}
+
+func TestCORS(t *testing.T) {
+	s := NewStoreServer(newTestStore())
+	s.AllowedOrigins = []string{"https://redstring.nyc"}
+	h := s.API()
+
+	w := request(t, h, http.MethodOptions, "/get-individual", nil,
+		"Origin", "https://redstring.nyc",
+		"Access-Control-Request-Method", "POST")
+	if w.Code != http.StatusNoContent {
+		t.Errorf("got status %d for preflight, want 204", w.Code)
+	}
+	if got := w.Header().Get("Access-Control-Allow-Origin"); got != "https://redstring.nyc" {
+		t.Errorf("got Access-Control-Allow-Origin %q", got)
+	}
+	if got := w.Header().Get("Access-Control-Allow-Headers"); !strings.Contains(got, "X-API-Key") {
+		t.Errorf("got Access-Control-Allow-Headers %q, want X-API-Key allowed", got)
+	}
+
+	w = request(t, h, http.MethodOptions, "/get-individual", nil,
+		"Origin", "https://elsewhere.example",
+		"Access-Control-Request-Method", "POST")
+	if got := w.Header().Get("Access-Control-Allow-Origin"); got != "" {
+		t.Errorf("got Access-Control-Allow-Origin %q for a disallowed origin", got)
+	}
+
+	w = post(t, h, "/categories", nil)
+	if got := w.Header().Get("X-Content-Type-Options"); got != "nosniff" {
+		t.Errorf("got X-Content-Type-Options %q, want nosniff", got)
+	}
+}
+
+func TestProbesAndMetrics(t *testing.T) {
+	h := NewStoreServer(newTestStore()).API()
+	for _, path := range []string{"/healthz", "/readyz"} {
+		if w := request(t, h, http.MethodGet, path, nil); w.Code != http.StatusOK {
+			t.Errorf("%s: got status %d, want 200", path, w.Code)
+		}
+	}
+
+	post(t, h, "/get-individual", map[string]string{"id": "1"})
+	post(t, h, "/no-such-endpoint", nil)
+
+	// Metrics are only for admins
+	if w := request(t, h, http.MethodGet, "/metrics", nil); w.Code != http.StatusUnauthorized {
+		t.Errorf("got status %d without a token, want 401", w.Code)
+	}
+	w := request(t, h, http.MethodGet, "/metrics", nil, "Authorization", "Bearer viewer-token")
+	if w.Code != http.StatusForbidden {
+		t.Errorf("got status %d for a viewer, want 403", w.Code)
+	}
+	w = request(t, h, http.MethodGet, "/metrics", nil, "Authorization", "Bearer admin-token")
+	for _, want := range []string{
+		`redstring_http_requests_total{route="/get-individual",method="POST",status="200"} 1`,
+		`redstring_http_requests_total{route="other",method="POST",status="404"} 1`,
+		`redstring_http_request_duration_seconds_count{route="/get-individual"} 1`,
+		`redstring_cache_lookups_total{result="miss"} 1`,
+	} {
+		if !strings.Contains(w.Body.String(), want+"\n") {
+			t.Errorf("metrics missing %s:\n%s", want, w.Body)
+		}
+	}
+}
@@ -0,0 +1,105 @@
+package api
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/pkg/errors"
+	"github.com/vickiniu/project-red-string/dataversion"
+)
+
+// Store is where the API reads the data it serves. The Postgres
+// store reads the database; the memory store serves a fixed dataset,
+// for testing handlers without a database.
+//
+// Curation goes straight to the database, so it's only served by
+// servers created with NewServer.
+type Store interface {
+	// GetIndividual returns the individual with the ID, following
+	// redirects from merged individuals, or a 404 error.
+	GetIndividual(ctx context.Context, id string) (*individual, error)
+	// SearchIndividuals returns individuals whose names contain
+	// query, or nothing if it's shorter than three characters.
+	SearchIndividuals(ctx context.Context, query string) ([]individualname, error)
+	// ContributionsReceived and ContributionsGiven return the
+	// individual's contributions, annotated with the roles of each
+	// party at the time if withRoles is set.
+	ContributionsReceived(ctx context.Context, individualID string, withRoles bool) ([]contribution, error)
+	ContributionsGiven(ctx context.Context, individualID string, withRoles bool) ([]contribution, error)
+
+	GetCategories(ctx context.Context) ([]category, error)
+	GetIndividualsByCategory(ctx context.Context, categoryID string) ([]individualname, error)
+	GetAssociationsForCategory(ctx context.Context, categoryID string) ([]association, error)
+	GetIndividualsByAssociation(ctx context.Context, associationID string) ([]individualname, error)
+	GetUncategorizedAssociations(ctx context.Context) ([]uncategorizedAssociation, error)
+	// GetIndividualHistory returns the audit log entries concerning
+	// the individual, most recent first.
+	GetIndividualHistory(ctx context.Context, individualID string) ([]change, error)
+
+	// UserByTokenHash returns the active API user with the hashed
+	// token, or nil if there isn't one.
+	UserByTokenHash(ctx context.Context, hash string) (*user, error)
+	// APIKeyByHash returns the active API key with the hash, or nil
+	// if there isn't one.
+	APIKeyByHash(ctx context.Context, hash string) (*apiKey, error)
+	// DataVersion returns the current data version, which changes
+	// whenever the data does.
+	DataVersion(ctx context.Context) (int64, error)
+	// Ping reports whether the store is reachable.
+	Ping(ctx context.Context) error
+}
+
+// postgresStore is a Store reading from Postgres.
+type postgresStore struct {
+	db *sql.DB
+	// metrics times queries, if set
+	metrics *serverMetrics
+}
+
+// NewPostgresStore returns a Store reading from the database.
+func NewPostgresStore(db *sql.DB) Store {
+	return &postgresStore{db: db}
+}
+
+func (s *postgresStore) UserByTokenHash(ctx context.Context, hash string) (*user, error) {
+	defer s.metrics.timeQuery("userByTokenHash")()
+	const q = `
+		SELECT id, name, role
+		FROM api_users
+		WHERE token_hash = $1 AND revoked_ts IS NULL
+	`
+	u := &user{}
+	err := s.db.QueryRowContext(ctx, q, hash).Scan(&u.ID, &u.Name, &u.Role)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	} else if err != nil {
+		return nil, errors.Wrap(err, "querying user")
+	}
+	return u, nil
+}
+
+func (s *postgresStore) APIKeyByHash(ctx context.Context, hash string) (*apiKey, error) {
+	defer s.metrics.timeQuery("apiKeyByHash")()
+	const q = `
+		SELECT id, name, rate_per_minute, COALESCE(daily_quota, 0), created_by, created_ts
+		FROM api_keys
+		WHERE key_hash = $1 AND revoked_ts IS NULL
+	`
+	k := &apiKey{}
+	err := s.db.QueryRowContext(ctx, q, hash).Scan(&k.ID, &k.Name, &k.RatePerMinute, &k.DailyQuota, &k.CreatedBy, &k.CreatedTS)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	} else if err != nil {
+		return nil, errors.Wrap(err, "querying API key")
+	}
+	k.limit = RateLimit{PerMinute: k.RatePerMinute, Daily: k.DailyQuota}
+	return k, nil
+}
+
+func (s *postgresStore) DataVersion(ctx context.Context) (int64, error) {
+	return dataversion.Get(ctx, s.db)
+}
+
+func (s *postgresStore) Ping(ctx context.Context) error {
+	return s.db.PingContext(ctx)
+}
@@ -0,0 +1,123 @@
+// Package audit keeps an append-only log of changes made to the
+// database by the importers.
+//
+// Each command that changes data starts a Run and records a Change
+// for every field it sets or clears, along with the source the new
+// value came from. The log is never updated or deleted from, so it
+// can be used to find out why something changed and to undo the
+// changes of a bad run.
+package audit
+
+import (
+	"context"
+
+	"github.com/pkg/errors"
+	"github.com/vickiniu/project-red-string/internal/sqlutil"
+	"github.com/vickiniu/project-red-string/provenance"
+)
+
+// Entity types
+const (
+	EntityIndividual            = "individual"
+	EntityAssociation           = "association"
+	EntityIndividualAssociation = "individual_association"
+	EntityIndividualRole        = "individual_role"
+	EntityCategory              = "category"
+	EntityAssociationCategory   = "association_category"
+	EntityContribution          = "contribution"
+)
+
+// Change is a change to a single field of an entity. Old is empty
+// when the entity or field is created and New is empty when it's
+// removed; empty values are stored as NULL.
+type Change struct {
+	Entity   string
+	EntityID string
+	// IndividualID is the individual the change concerns, if any,
+	// so it shows up in their history. It's the individual's own ID
+	// for EntityIndividual.
+	IndividualID string
+	Field        string
+	Old          string
+	New          string
+}
+
+// Run is a single run of a command that changes data, e.g. an
+// annotations sync.
+type Run struct {
+	ID      string
+	Command string
+	Actor   string
+}
+
+// StartRun records the start of a run of command by the current
+// actor. Starting it within the run's transaction means runs that
+// are rolled back leave no trace.
+func StartRun(ctx context.Context, db sqlutil.Querier, command string) (*Run, error) {
+	return StartRunBy(ctx, db, command, provenance.Actor())
+}
+
+// StartRunBy is like StartRun, for a run by the given actor, e.g. an
+// API user.
+func StartRunBy(ctx context.Context, db sqlutil.Querier, command, actor string) (*Run, error) {
+	r := &Run{Command: command, Actor: actor}
+	const insertQ = `
+		INSERT INTO audit_runs (
+			command,
+			actor,
+			started_ts
+		) VALUES (
+			$1,
+			$2,
+			current_timestamp
+		) RETURNING id
+	`
+	err := db.QueryRowContext(ctx, insertQ, r.Command, r.Actor).Scan(&r.ID)
+	if err != nil {
+		return nil, errors.Wrap(err, "inserting audit run")
+	}
+	return r, nil
+}
+
+// Record appends changes made by the run to the log. sourceID is the
+// source the changes were taken from, and may be empty.
+func (r *Run) Record(ctx context.Context, db sqlutil.Querier, sourceID string, changes ...Change) error {
+	const insertQ = `
+		INSERT INTO audit_log (
+			run_id,
+			entity_type,
+			entity_id,
+			individual_id,
+			field,
+			old_value,
+			new_value,
+			actor,
+			source_id,
+			changed_ts
+		) VALUES (
+			$1,
+			$2,
+			$3,
+			$4,
+			$5,
+			$6,
+			$7,
+			$8,
+			$9,
+			current_timestamp
+		)
+	`
+	for _, c := range changes {
+		if c.Old == c.New {
+			continue
+		}
+		_, err := db.ExecContext(
+			ctx, insertQ, r.ID, c.Entity, c.EntityID, sqlutil.NullString(c.IndividualID), c.Field,
+			sqlutil.NullString(c.Old), sqlutil.NullString(c.New), r.Actor, sqlutil.NullString(sourceID),
+		)
+		if err != nil {
+			return errors.Wrapf(err, "recording change to %s %s", c.Entity, c.EntityID)
+		}
+	}
+	return nil
+}
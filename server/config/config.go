@@ -0,0 +1,339 @@
+// Package config loads the configuration of the redstring command
+// from, in order of precedence, command line flags, environment
+// variables, an optional YAML file and defaults.
+//
+// Every setting has a flag, e.g. -db-max-open-conns; an environment
+// variable named after it, DB_MAX_OPEN_CONNS; and a key in the file,
+// db_max_open_conns. The file is named by -config-file or
+// CONFIG_FILE:
+//
+//	listen: ":8080"
+//	database_url: postgres://redstring@db/redstring
+//	write_timeout: 1m
+//	cors_origins: [https://redstring.nyc]
+package config
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/vickiniu/project-red-string/airtable"
+	"gopkg.in/yaml.v2"
+)
+
+// Config is the configuration shared by the server and the other
+// subcommands.
+type Config struct {
+	// Listen is the address the server listens on
+	Listen string
+	// DatabaseURL is the Postgres connection string
+	DatabaseURL string
+	// SchemaCheck is one of "strict" (refuse to start unless all
+	// migrations are applied), "warn" or "off"
+	SchemaCheck string
+	// LogLevel is the minimum level logged: debug, info, warn or
+	// error
+	LogLevel string
+	// CORSOrigins are the origins allowed to make cross-origin
+	// requests, or "*" for any
+	CORSOrigins []string
+	// TrustedProxies are the networks of the proxies in front of the
+	// server, such as the Heroku router, whose X-Forwarded-For
+	// headers are trusted to give the client's address
+	TrustedProxies []*net.IPNet
+
+	// CacheMaxAge is how long clients may reuse cached responses
+	// without revalidating them
+	CacheMaxAge time.Duration
+
+	// AnonymousRatePerMinute and AnonymousDailyQuota limit each
+	// address making requests without an API key; 0 is unlimited
+	AnonymousRatePerMinute int
+	AnonymousDailyQuota    int
+
+	// Timeouts for reading requests, writing responses and keeping
+	// idle connections open, as for http.Server
+	ReadHeaderTimeout time.Duration
+	ReadTimeout       time.Duration
+	WriteTimeout      time.Duration
+	IdleTimeout       time.Duration
+	// ShutdownTimeout is how long in-flight requests are given to
+	// finish when the server is stopped
+	ShutdownTimeout time.Duration
+
+	// Connection pool settings, as for sql.DB
+	DBMaxOpenConns    int
+	DBMaxIdleConns    int
+	DBConnMaxLifetime time.Duration
+	// DBConnectTimeout is how long to keep retrying the database at
+	// startup before giving up
+	DBConnectTimeout time.Duration
+
+	// The Airtable base annotations are synced from, and the names
+	// of its tables
+	AirtableURL             string
+	AirtableBaseID          string
+	AirtableAPIKey          string
+	AirtableMasterTable     string
+	AirtableCategoriesTable string
+	// FieldMap is the path of a JSON file mapping Airtable fields to
+	// individuals columns, if not the default mapping
+	FieldMap string
+
+	// AnnotationsSyncInterval is how often the server syncs
+	// annotations from Airtable, or 0 not to
+	AnnotationsSyncInterval time.Duration
+	// CFBImportDir is a directory of CFB exports the server imports
+	// new files from every CFBImportInterval, if set
+	CFBImportDir      string
+	CFBImportInterval time.Duration
+	// CFBURL is where the CFB export is downloaded from into
+	// CFBImportDir, if set
+	CFBURL string
+	// CFBMaxErrors is how many rows of a CFB export may fail to
+	// import before the import fails
+	CFBMaxErrors int
+}
+
+// Default returns the default configuration.
+func Default() *Config {
+	return &Config{
+		Listen:                  ":8080",
+		DatabaseURL:             "postgres:///redstring?sslmode=disable",
+		SchemaCheck:             "warn",
+		LogLevel:                "info",
+		CORSOrigins:             []string{"*"},
+		AnonymousRatePerMinute:  60,
+		AnonymousDailyQuota:     5000,
+		ReadHeaderTimeout:       10 * time.Second,
+		ReadTimeout:             30 * time.Second,
+		WriteTimeout:            60 * time.Second,
+		IdleTimeout:             2 * time.Minute,
+		ShutdownTimeout:         30 * time.Second,
+		DBMaxOpenConns:          20,
+		DBMaxIdleConns:          5,
+		DBConnMaxLifetime:       30 * time.Minute,
+		DBConnectTimeout:        time.Minute,
+		AirtableURL:             airtable.DefaultBaseURL,
+		AirtableMasterTable:     "Master List",
+		AirtableCategoriesTable: "Categories",
+		CFBImportInterval:       time.Hour,
+		CFBMaxErrors:            100,
+	}
+}
+
+// flagSet returns a FlagSet setting c's fields.
+func (c *Config) flagSet(name string) *flag.FlagSet {
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	fs.String("config-file", "", "read settings from this YAML file")
+	fs.StringVar(&c.Listen, "listen", c.Listen, "address to listen on")
+	fs.StringVar(&c.DatabaseURL, "database-url", c.DatabaseURL, "Postgres connection string")
+	fs.StringVar(&c.SchemaCheck, "schema-check", c.SchemaCheck, "check for pending migrations at startup: strict, warn or off")
+	fs.StringVar(&c.LogLevel, "log-level", c.LogLevel, "minimum level to log: debug, info, warn or error")
+	fs.Var((*stringList)(&c.CORSOrigins), "cors-origins", "comma separated origins allowed to make cross-origin requests, or * for any")
+	fs.Var((*networkList)(&c.TrustedProxies), "trusted-proxies", "comma separated addresses or CIDR networks of proxies whose X-Forwarded-For is trusted")
+	fs.DurationVar(&c.CacheMaxAge, "cache-max-age", c.CacheMaxAge, "how long clients may reuse cached responses without revalidating them")
+	fs.IntVar(&c.AnonymousRatePerMinute, "anonymous-rate-per-minute", c.AnonymousRatePerMinute, "requests per minute allowed each address without an API key, or 0 for no limit per minute")
+	fs.IntVar(&c.AnonymousDailyQuota, "anonymous-daily-quota", c.AnonymousDailyQuota, "requests per day allowed each address without an API key, or 0 for no limit")
+	fs.DurationVar(&c.ReadHeaderTimeout, "read-header-timeout", c.ReadHeaderTimeout, "time allowed to read request headers")
+	fs.DurationVar(&c.ReadTimeout, "read-timeout", c.ReadTimeout, "time allowed to read requests")
+	fs.DurationVar(&c.WriteTimeout, "write-timeout", c.WriteTimeout, "time allowed to write responses")
+	fs.DurationVar(&c.IdleTimeout, "idle-timeout", c.IdleTimeout, "time to keep idle connections open")
+	fs.DurationVar(&c.ShutdownTimeout, "shutdown-timeout", c.ShutdownTimeout, "time allowed for in-flight requests when stopping")
+	fs.IntVar(&c.DBMaxOpenConns, "db-max-open-conns", c.DBMaxOpenConns, "maximum open database connections, or 0 for no limit")
+	fs.IntVar(&c.DBMaxIdleConns, "db-max-idle-conns", c.DBMaxIdleConns, "maximum idle database connections")
+	fs.DurationVar(&c.DBConnMaxLifetime, "db-conn-max-lifetime", c.DBConnMaxLifetime, "maximum age of database connections, or 0 for no limit")
+	fs.DurationVar(&c.DBConnectTimeout, "db-connect-timeout", c.DBConnectTimeout, "time to keep retrying the database at startup")
+	fs.StringVar(&c.AirtableURL, "airtable-url", c.AirtableURL, "Airtable API URL")
+	fs.StringVar(&c.AirtableBaseID, "airtable-base-id", c.AirtableBaseID, "Airtable base to sync annotations from")
+	fs.StringVar(&c.AirtableAPIKey, "airtable-api-key", c.AirtableAPIKey, "Airtable API key")
+	fs.StringVar(&c.AirtableMasterTable, "airtable-master-table", c.AirtableMasterTable, "Airtable table of individuals")
+	fs.StringVar(&c.AirtableCategoriesTable, "airtable-categories-table", c.AirtableCategoriesTable, "Airtable table of categories")
+	fs.StringVar(&c.FieldMap, "field-map", c.FieldMap, "JSON file mapping Airtable fields to individuals columns")
+	fs.DurationVar(&c.AnnotationsSyncInterval, "annotations-sync-interval", c.AnnotationsSyncInterval, "how often the server syncs annotations from Airtable, or 0 not to")
+	fs.StringVar(&c.CFBImportDir, "cfb-import-dir", c.CFBImportDir, "directory of CFB exports the server imports new files from")
+	fs.DurationVar(&c.CFBImportInterval, "cfb-import-interval", c.CFBImportInterval, "how often the server checks for new CFB exports")
+	fs.StringVar(&c.CFBURL, "cfb-url", c.CFBURL, "URL to download the CFB export from into cfb-import-dir")
+	fs.IntVar(&c.CFBMaxErrors, "cfb-max-errors", c.CFBMaxErrors, "rows of a CFB export that may fail to import before the import fails")
+	return fs
+}
+
+// Load loads the configuration, parsing flags from args. It returns
+// the arguments left after the flags, e.g. a subcommand.
+func Load(name string, args []string) (*Config, []string, error) {
+	// Flags are parsed first to find the config file, then applied
+	// again over the file and environment
+	fs := Default().flagSet(name)
+	err := fs.Parse(args)
+	if err != nil {
+		return nil, nil, err
+	}
+	var set []*flag.Flag
+	fs.Visit(func(f *flag.Flag) {
+		set = append(set, f)
+	})
+
+	c := Default()
+	cfs := c.flagSet(name)
+	path := fs.Lookup("config-file").Value.String()
+	if path == "" {
+		path = os.Getenv("CONFIG_FILE")
+	}
+	if path != "" {
+		err = loadFile(cfs, path)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	var envErr error
+	cfs.VisitAll(func(f *flag.Flag) {
+		if v := os.Getenv(envName(f.Name)); v != "" && envErr == nil {
+			if err := cfs.Set(f.Name, v); err != nil {
+				envErr = errors.Wrapf(err, "invalid %s", envName(f.Name))
+			}
+		}
+	})
+	if envErr != nil {
+		return nil, nil, envErr
+	}
+	for _, f := range set {
+		cfs.Set(f.Name, f.Value.String())
+	}
+	return c, fs.Args(), c.validate()
+}
+
+// loadFile applies the settings in the YAML file at path.
+func loadFile(fs *flag.FlagSet, path string) error {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return errors.Wrap(err, "reading config file")
+	}
+	var settings map[string]interface{}
+	err = yaml.Unmarshal(b, &settings)
+	if err != nil {
+		return errors.Wrapf(err, "parsing config file %s", path)
+	}
+	keys := make([]string, 0, len(settings))
+	for k := range settings {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		name := strings.Replace(k, "_", "-", -1)
+		if fs.Lookup(name) == nil || name == "config-file" {
+			return fmt.Errorf("%s: unknown setting %q", path, k)
+		}
+		v := settings[k]
+		if list, ok := v.([]interface{}); ok {
+			var s []string
+			for _, e := range list {
+				s = append(s, fmt.Sprint(e))
+			}
+			v = strings.Join(s, ",")
+		}
+		if err := fs.Set(name, fmt.Sprint(v)); err != nil {
+			return errors.Wrapf(err, "%s: invalid %s", path, k)
+		}
+	}
+	return nil
+}
+
+func (c *Config) validate() error {
+	switch c.SchemaCheck {
+	case "strict", "warn", "off":
+	default:
+		return fmt.Errorf("invalid schema check %q", c.SchemaCheck)
+	}
+	if c.DatabaseURL == "" {
+		return errors.New("missing database URL")
+	}
+	if c.CFBImportDir != "" && c.CFBImportInterval <= 0 {
+		return errors.New("cfb-import-interval must be positive to import from cfb-import-dir")
+	}
+	if c.CFBURL != "" && c.CFBImportDir == "" {
+		return errors.New("cfb-import-dir must be set to download from cfb-url")
+	}
+	if c.CFBMaxErrors < 0 {
+		return errors.New("invalid cfb max errors")
+	}
+	if c.AnnotationsSyncInterval < 0 {
+		return errors.New("invalid annotations sync interval")
+	}
+	return nil
+}
+
+// envName returns the environment variable for a flag, e.g.
+// DB_MAX_OPEN_CONNS for db-max-open-conns.
+func envName(flag string) string {
+	return strings.ToUpper(strings.Replace(flag, "-", "_", -1))
+}
+
+// stringList is a comma separated list flag.
+type stringList []string
+
+func (l *stringList) String() string {
+	if l == nil {
+		return ""
+	}
+	return strings.Join(*l, ",")
+}
+
+func (l *stringList) Set(s string) error {
+	*l = nil
+	for _, e := range strings.Split(s, ",") {
+		if e = strings.TrimSpace(e); e != "" {
+			*l = append(*l, e)
+		}
+	}
+	return nil
+}
+
+// networkList is a comma separated list of addresses or CIDR
+// networks. An address is a network of just that address.
+type networkList []*net.IPNet
+
+func (l *networkList) String() string {
+	if l == nil {
+		return ""
+	}
+	var s []string
+	for _, n := range *l {
+		s = append(s, n.String())
+	}
+	return strings.Join(s, ",")
+}
+
+func (l *networkList) Set(s string) error {
+	*l = nil
+	for _, e := range strings.Split(s, ",") {
+		e = strings.TrimSpace(e)
+		if e == "" {
+			continue
+		}
+		if !strings.Contains(e, "/") {
+			ip := net.ParseIP(e)
+			if ip == nil {
+				return fmt.Errorf("invalid address %q", e)
+			}
+			bits := 8 * net.IPv6len
+			if ip4 := ip.To4(); ip4 != nil {
+				ip, bits = ip4, 8*net.IPv4len
+			}
+			*l = append(*l, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, n, err := net.ParseCIDR(e)
+		if err != nil {
+			return fmt.Errorf("invalid network %q", e)
+		}
+		*l = append(*l, n)
+	}
+	return nil
+}
@@ -0,0 +1,397 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/vickiniu/project-red-string/airtable"
+	"github.com/vickiniu/project-red-string/config"
+	"github.com/vickiniu/project-red-string/data/annotations"
+	"github.com/vickiniu/project-red-string/data/cfb"
+	"github.com/vickiniu/project-red-string/jobs"
+	"github.com/vickiniu/project-red-string/logging"
+	"github.com/vickiniu/project-red-string/provenance"
+)
+
+// runImport implements the import subcommand:
+//
+//	import cfb [-dry-run] [-unmatched-file FILE] FILE
+//	    import the contributions in a CFB export, writing the
+//	    recipient names that matched no individual to FILE
+func runImport(ctx context.Context, cfg *config.Config, db *sql.DB, args []string) {
+	if len(args) == 0 || args[0] != "cfb" {
+		log.Fatalf("usage: import cfb [-dry-run] [-unmatched-file FILE] FILE")
+	}
+	fs := flag.NewFlagSet("import cfb", flag.ExitOnError)
+	dryRun := fs.Bool("dry-run", false, "report what would be imported without changing anything")
+	unmatchedFile := fs.String("unmatched-file", "unmatched_names.txt", "write recipient names that matched no individual to this file")
+	fs.Parse(args[1:])
+	if fs.NArg() != 1 {
+		log.Fatalf("usage: import cfb [-dry-run] [-unmatched-file FILE] FILE")
+	}
+	path := fs.Arg(0)
+
+	res, err := importCFB(ctx, db, path, cfb.Options{DryRun: *dryRun, MaxErrors: cfg.CFBMaxErrors})
+	if err != nil {
+		log.Fatalf("error importing %s: %v\n", path, err)
+	}
+	if *dryRun {
+		fmt.Printf("dry run of importing %s, nothing was changed\n", path)
+		res.Print(os.Stdout)
+		return
+	}
+	log.Printf("imported %s, %d unmatched recipient names, %d rows couldn't be imported",
+		path, len(res.UnmatchedNames), res.Errored)
+	for _, e := range res.Errors {
+		log.Printf("row %d (%s): %s", e.Row, e.RefNo, e.Err)
+	}
+	err = ioutil.WriteFile(*unmatchedFile, []byte(strings.Join(res.UnmatchedNames, "\n")), 0644)
+	if err != nil {
+		log.Printf("unable to write %s: %v", *unmatchedFile, err)
+	}
+}
+
+// runSync implements the sync subcommand:
+//
+//	sync annotations [-dry-run] [-master-file FILE [-categories-file FILE]]
+//	    sync annotations from the configured Airtable base, or from
+//	    files exported from it
+func runSync(ctx context.Context, cfg *config.Config, db *sql.DB, args []string) {
+	if len(args) == 0 || args[0] != "annotations" {
+		log.Fatalf("usage: sync annotations [-dry-run] [-master-file FILE [-categories-file FILE]]")
+	}
+	fs := flag.NewFlagSet("sync annotations", flag.ExitOnError)
+	dryRun := fs.Bool("dry-run", false, "report what would be synced without changing anything")
+	masterFile := fs.String("master-file", "", "read the master list from a CSV, JSON or YAML directory export instead of Airtable")
+	categoriesFile := fs.String("categories-file", "", "read categories from a CSV, JSON or YAML directory export (with -master-file)")
+	fs.Parse(args[1:])
+
+	stats, err := syncAnnotations(ctx, cfg, db, *masterFile, *categoriesFile, *dryRun)
+	if err != nil {
+		log.Fatalf("error syncing annotations: %v\n", err)
+	}
+	if *dryRun {
+		fmt.Println("dry run of syncing annotations, nothing was changed")
+	}
+	stats.Print(os.Stdout)
+}
+
+// runFetch implements the fetch subcommand:
+//
+//	fetch cfb
+//	    download the CFB export from cfb-url into cfb-import-dir,
+//	    and import it if it's changed
+func runFetch(ctx context.Context, cfg *config.Config, db *sql.DB, args []string) {
+	if len(args) != 1 || args[0] != "cfb" {
+		log.Fatalf("usage: fetch cfb")
+	}
+	if cfg.CFBURL == "" {
+		log.Fatalf("cfb-url isn't set")
+	}
+	d, err := fetchCFB(ctx, cfg, db)
+	if err != nil {
+		log.Fatalf("error fetching CFB export: %v\n", err)
+	}
+	if !d.New {
+		log.Printf("CFB export unchanged since %s was downloaded", d.Path)
+		return
+	}
+	res, err := importCFB(ctx, db, d.Path, cfb.Options{MaxErrors: cfg.CFBMaxErrors})
+	if err != nil {
+		log.Fatalf("error importing %s: %v\n", d.Path, err)
+	}
+	log.Printf("imported %s: %d read, %d inserted, %d skipped, %d errored, %d unmatched recipient names",
+		d.Path, res.Read, res.Inserted, res.Skipped, res.Errored, len(res.UnmatchedNames))
+}
+
+// Job names
+const (
+	jobSyncAnnotations = "sync annotations"
+	jobImportCFB       = "import cfb"
+	jobFetchCFB        = "fetch cfb"
+)
+
+// cfbClient downloads CFB exports, which can be large.
+var cfbClient = &http.Client{Timeout: 10 * time.Minute}
+
+// fetchCFB downloads the CFB export from cfb-url into cfb-import-dir
+// as a run of the fetch cfb job.
+func fetchCFB(ctx context.Context, cfg *config.Config, db *sql.DB) (*cfb.Download, error) {
+	var d *cfb.Download
+	err := jobs.Run(ctx, db, jobFetchCFB, cfg.CFBURL, func(ctx context.Context) (jobs.Counts, error) {
+		var err error
+		d, err = cfb.Fetch(ctx, db, cfbClient, cfg.CFBURL, cfg.CFBImportDir)
+		if err != nil {
+			return nil, err
+		}
+		counts := jobs.Counts{"bytes": int(d.Size), "new": 0}
+		if d.New {
+			counts["new"] = 1
+		}
+		return counts, nil
+	})
+	return d, err
+}
+
+// syncAnnotations syncs annotations from the configured Airtable base,
+// or from files exported from it if masterFile is set, as a run of
+// the sync annotations job. Dry runs aren't recorded as runs.
+func syncAnnotations(ctx context.Context, cfg *config.Config, db *sql.DB, masterFile, categoriesFile string, dryRun bool) (annotations.Stats, error) {
+	fields, err := annotations.LoadFieldMap(cfg.FieldMap)
+	if err != nil {
+		return annotations.Stats{}, errors.Wrap(err, "loading field map")
+	}
+	syncCfg := annotations.SyncConfig{
+		MasterTable:     cfg.AirtableMasterTable,
+		CategoriesTable: cfg.AirtableCategoriesTable,
+		Fields:          fields,
+		Source:          provenance.Source{Type: provenance.TypeAirtable},
+		DryRun:          dryRun,
+	}
+	var src annotations.RecordSource
+	if masterFile != "" {
+		// Import from exported files
+		paths := map[string]string{syncCfg.MasterTable: masterFile}
+		if categoriesFile != "" {
+			paths[syncCfg.CategoriesTable] = categoriesFile
+		} else {
+			syncCfg.CategoriesTable = ""
+		}
+		src = annotations.FileSource{Paths: paths}
+		syncCfg.Source = provenance.Source{Type: provenance.TypeFile, File: masterFile}
+	} else {
+		c := airtable.NewClient(cfg.AirtableBaseID, cfg.AirtableAPIKey)
+		c.BaseURL = cfg.AirtableURL
+		src = c
+	}
+	if dryRun {
+		return annotations.Sync(ctx, db, src, syncCfg)
+	}
+
+	var stats annotations.Stats
+	err = jobs.Run(ctx, db, jobSyncAnnotations, masterFile, func(ctx context.Context) (jobs.Counts, error) {
+		var err error
+		stats, err = annotations.Sync(ctx, db, src, syncCfg)
+		return jobs.Counts{
+			"individuals_created":   stats.IndividualsCreated,
+			"individuals_updated":   stats.IndividualsUpdated,
+			"individuals_unchanged": stats.IndividualsUnchanged,
+			"individuals_removed":   stats.IndividualsRemoved,
+			"records_skipped":       stats.RecordsSkipped,
+			"associations_created":  stats.AssociationsCreated,
+			"links_added":           stats.LinksAdded,
+			"links_updated":         stats.LinksUpdated,
+			"links_removed":         stats.LinksRemoved,
+			"categories_created":    stats.CategoriesCreated,
+			"categories_updated":    stats.CategoriesUpdated,
+			"categories_removed":    stats.CategoriesRemoved,
+		}, err
+	})
+	return stats, err
+}
+
+// importCFB imports the CFB export at path as a run of the import cfb
+// job. Dry runs aren't recorded as runs.
+func importCFB(ctx context.Context, db *sql.DB, path string, opts cfb.Options) (*cfb.Result, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "opening CFB export")
+	}
+	defer f.Close()
+	if opts.DryRun {
+		return cfb.Import(ctx, db, filepath.Base(path), f, opts)
+	}
+	sum, err := checksum(f)
+	if err != nil {
+		return nil, errors.Wrap(err, "hashing CFB export")
+	}
+	var res *cfb.Result
+	err = jobs.RunChecksum(ctx, db, jobImportCFB, filepath.Base(path), sum, func(ctx context.Context) (jobs.Counts, error) {
+		var err error
+		res, err = cfb.Import(ctx, db, filepath.Base(path), f, opts)
+		if err != nil {
+			return nil, err
+		}
+		return jobs.Counts{
+			"read":                 res.Read,
+			"inserted":             res.Inserted,
+			"skipped":              res.Skipped,
+			"errored":              res.Errored,
+			"unmatched_recipients": len(res.UnmatchedNames),
+		}, nil
+	})
+	return res, err
+}
+
+// checksum returns the hex SHA-256 of f's contents, leaving it to be
+// read from the start.
+func checksum(f *os.File) (string, error) {
+	h := sha256.New()
+	_, err := io.Copy(h, f)
+	if err != nil {
+		return "", err
+	}
+	_, err = f.Seek(0, io.SeekStart)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// importCFBDir imports the CFB exports in dir that haven't been
+// imported, oldest first by name. An export that fails to import is
+// logged and skipped, and isn't tried again unless its contents
+// change; "redstring import cfb" retries it regardless.
+func importCFBDir(ctx context.Context, db *sql.DB, dir string, opts cfb.Options) error {
+	paths, err := filepath.Glob(filepath.Join(dir, "*.csv"))
+	if err != nil {
+		return errors.Wrap(err, "listing CFB exports")
+	}
+	sort.Strings(paths)
+	var failed []string
+	for _, path := range paths {
+		done, err := jobs.Succeeded(ctx, db, jobImportCFB, filepath.Base(path))
+		if err != nil {
+			return err
+		}
+		if done {
+			continue
+		}
+		known, err := knownBad(ctx, db, path)
+		if err != nil {
+			return err
+		}
+		if known {
+			logging.Debug(ctx, "skipping CFB export that failed to import", "file", path)
+			continue
+		}
+		logging.Info(ctx, "importing CFB export", "file", path)
+		_, err = importCFB(ctx, db, path, opts)
+		if ctx.Err() != nil || errors.Cause(err) == jobs.ErrLocked {
+			return err
+		}
+		if err != nil {
+			logging.Error(ctx, "error importing CFB export", "file", path, "error", err)
+			failed = append(failed, filepath.Base(path))
+		}
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("importing %s failed", strings.Join(failed, ", "))
+	}
+	return nil
+}
+
+// knownBad reports whether the CFB export at path has the contents of
+// one that failed to import.
+func knownBad(ctx context.Context, db *sql.DB, path string) (bool, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return false, errors.Wrap(err, "opening CFB export")
+	}
+	defer f.Close()
+	sum, err := checksum(f)
+	if err != nil {
+		return false, errors.Wrap(err, "hashing CFB export")
+	}
+	return jobs.FailedChecksum(ctx, db, jobImportCFB, sum)
+}
+
+// scheduledJobs returns the jobs the server is configured to run in
+// the background.
+func scheduledJobs(cfg *config.Config, db *sql.DB) []jobs.Job {
+	var res []jobs.Job
+	if cfg.AnnotationsSyncInterval > 0 {
+		res = append(res, jobs.Job{
+			Name:     jobSyncAnnotations,
+			Interval: cfg.AnnotationsSyncInterval,
+			Func: func(ctx context.Context) error {
+				_, err := syncAnnotations(ctx, cfg, db, "", "", false)
+				return err
+			},
+		})
+	}
+	if cfg.CFBImportDir != "" {
+		res = append(res, jobs.Job{
+			Name:     jobImportCFB,
+			Interval: cfg.CFBImportInterval,
+			Func: func(ctx context.Context) error {
+				// A new download is imported along with any other
+				// new files in the directory
+				if cfg.CFBURL != "" {
+					_, err := fetchCFB(ctx, cfg, db)
+					if err != nil {
+						return errors.Wrap(err, "fetching CFB export")
+					}
+				}
+				return importCFBDir(ctx, db, cfg.CFBImportDir, cfb.Options{MaxErrors: cfg.CFBMaxErrors})
+			},
+		})
+	}
+	return res
+}
+
+// runMatch implements the match subcommand:
+//
+//	match review
+//	    list the recipients of imported contributions that matched
+//	    no individual, with individuals of the same last name
+func runMatch(ctx context.Context, cfg *config.Config, db *sql.DB, args []string) {
+	if len(args) != 1 || args[0] != "review" {
+		log.Fatalf("usage: match review")
+	}
+	unmatched, err := cfb.UnmatchedRecipients(ctx, db)
+	if err != nil {
+		log.Fatalf("error reviewing matches: %v\n", err)
+	}
+	for _, u := range unmatched {
+		fmt.Printf("%s (%s): %d contributions, $%.2f\n", u.Name, u.CFBRecipientID, u.Contributions, float64(u.Amount)/100)
+		for _, c := range u.Candidates {
+			fmt.Printf("    maybe %s (%s)\n", c.CFBName, c.ID)
+		}
+	}
+	if len(unmatched) == 0 {
+		log.Println("every recipient is matched")
+	}
+}
+
+// runExport implements the export subcommand:
+//
+//	export [-master-file FILE] [-categories-file FILE]
+//	    write the annotations as JSON files that sync annotations
+//	    can read
+func runExport(ctx context.Context, cfg *config.Config, db *sql.DB, args []string) {
+	fs := flag.NewFlagSet("export", flag.ExitOnError)
+	masterFile := fs.String("master-file", "master.json", "write individuals to this file")
+	categoriesFile := fs.String("categories-file", "categories.json", "write categories to this file")
+	fs.Parse(args)
+
+	master, err := os.Create(*masterFile)
+	if err != nil {
+		log.Fatalf("error creating %s: %v\n", *masterFile, err)
+	}
+	defer master.Close()
+	categories, err := os.Create(*categoriesFile)
+	if err != nil {
+		log.Fatalf("error creating %s: %v\n", *categoriesFile, err)
+	}
+	defer categories.Close()
+	err = annotations.Export(ctx, db, master, categories)
+	if err != nil {
+		log.Fatalf("error exporting annotations: %v\n", err)
+	}
+	log.Printf("exported individuals to %s and categories to %s", *masterFile, *categoriesFile)
+}
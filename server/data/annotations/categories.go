@@ -0,0 +1,327 @@
+package annotations
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/lib/pq"
+	"github.com/pkg/errors"
+	"github.com/vickiniu/project-red-string/airtable"
+	"github.com/vickiniu/project-red-string/audit"
+	"github.com/vickiniu/project-red-string/logging"
+)
+
+// Fields on each record of the Airtable categories table.
+const (
+	categoryNameField         = "Name"
+	categoryAssociationsField = "Associations"
+)
+
+// categoryLink is a desired association : category mapping.
+type categoryLink struct {
+	associationID string
+	categoryID    string
+}
+
+// syncCategories upserts each category record and makes the
+// association_categories of synced categories match Airtable. An
+// association may belong to several categories; its category_id is
+// set to its primary (lowest ID) category.
+func (s *syncer) syncCategories(ctx context.Context, src RecordSource, table string) error {
+	var (
+		seen  pq.StringArray
+		links = make(map[categoryLink]bool)
+	)
+	err := src.ForEachRecord(ctx, table, func(r airtable.Record) error {
+		seen = append(seen, r.ID)
+		s.source = s.cfg.Source
+		s.source.AirtableRecordID = r.ID
+		s.sourceRow = ""
+		name := fieldString(r.Fields[categoryNameField])
+		if name == "" {
+			logging.Warn(ctx, "skipping category with no name", "record", r.ID)
+			return nil
+		}
+		categoryID, err := s.upsertCategory(ctx, r.ID, name)
+		if err != nil {
+			return errors.Wrap(err, "upserting category")
+		}
+		associations := fieldList(r.Fields[categoryAssociationsField], splitAssociations)
+		for _, desc := range associations {
+			const associationQ = `SELECT id FROM associations WHERE description = $1`
+			var aid string
+			err := s.tx.QueryRowContext(ctx, associationQ, desc).Scan(&aid)
+			if err == sql.ErrNoRows {
+				logging.Warn(ctx, "skipping unknown association in category", "category", name, "association", desc)
+				s.stats.UnknownAssociations++
+				continue
+			} else if err != nil {
+				return errors.Wrap(err, "querying association")
+			}
+			links[categoryLink{associationID: aid, categoryID: categoryID}] = true
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if len(seen) == 0 {
+		logging.Warn(ctx, "no categories synced, skipping category associations")
+		return nil
+	}
+
+	// Remove categories deleted from Airtable
+	s.source = s.cfg.Source
+	s.source.Note = "category deleted"
+	s.sourceRow = ""
+	const deleteLinksQ = `
+		DELETE FROM association_categories
+		WHERE category_id IN (
+			SELECT id
+			FROM categories
+			WHERE airtable_id IS NOT NULL AND NOT (airtable_id = ANY($1::text[]))
+		)
+		RETURNING association_id, category_id
+	`
+	changes, err := s.deletedRows(ctx, deleteLinksQ, seen, func(associationID, categoryID string) audit.Change {
+		return audit.Change{
+			Entity:   audit.EntityAssociationCategory,
+			EntityID: associationID,
+			Field:    "category_id",
+			Old:      categoryID,
+		}
+	})
+	if err != nil {
+		return errors.Wrap(err, "deleting stale category associations")
+	}
+	const deleteQ = `
+		DELETE FROM categories
+		WHERE airtable_id IS NOT NULL AND NOT (airtable_id = ANY($1::text[]))
+		RETURNING id, description
+	`
+	deleted, err := s.deletedRows(ctx, deleteQ, seen, func(categoryID, description string) audit.Change {
+		return audit.Change{
+			Entity:   audit.EntityCategory,
+			EntityID: categoryID,
+			Field:    "description",
+			Old:      description,
+		}
+	})
+	if err != nil {
+		return errors.Wrap(err, "deleting stale categories")
+	}
+	s.stats.CategoriesRemoved += len(deleted)
+	if len(changes)+len(deleted) > 0 {
+		err = s.record(ctx, append(changes, deleted...)...)
+		if err != nil {
+			return err
+		}
+	}
+
+	s.source = s.cfg.Source
+	s.sourceRow = ""
+	err = s.syncAssociationCategories(ctx, links)
+	if err != nil {
+		return errors.Wrap(err, "syncing association categories")
+	}
+
+	// Keep each association's primary category up to date
+	const primaryQ = `
+		UPDATE associations SET category_id = (
+			SELECT min(category_id)
+			FROM association_categories
+			WHERE association_categories.association_id = associations.id
+		)
+	`
+	_, err = s.tx.ExecContext(ctx, primaryQ)
+	if err != nil {
+		return errors.Wrap(err, "updating primary categories")
+	}
+	return nil
+}
+
+// deletedRows runs a DELETE ... RETURNING query returning two
+// columns, and returns the changes describing the deleted rows.
+func (s *syncer) deletedRows(ctx context.Context, query string, seen pq.StringArray, change func(a, b string) audit.Change) ([]audit.Change, error) {
+	rows, err := s.tx.QueryContext(ctx, query, seen)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var changes []audit.Change
+	for rows.Next() {
+		var a, b string
+		err := rows.Scan(&a, &b)
+		if err != nil {
+			return nil, errors.Wrap(err, "scanning deleted row")
+		}
+		changes = append(changes, change(a, b))
+	}
+	return changes, errors.Wrap(rows.Err(), "reading deleted rows")
+}
+
+func (s *syncer) upsertCategory(ctx context.Context, recordID, description string) (string, error) {
+	const categoryQ = `SELECT id, description FROM categories WHERE airtable_id = $1`
+	const legacyQ = `SELECT id, description FROM categories WHERE description = $1 AND airtable_id IS NULL`
+	var categoryID, current string
+	err := s.tx.QueryRowContext(ctx, categoryQ, recordID).Scan(&categoryID, &current)
+	if err == nil && current == description {
+		return categoryID, nil
+	} else if err == sql.ErrNoRows {
+		err = s.tx.QueryRowContext(ctx, legacyQ, description).Scan(&categoryID, &current)
+		if err == sql.ErrNoRows {
+			const insertQ = `
+				INSERT INTO categories (
+					description,
+					airtable_id
+				) VALUES (
+					$1,
+					$2
+				) RETURNING id
+			`
+			err := s.tx.QueryRowContext(ctx, insertQ, description, recordID).Scan(&categoryID)
+			if err != nil {
+				return "", errors.Wrap(err, "inserting category")
+			}
+			s.stats.CategoriesCreated++
+			return categoryID, s.record(ctx, categoryChange(categoryID, "description", "", description))
+		} else if err != nil {
+			return "", errors.Wrap(err, "querying category by description")
+		}
+	} else if err != nil {
+		return "", errors.Wrap(err, "querying category by Airtable ID")
+	}
+
+	const updateQ = `UPDATE categories SET description = $2, airtable_id = $3 WHERE id = $1`
+	_, err = s.tx.ExecContext(ctx, updateQ, categoryID, description, recordID)
+	if err != nil {
+		return "", errors.Wrap(err, "updating category")
+	}
+	s.stats.CategoriesUpdated++
+	return categoryID, s.record(ctx, categoryChange(categoryID, "description", current, description))
+}
+
+func categoryChange(categoryID, field, old, new string) audit.Change {
+	return audit.Change{
+		Entity:   audit.EntityCategory,
+		EntityID: categoryID,
+		Field:    field,
+		Old:      old,
+		New:      new,
+	}
+}
+
+// syncAssociationCategories makes the association_categories of
+// Airtable categories exactly links. Mappings to categories created
+// outside of Airtable are left alone.
+func (s *syncer) syncAssociationCategories(ctx context.Context, links map[categoryLink]bool) error {
+	const existingQ = `
+		SELECT DISTINCT association_id, category_id
+		FROM association_categories
+		WHERE category_id IN (
+			SELECT id FROM categories WHERE airtable_id IS NOT NULL
+		)
+	`
+	rows, err := s.tx.QueryContext(ctx, existingQ)
+	if err != nil {
+		return errors.Wrap(err, "querying existing association categories")
+	}
+	defer rows.Close()
+	existing := make(map[categoryLink]bool)
+	for rows.Next() {
+		var l categoryLink
+		err := rows.Scan(&l.associationID, &l.categoryID)
+		if err != nil {
+			return errors.Wrap(err, "scanning association category row")
+		}
+		existing[l] = true
+	}
+	if err := rows.Err(); err != nil {
+		return errors.Wrap(err, "reading association category rows")
+	}
+
+	for l := range existing {
+		if links[l] {
+			continue
+		}
+		const deleteQ = `DELETE FROM association_categories WHERE association_id = $1 AND category_id = $2`
+		_, err := s.tx.ExecContext(ctx, deleteQ, l.associationID, l.categoryID)
+		if err != nil {
+			return errors.Wrap(err, "deleting association category")
+		}
+		s.stats.CategoryLinksRemoved++
+		err = s.record(ctx, audit.Change{
+			Entity:   audit.EntityAssociationCategory,
+			EntityID: l.associationID,
+			Field:    "category_id",
+			Old:      l.categoryID,
+		})
+		if err != nil {
+			return err
+		}
+	}
+	for l := range links {
+		if existing[l] {
+			continue
+		}
+		const insertQ = `
+			INSERT INTO association_categories (
+				association_id,
+				category_id,
+				updated_ts
+			) VALUES (
+				$1,
+				$2,
+				current_timestamp
+			)
+		`
+		_, err := s.tx.ExecContext(ctx, insertQ, l.associationID, l.categoryID)
+		if err != nil {
+			return errors.Wrap(err, "inserting association category")
+		}
+		s.stats.CategoryLinksAdded++
+		err = s.record(ctx, audit.Change{
+			Entity:   audit.EntityAssociationCategory,
+			EntityID: l.associationID,
+			Field:    "category_id",
+			New:      l.categoryID,
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// uncategorizedAssociations returns the descriptions of
+// associations that don't belong to any category.
+func (s *syncer) uncategorizedAssociations(ctx context.Context) ([]string, error) {
+	const q = `
+		SELECT description
+		FROM associations
+		WHERE NOT EXISTS (
+			SELECT 1
+			FROM association_categories
+			WHERE association_categories.association_id = associations.id
+		)
+		ORDER BY description
+	`
+	rows, err := s.tx.QueryContext(ctx, q)
+	if err != nil {
+		return nil, errors.Wrap(err, "querying uncategorized associations")
+	}
+	defer rows.Close()
+	var descriptions []string
+	for rows.Next() {
+		var d string
+		err := rows.Scan(&d)
+		if err != nil {
+			return nil, errors.Wrap(err, "scanning association row")
+		}
+		descriptions = append(descriptions, d)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, errors.Wrap(err, "reading association rows")
+	}
+	return descriptions, nil
+}
@@ -0,0 +1,202 @@
+package annotations
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/lib/pq"
+	"github.com/pkg/errors"
+	"github.com/vickiniu/project-red-string/airtable"
+)
+
+// Export writes the individuals and categories in the database as
+// JSON arrays of records that FileSource reads with DefaultFieldMap,
+// so a database can be rebuilt from them without Airtable. Records
+// keep their Airtable record ID; those created through the API are
+// keyed on their ID instead.
+func Export(ctx context.Context, db *sql.DB, master, categories io.Writer) error {
+	individuals, err := exportIndividuals(ctx, db)
+	if err != nil {
+		return err
+	}
+	err = writeRecords(master, individuals)
+	if err != nil {
+		return errors.Wrap(err, "writing individuals")
+	}
+	cats, err := exportCategories(ctx, db)
+	if err != nil {
+		return err
+	}
+	return errors.Wrap(writeRecords(categories, cats), "writing categories")
+}
+
+func exportIndividuals(ctx context.Context, db *sql.DB) ([]airtable.Record, error) {
+	const q = `
+		SELECT
+			i.id,
+			COALESCE(i.airtable_id, i.id),
+			i.first_name,
+			i.last_name,
+			COALESCE(i.role, ''),
+			COALESCE(i.title, ''),
+			COALESCE(i.twitter, ''),
+			COALESCE(i.zip, ''),
+			COALESCE(i.notes, ''),
+			COALESCE(i.source_urls, '{}'),
+			(
+				SELECT start_date
+				FROM individual_roles
+				WHERE individual_id = i.id AND end_date IS NULL
+				ORDER BY start_date DESC NULLS LAST
+				LIMIT 1
+			)
+		FROM individuals i
+		ORDER BY i.last_name, i.first_name, i.id
+	`
+	rows, err := db.QueryContext(ctx, q)
+	if err != nil {
+		return nil, errors.Wrap(err, "querying individuals")
+	}
+	defer rows.Close()
+	var (
+		records []airtable.Record
+		ids     []string
+	)
+	for rows.Next() {
+		var (
+			id, recordID                                  string
+			first, last, role, title, twitter, zip, notes string
+			sources                                       pq.StringArray
+			roleStart                                     *time.Time
+		)
+		err := rows.Scan(&id, &recordID, &first, &last, &role, &title, &twitter, &zip, &notes, &sources, &roleStart)
+		if err != nil {
+			return nil, errors.Wrap(err, "scanning individual row")
+		}
+		fields := map[string]interface{}{
+			"First":        first,
+			"Last":         last,
+			"Associations": []string{},
+			"Sources":      []string(sources),
+		}
+		for name, v := range map[string]string{"Role": role, "Title": title, "Twitter": twitter, "ZIP": zip, "Notes": notes} {
+			if v != "" {
+				fields[name] = v
+			}
+		}
+		if roleStart != nil {
+			fields["Role Start"] = roleStart.Format("2006-01-02")
+		}
+		records = append(records, airtable.Record{ID: recordID, Fields: fields})
+		ids = append(ids, id)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, errors.Wrap(err, "reading individual rows")
+	}
+
+	associations, err := exportAssociations(ctx, db)
+	if err != nil {
+		return nil, err
+	}
+	for i, id := range ids {
+		if a := associations[id]; a != nil {
+			records[i].Fields["Associations"] = a
+		}
+	}
+	return records, nil
+}
+
+// exportAssociations returns each individual's associations, with
+// the years they were held as the sync parses them.
+func exportAssociations(ctx context.Context, db *sql.DB) (map[string][]string, error) {
+	const q = `
+		SELECT ia.individual_id, a.description, ia.start_date, ia.end_date
+		FROM individual_associations ia
+		JOIN associations a ON a.id = ia.association_id
+		ORDER BY a.description
+	`
+	rows, err := db.QueryContext(ctx, q)
+	if err != nil {
+		return nil, errors.Wrap(err, "querying individual associations")
+	}
+	defer rows.Close()
+	res := make(map[string][]string)
+	for rows.Next() {
+		var (
+			individualID, description string
+			start, end                *time.Time
+		)
+		err := rows.Scan(&individualID, &description, &start, &end)
+		if err != nil {
+			return nil, errors.Wrap(err, "scanning individual association row")
+		}
+		res[individualID] = append(res[individualID], formatAssociation(description, start, end))
+	}
+	if err := rows.Err(); err != nil {
+		return nil, errors.Wrap(err, "reading individual association rows")
+	}
+	return res, nil
+}
+
+// formatAssociation is the inverse of parseAssociation.
+func formatAssociation(description string, start, end *time.Time) string {
+	switch {
+	case start == nil:
+		return description
+	case end == nil:
+		return fmt.Sprintf("%s (%d-present)", description, start.Year())
+	default:
+		return fmt.Sprintf("%s (%d-%d)", description, start.Year(), end.Year())
+	}
+}
+
+func exportCategories(ctx context.Context, db *sql.DB) ([]airtable.Record, error) {
+	const q = `
+		SELECT
+			COALESCE(c.airtable_id, c.id),
+			c.description,
+			COALESCE(array_agg(a.description ORDER BY a.description) FILTER (WHERE a.id IS NOT NULL), '{}')
+		FROM categories c
+		LEFT JOIN association_categories ac ON ac.category_id = c.id
+		LEFT JOIN associations a ON a.id = ac.association_id
+		GROUP BY c.id
+		ORDER BY c.description
+	`
+	rows, err := db.QueryContext(ctx, q)
+	if err != nil {
+		return nil, errors.Wrap(err, "querying categories")
+	}
+	defer rows.Close()
+	var records []airtable.Record
+	for rows.Next() {
+		var (
+			recordID, name string
+			associations   pq.StringArray
+		)
+		err := rows.Scan(&recordID, &name, &associations)
+		if err != nil {
+			return nil, errors.Wrap(err, "scanning category row")
+		}
+		records = append(records, airtable.Record{ID: recordID, Fields: map[string]interface{}{
+			categoryNameField:         name,
+			categoryAssociationsField: []string(associations),
+		}})
+	}
+	if err := rows.Err(); err != nil {
+		return nil, errors.Wrap(err, "reading category rows")
+	}
+	return records, nil
+}
+
+func writeRecords(w io.Writer, records []airtable.Record) error {
+	if records == nil {
+		records = []airtable.Record{}
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(records)
+}
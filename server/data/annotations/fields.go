@@ -0,0 +1,299 @@
+package annotations
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Special mapping targets that aren't individuals columns.
+const (
+	targetAssociations = "associations"
+	targetSources      = "sources"
+	// targetAddedBy is who added the record, recorded as its
+	// provenance.
+	targetAddedBy = "added_by"
+	// targetRoleStart is when the individual's current role began.
+	targetRoleStart = "role_start"
+)
+
+// FieldMap maps Airtable field names to the individuals column
+// (or special target) they're synced into.
+type FieldMap map[string]string
+
+// DefaultFieldMap is used when no field map file is configured.
+var DefaultFieldMap = FieldMap{
+	"First":        "first_name",
+	"Last":         "last_name",
+	"Role":         "role",
+	"Title":        "title",
+	"Twitter":      "twitter",
+	"ZIP":          "zip",
+	"Notes":        "notes",
+	"Associations": targetAssociations,
+	"Sources":      targetSources,
+	"Added By":     targetAddedBy,
+	"Role Start":   targetRoleStart,
+}
+
+var specialTargets = map[string]bool{
+	targetAssociations: true,
+	targetSources:      true,
+	targetAddedBy:      true,
+	targetRoleStart:    true,
+}
+
+// managedColumns are individuals columns maintained by the sync
+// itself, which can't be mapped to from Airtable.
+var managedColumns = map[string]bool{
+	"id":          true,
+	"cfb_name":    true,
+	"updated_ts":  true,
+	"airtable_id": true,
+	"source_urls": true,
+	"source_id":   true,
+}
+
+// LoadFieldMap reads a JSON object of Airtable field name to
+// column name from path. An empty path returns DefaultFieldMap.
+func LoadFieldMap(path string) (FieldMap, error) {
+	if path == "" {
+		return DefaultFieldMap, nil
+	}
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "reading field map")
+	}
+	var m FieldMap
+	err = json.Unmarshal(b, &m)
+	if err != nil {
+		return nil, errors.Wrap(err, "unmarshaling field map")
+	}
+	return m, nil
+}
+
+// validate checks that every target in the field map is a
+// special target or an existing, unmanaged individuals column, and
+// that names are mapped.
+func (m FieldMap) validate(ctx context.Context, db *sql.DB) error {
+	const q = `
+		SELECT column_name
+		FROM information_schema.columns
+		WHERE table_schema = current_schema() AND table_name = 'individuals'
+	`
+	rows, err := db.QueryContext(ctx, q)
+	if err != nil {
+		return errors.Wrap(err, "querying individuals columns")
+	}
+	defer rows.Close()
+	columns := make(map[string]bool)
+	for rows.Next() {
+		var c string
+		err := rows.Scan(&c)
+		if err != nil {
+			return errors.Wrap(err, "scanning column row")
+		}
+		columns[c] = true
+	}
+	if err := rows.Err(); err != nil {
+		return errors.Wrap(err, "reading column rows")
+	}
+
+	targets := make(map[string]bool)
+	for field, target := range m {
+		switch {
+		case specialTargets[target]:
+		case managedColumns[target]:
+			return fmt.Errorf("field %q: column %q is managed by the sync", field, target)
+		case !columns[target]:
+			return fmt.Errorf("field %q: individuals has no column %q", field, target)
+		}
+		if targets[target] {
+			return fmt.Errorf("field %q: %q is mapped more than once", field, target)
+		}
+		targets[target] = true
+	}
+	if !targets["first_name"] || !targets["last_name"] {
+		return errors.New("field map must map first_name and last_name")
+	}
+	return nil
+}
+
+// annotation is an Airtable record's fields after mapping.
+type annotation struct {
+	FirstName    string
+	LastName     string
+	Associations []datedAssociation
+	Sources      []string
+	AddedBy      string
+	RoleStart    *time.Time
+	// Columns holds the value of every mapped individuals
+	// column, including first_name and last_name.
+	Columns map[string]string
+}
+
+// columnNames returns the mapped column names in a stable order.
+func (a annotation) columnNames() []string {
+	var names []string
+	for c := range a.Columns {
+		names = append(names, c)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// annotation maps raw Airtable record fields to an annotation.
+// Fields missing from the record map to empty values, so clearing
+// a field in Airtable clears the column. Unparseable dates are
+// ignored.
+func (m FieldMap) annotation(fields map[string]interface{}) annotation {
+	a := annotation{Columns: make(map[string]string)}
+	for field, target := range m {
+		v := fields[field]
+		switch target {
+		case targetAssociations:
+			for _, desc := range fieldList(v, splitAssociations) {
+				a.Associations = append(a.Associations, parseAssociation(desc))
+			}
+		case targetSources:
+			a.Sources = fieldList(v, strings.Fields)
+		case targetAddedBy:
+			a.AddedBy = strings.TrimSpace(fieldString(v))
+		case targetRoleStart:
+			a.RoleStart = parseDate(strings.TrimSpace(fieldString(v)))
+		default:
+			a.Columns[target] = strings.TrimSpace(fieldString(v))
+		}
+	}
+	a.FirstName = a.Columns["first_name"]
+	a.LastName = a.Columns["last_name"]
+	return a
+}
+
+// fieldString formats a single Airtable field value as a string.
+func fieldString(v interface{}) string {
+	switch v := v.(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	case bool:
+		return strconv.FormatBool(v)
+	case map[string]interface{}:
+		// Attachments and collaborators
+		for _, k := range []string{"url", "name", "email"} {
+			if s, ok := v[k].(string); ok {
+				return s
+			}
+		}
+		return ""
+	case []interface{}:
+		var parts []string
+		for _, e := range v {
+			if s := fieldString(e); s != "" {
+				parts = append(parts, s)
+			}
+		}
+		return strings.Join(parts, ", ")
+	default:
+		return fmt.Sprint(v)
+	}
+}
+
+// splitAssociations splits a text field of comma separated
+// associations.
+func splitAssociations(s string) []string {
+	return strings.Split(s, ",")
+}
+
+// fieldList formats a multi-valued Airtable field as a list. Text
+// fields are split into values with split.
+func fieldList(v interface{}, split func(string) []string) []string {
+	var raw []string
+	switch v := v.(type) {
+	case nil:
+	case []interface{}:
+		for _, e := range v {
+			raw = append(raw, fieldString(e))
+		}
+	case string:
+		raw = split(v)
+	default:
+		raw = []string{fieldString(v)}
+	}
+	var list []string
+	for _, s := range raw {
+		if s = strings.TrimSpace(s); s != "" {
+			list = append(list, s)
+		}
+	}
+	return list
+}
+
+// datedAssociation is an association along with when the individual
+// held it, if known.
+type datedAssociation struct {
+	Description string
+	Start, End  *time.Time
+}
+
+// associationDates matches a trailing year range on an association,
+// e.g. "Community Board 3 (2015-2019)" or "DSA (2018-present)".
+var associationDates = regexp.MustCompile(`^(.*?)\s*\((\d{4})\s*[-–—]\s*(\d{4}|present)?\s*\)$`)
+
+// parseAssociation splits a year range off an association. Ranges
+// cover the whole of their start and end years.
+func parseAssociation(s string) datedAssociation {
+	m := associationDates.FindStringSubmatch(s)
+	if m == nil {
+		return datedAssociation{Description: s}
+	}
+	a := datedAssociation{Description: m[1]}
+	start, _ := strconv.Atoi(m[2])
+	a.Start = date(start, time.January, 1)
+	if end, err := strconv.Atoi(m[3]); err == nil {
+		a.End = date(end, time.December, 31)
+	}
+	return a
+}
+
+// parseDate parses dates as formatted by Airtable, or bare years.
+func parseDate(s string) *time.Time {
+	for _, layout := range []string{"2006-01-02", "1/2/2006", "2006"} {
+		if t, err := time.Parse(layout, s); err == nil {
+			return &t
+		}
+	}
+	return nil
+}
+
+func date(year int, month time.Month, day int) *time.Time {
+	t := time.Date(year, month, day, 0, 0, 0, 0, time.UTC)
+	return &t
+}
+
+// nullDate converts a scanned date column.
+func nullDate(t sql.NullTime) *time.Time {
+	if !t.Valid {
+		return nil
+	}
+	return date(t.Time.Year(), t.Time.Month(), t.Time.Day())
+}
+
+func equalDates(a, b *time.Time) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return a.Equal(*b)
+}
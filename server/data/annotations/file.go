@@ -0,0 +1,206 @@
+package annotations
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/vickiniu/project-red-string/airtable"
+	"gopkg.in/yaml.v2"
+)
+
+// csvIDColumns are the header names recognized as holding the
+// Airtable record ID in a CSV export.
+var csvIDColumns = []string{"Record ID", "Airtable ID", "id"}
+
+// FileSource reads annotation tables from files exported from
+// Airtable instead of the API. Each table is read from a path:
+//
+//   - a .csv file with a header row of field names and a record ID
+//     column (see csvIDColumns)
+//   - a .json file holding either an Airtable list records response
+//     or an array of records
+//   - a directory of .yaml files, one record per file, with the
+//     record's fields under "fields". The record ID defaults to the
+//     file name without its extension.
+type FileSource struct {
+	Paths map[string]string // table name : path
+}
+
+// ForEachRecord implements RecordSource.
+func (f FileSource) ForEachRecord(ctx context.Context, table string, fn func(r airtable.Record) error) error {
+	path, ok := f.Paths[table]
+	if !ok {
+		return fmt.Errorf("no file given for table %q", table)
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return errors.Wrapf(err, "reading %s", table)
+	}
+	var records []airtable.Record
+	switch ext := strings.ToLower(filepath.Ext(path)); {
+	case info.IsDir():
+		records, err = readYAMLDir(path)
+	case ext == ".csv":
+		records, err = readCSV(path)
+	case ext == ".json":
+		records, err = readJSON(path)
+	default:
+		return fmt.Errorf("%s: unknown file type %q", path, ext)
+	}
+	if err != nil {
+		return errors.Wrapf(err, "reading %s from %s", table, path)
+	}
+	for _, r := range records {
+		err := fn(r)
+		if err != nil {
+			return errors.Wrap(err, "processing record")
+		}
+	}
+	return nil
+}
+
+func readCSV(path string) ([]airtable.Record, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	r := csv.NewReader(f)
+	header, err := r.Read()
+	if err != nil {
+		return nil, errors.Wrap(err, "reading header")
+	}
+	idColumn := -1
+	for _, name := range csvIDColumns {
+		for i, h := range header {
+			if h == name {
+				idColumn = i
+				break
+			}
+		}
+		if idColumn >= 0 {
+			break
+		}
+	}
+	if idColumn < 0 {
+		return nil, fmt.Errorf("no record ID column, expected one of %s", strings.Join(csvIDColumns, ", "))
+	}
+
+	var records []airtable.Record
+	for {
+		row, err := r.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, errors.Wrap(err, "reading row")
+		}
+		rec := airtable.Record{
+			ID:     row[idColumn],
+			Fields: make(map[string]interface{}),
+		}
+		for i, v := range row {
+			if i == idColumn || v == "" {
+				continue
+			}
+			rec.Fields[header[i]] = v
+		}
+		records = append(records, rec)
+	}
+	return records, nil
+}
+
+func readJSON(path string) ([]airtable.Record, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var records []airtable.Record
+	if strings.HasPrefix(strings.TrimSpace(string(b)), "[") {
+		err = json.Unmarshal(b, &records)
+	} else {
+		var page struct {
+			Records []airtable.Record `json:"records"`
+		}
+		err = json.Unmarshal(b, &page)
+		records = page.Records
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "unmarshaling records")
+	}
+	return records, nil
+}
+
+func readYAMLDir(dir string) ([]airtable.Record, error) {
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, info := range infos {
+		ext := filepath.Ext(info.Name())
+		if !info.IsDir() && (ext == ".yaml" || ext == ".yml") {
+			names = append(names, info.Name())
+		}
+	}
+	sort.Strings(names)
+
+	var records []airtable.Record
+	for _, name := range names {
+		b, err := ioutil.ReadFile(filepath.Join(dir, name))
+		if err != nil {
+			return nil, err
+		}
+		var doc struct {
+			ID     string                      `yaml:"id"`
+			Fields map[interface{}]interface{} `yaml:"fields"`
+		}
+		err = yaml.Unmarshal(b, &doc)
+		if err != nil {
+			return nil, errors.Wrapf(err, "unmarshaling %s", name)
+		}
+		rec := airtable.Record{
+			ID:     doc.ID,
+			Fields: make(map[string]interface{}),
+		}
+		if rec.ID == "" {
+			rec.ID = strings.TrimSuffix(name, filepath.Ext(name))
+		}
+		for k, v := range doc.Fields {
+			rec.Fields[fmt.Sprint(k)] = yamlValue(v)
+		}
+		records = append(records, rec)
+	}
+	return records, nil
+}
+
+// yamlValue converts decoded YAML values to the types decoded from
+// Airtable's JSON responses.
+func yamlValue(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[interface{}]interface{}:
+		m := make(map[string]interface{})
+		for k, e := range v {
+			m[fmt.Sprint(k)] = yamlValue(e)
+		}
+		return m
+	case []interface{}:
+		l := make([]interface{}, len(v))
+		for i, e := range v {
+			l[i] = yamlValue(e)
+		}
+		return l
+	case int:
+		return float64(v)
+	}
+	return v
+}
@@ -0,0 +1,148 @@
+package annotations
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/vickiniu/project-red-string/audit"
+	"github.com/vickiniu/project-red-string/internal/sqlutil"
+)
+
+// syncRole keeps the individual's role history up to date. When
+// their role or title changes, their current role is ended and a new
+// one started, on the record's role start date if it has one and
+// otherwise today.
+func (s *syncer) syncRole(ctx context.Context, individualID string, a annotation) error {
+	role, hasRole := a.Columns["role"]
+	title, hasTitle := a.Columns["title"]
+	if !hasRole && !hasTitle {
+		// Roles aren't synced
+		return nil
+	}
+
+	const currentQ = `
+		SELECT id, COALESCE(role, ''), COALESCE(title, ''), start_date
+		FROM individual_roles
+		WHERE individual_id = $1 AND end_date IS NULL
+		ORDER BY start_date DESC NULLS LAST
+		LIMIT 1
+	`
+	var (
+		roleID, currentRole, currentTitle string
+		start                             sql.NullTime
+		found                             = true
+	)
+	err := s.tx.QueryRowContext(ctx, currentQ, individualID).Scan(&roleID, &currentRole, &currentTitle, &start)
+	if err == sql.ErrNoRows {
+		found = false
+	} else if err != nil {
+		return errors.Wrap(err, "querying current role")
+	}
+	if !hasRole {
+		role = currentRole
+	}
+	if !hasTitle {
+		title = currentTitle
+	}
+	change := func(roleID, field, old, new string) audit.Change {
+		return audit.Change{
+			Entity:       audit.EntityIndividualRole,
+			EntityID:     roleID,
+			IndividualID: individualID,
+			Field:        field,
+			Old:          old,
+			New:          new,
+		}
+	}
+
+	if found && role == currentRole && title == currentTitle {
+		if a.RoleStart == nil || equalDates(nullDate(start), a.RoleStart) {
+			return nil
+		}
+		sourceID, err := s.sourceID(ctx)
+		if err != nil {
+			return err
+		}
+		const updateQ = `
+			UPDATE individual_roles SET
+				start_date = $2,
+				source_id = $3,
+				updated_ts = current_timestamp
+			WHERE id = $1
+		`
+		_, err = s.tx.ExecContext(ctx, updateQ, roleID, a.RoleStart, sourceID)
+		if err != nil {
+			return errors.Wrap(err, "updating role start date")
+		}
+		return s.record(ctx, change(roleID, "start_date", sqlutil.FormatDate(nullDate(start)), sqlutil.FormatDate(a.RoleStart)))
+	}
+	if !found && role == "" && title == "" {
+		return nil
+	}
+
+	sourceID, err := s.sourceID(ctx)
+	if err != nil {
+		return err
+	}
+	changed := a.RoleStart
+	if changed == nil {
+		now := time.Now()
+		changed = date(now.Year(), now.Month(), now.Day())
+	}
+	if found {
+		const endQ = `
+			UPDATE individual_roles SET
+				end_date = $2,
+				updated_ts = current_timestamp
+			WHERE id = $1
+		`
+		_, err := s.tx.ExecContext(ctx, endQ, roleID, changed)
+		if err != nil {
+			return errors.Wrap(err, "ending role")
+		}
+		s.stats.RolesEnded++
+		err = s.record(ctx, change(roleID, "end_date", "", sqlutil.FormatDate(changed)))
+		if err != nil {
+			return err
+		}
+	}
+	if role == "" && title == "" {
+		return nil
+	}
+	// The first role we see for someone may have started long
+	// before, so only assume it started today if it replaced one.
+	startDate := a.RoleStart
+	if found {
+		startDate = changed
+	}
+	const insertQ = `
+		INSERT INTO individual_roles (
+			individual_id,
+			role,
+			title,
+			start_date,
+			source_id,
+			updated_ts
+		) VALUES (
+			$1,
+			$2,
+			$3,
+			$4,
+			$5,
+			current_timestamp
+		) RETURNING id
+	`
+	var newID string
+	err = s.tx.QueryRowContext(ctx, insertQ, individualID, columnValue(role), columnValue(title), startDate, sourceID).Scan(&newID)
+	if err != nil {
+		return errors.Wrap(err, "inserting role")
+	}
+	s.stats.RolesStarted++
+	return s.record(ctx,
+		change(newID, "role", "", role),
+		change(newID, "title", "", title),
+		change(newID, "start_date", "", sqlutil.FormatDate(startDate)),
+	)
+}
@@ -0,0 +1,634 @@
+// Package annotations syncs the annotations table, from Airtable or
+// files exported from it, into the database.
+package annotations
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/lib/pq"
+	"github.com/pkg/errors"
+	"github.com/vickiniu/project-red-string/airtable"
+	"github.com/vickiniu/project-red-string/audit"
+	"github.com/vickiniu/project-red-string/dataversion"
+	"github.com/vickiniu/project-red-string/internal/sqlutil"
+	"github.com/vickiniu/project-red-string/logging"
+	"github.com/vickiniu/project-red-string/provenance"
+)
+
+// Stats summarizes the changes applied by a sync run.
+type Stats struct {
+	IndividualsCreated   int
+	IndividualsUpdated   int
+	IndividualsUnchanged int
+	// IndividualsMatchedByName counts the records matched to an
+	// individual by name because no individual had their Airtable
+	// ID yet. They're included in IndividualsUpdated.
+	IndividualsMatchedByName int
+	// IndividualsRemoved counts individuals whose Airtable record
+	// no longer exists. Their associations are removed, but the
+	// individual is kept since contributions may reference it.
+	IndividualsRemoved  int
+	RecordsSkipped      int
+	AssociationsCreated int
+	LinksAdded          int
+	LinksUpdated        int
+	LinksRemoved        int
+	RolesStarted        int
+	RolesEnded          int
+
+	CategoriesCreated    int
+	CategoriesUpdated    int
+	CategoriesRemoved    int
+	CategoryLinksAdded   int
+	CategoryLinksRemoved int
+	// UnknownAssociations counts associations named by a
+	// category that no individual has.
+	UnknownAssociations int
+	// Uncategorized are the descriptions of associations in no
+	// category after the sync.
+	Uncategorized []string
+
+	// NewIndividuals are the names of the individuals created, whose
+	// records matched no individual, and NewAssociations the
+	// descriptions of the associations created.
+	NewIndividuals  []string
+	NewAssociations []string
+}
+
+// MatchRate returns the fraction of the records synced that matched
+// an individual already in the database, or 0 if none were synced.
+func (s Stats) MatchRate() float64 {
+	synced := s.IndividualsCreated + s.IndividualsUpdated + s.IndividualsUnchanged
+	if synced == 0 {
+		return 0
+	}
+	return float64(synced-s.IndividualsCreated) / float64(synced)
+}
+
+// Print writes a report of the stats to w.
+func (s Stats) Print(w io.Writer) {
+	fmt.Fprintf(w, "individuals: %d created, %d updated, %d unchanged, %d removed from Airtable, %d records skipped\n",
+		s.IndividualsCreated, s.IndividualsUpdated, s.IndividualsUnchanged, s.IndividualsRemoved, s.RecordsSkipped)
+	fmt.Fprintf(w, "matched: %.1f%% of records to existing individuals, %d by name\n",
+		100*s.MatchRate(), s.IndividualsMatchedByName)
+	fmt.Fprintf(w, "associations: %d created\n", s.AssociationsCreated)
+	fmt.Fprintf(w, "individual associations: %d added, %d updated, %d removed\n",
+		s.LinksAdded, s.LinksUpdated, s.LinksRemoved)
+	fmt.Fprintf(w, "roles: %d started, %d ended\n", s.RolesStarted, s.RolesEnded)
+	fmt.Fprintf(w, "categories: %d created, %d updated, %d removed\n",
+		s.CategoriesCreated, s.CategoriesUpdated, s.CategoriesRemoved)
+	fmt.Fprintf(w, "association categories: %d added, %d removed, %d unknown associations\n",
+		s.CategoryLinksAdded, s.CategoryLinksRemoved, s.UnknownAssociations)
+	for _, n := range s.NewIndividuals {
+		fmt.Fprintf(w, "  new individual: %s\n", n)
+	}
+	for _, d := range s.NewAssociations {
+		fmt.Fprintf(w, "  new association: %s\n", d)
+	}
+	fmt.Fprintf(w, "%d uncategorized associations\n", len(s.Uncategorized))
+	for _, d := range s.Uncategorized {
+		fmt.Fprintf(w, "  uncategorized: %s\n", d)
+	}
+}
+
+// RecordSource reads the records of an annotations table.
+// *airtable.Client is a RecordSource.
+type RecordSource interface {
+	ForEachRecord(ctx context.Context, table string, fn func(r airtable.Record) error) error
+}
+
+// SyncConfig configures which Airtable tables are synced and how
+// their fields are mapped.
+type SyncConfig struct {
+	MasterTable string
+	// CategoriesTable may be empty to skip syncing categories
+	CategoriesTable string
+	Fields          FieldMap
+	// Source is the provenance shared by every synced record, e.g.
+	// its type and the file imported
+	Source provenance.Source
+	// DryRun rolls the sync back once it's done, so the stats report
+	// what it would change
+	DryRun bool
+}
+
+// syncer applies annotation records to the database within a
+// single transaction, keyed on the Airtable record ID.
+type syncer struct {
+	tx    *sql.Tx
+	cfg   SyncConfig
+	seen  pq.StringArray // Airtable record IDs processed this run
+	stats Stats
+	run   *audit.Run
+
+	// source is the provenance of the record being synced. Its
+	// row is inserted into sources the first time a change from
+	// the record is applied.
+	source    provenance.Source
+	sourceRow string
+}
+
+// Sync makes the database reflect the current set of Airtable
+// records: new records are inserted, changed records are updated, and
+// associations no longer present in Airtable are removed. Categories
+// are then synced the same way. Nothing is committed unless the whole
+// sync succeeds, or at all if cfg.DryRun is set.
+func Sync(ctx context.Context, db *sql.DB, src RecordSource, cfg SyncConfig) (Stats, error) {
+	err := cfg.Fields.validate(ctx, db)
+	if err != nil {
+		return Stats{}, errors.Wrap(err, "validating field map")
+	}
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return Stats{}, errors.Wrap(err, "beginning transaction")
+	}
+	defer tx.Rollback()
+
+	run, err := audit.StartRun(ctx, tx, "sync annotations")
+	if err != nil {
+		return Stats{}, err
+	}
+	s := &syncer{tx: tx, cfg: cfg, run: run}
+	err = src.ForEachRecord(ctx, cfg.MasterTable, func(r airtable.Record) error {
+		return s.insertAnnotation(ctx, r.ID, cfg.Fields.annotation(r.Fields))
+	})
+	if err != nil {
+		return Stats{}, err
+	}
+	err = s.removeStale(ctx)
+	if err != nil {
+		return Stats{}, errors.Wrap(err, "removing stale records")
+	}
+	// Categories refer to associations, so sync them last
+	if cfg.CategoriesTable != "" {
+		err = s.syncCategories(ctx, src, cfg.CategoriesTable)
+		if err != nil {
+			return Stats{}, errors.Wrap(err, "syncing categories")
+		}
+	}
+	s.stats.Uncategorized, err = s.uncategorizedAssociations(ctx)
+	if err != nil {
+		return Stats{}, err
+	}
+	if cfg.DryRun {
+		return s.stats, nil
+	}
+	err = dataversion.Bump(ctx, tx)
+	if err != nil {
+		return Stats{}, err
+	}
+	err = tx.Commit()
+	if err != nil {
+		return Stats{}, errors.Wrap(err, "committing sync")
+	}
+	return s.stats, nil
+}
+
+func (s *syncer) insertAnnotation(ctx context.Context, recordID string, a annotation) error {
+	if recordID == "" {
+		return errors.New("record is missing an Airtable ID")
+	}
+	s.seen = append(s.seen, recordID)
+	s.source = s.cfg.Source
+	s.source.AirtableRecordID = recordID
+	if len(a.Sources) > 0 {
+		s.source.URL = a.Sources[0]
+	}
+	if a.AddedBy != "" {
+		s.source.AddedBy = a.AddedBy
+	}
+	s.sourceRow = ""
+	if a.FirstName == "" || a.LastName == "" {
+		// Leave incomplete records as they are until they're
+		// filled in
+		logging.Warn(ctx, "skipping record with no first or last name", "record", recordID)
+		s.stats.RecordsSkipped++
+		return nil
+	}
+
+	// Upsert individual
+	individualID, err := s.upsertIndividual(ctx, recordID, a)
+	if err != nil {
+		return errors.Wrap(err, "upserting individual")
+	}
+
+	// Now, upsert associations
+	associations, err := s.upsertAssociations(ctx, a)
+	if err != nil {
+		return errors.Wrap(err, "upserting associations")
+	}
+
+	// Reconcile individual : association mappings
+	err = s.syncIndividualAssociations(ctx, individualID, associations)
+	if err != nil {
+		return errors.Wrap(err, "syncing individual associations")
+	}
+
+	err = s.syncRole(ctx, individualID, a)
+	if err != nil {
+		return errors.Wrap(err, "syncing role history")
+	}
+	return nil
+}
+
+// upsertIndividual returns the ID of the individual synced from
+// the given Airtable record, creating or updating it as needed.
+// Individuals inserted before records were tracked by Airtable ID
+// are adopted by exact name match.
+func (s *syncer) upsertIndividual(ctx context.Context, recordID string, a annotation) (string, error) {
+	columns := a.columnNames()
+	selectList := "id, source_urls"
+	for _, c := range columns {
+		selectList += ", " + pq.QuoteIdentifier(c) + "::text"
+	}
+	individualQ := `SELECT ` + selectList + ` FROM individuals WHERE airtable_id = $1`
+	legacyQ := `SELECT ` + selectList + ` FROM individuals WHERE first_name = $1 AND last_name = $2 AND airtable_id IS NULL`
+
+	var (
+		individualID    string
+		sources         pq.StringArray
+		current         = make([]sql.NullString, len(columns))
+		hasAirtableID   = true
+		individualFound = true
+	)
+	dest := []interface{}{&individualID, &sources}
+	for i := range current {
+		dest = append(dest, &current[i])
+	}
+	err := s.tx.QueryRowContext(ctx, individualQ, recordID).Scan(dest...)
+	if err == sql.ErrNoRows {
+		hasAirtableID = false
+		err = s.tx.QueryRowContext(ctx, legacyQ, a.FirstName, a.LastName).Scan(dest...)
+		if err == sql.ErrNoRows {
+			individualFound = false
+		} else if err != nil {
+			return "", errors.Wrap(err, "querying individual by name")
+		}
+	} else if err != nil {
+		return "", errors.Wrap(err, "querying individual by Airtable ID")
+	}
+
+	if individualFound && hasAirtableID && equalStrings(sources, a.Sources) {
+		unchanged := true
+		for i, c := range columns {
+			if current[i].String != a.Columns[c] {
+				unchanged = false
+				break
+			}
+		}
+		if unchanged {
+			s.stats.IndividualsUnchanged++
+			return individualID, nil
+		}
+	}
+
+	sourceID, err := s.sourceID(ctx)
+	if err != nil {
+		return "", err
+	}
+	// Arguments shared by the insert and update: mapped columns,
+	// then the columns maintained by the sync.
+	var (
+		names = append([]string(nil), columns...)
+		args  []interface{}
+	)
+	for _, c := range columns {
+		args = append(args, columnValue(a.Columns[c]))
+	}
+	names = append(names, "cfb_name", "source_urls", "airtable_id", "source_id")
+	args = append(args, sqlutil.CFBName(a.FirstName, a.LastName), pq.StringArray(a.Sources), recordID, sourceID)
+
+	if !individualFound {
+		var cols, params []string
+		for i, c := range names {
+			cols = append(cols, pq.QuoteIdentifier(c))
+			params = append(params, "$"+strconv.Itoa(i+1))
+		}
+		insertQ := `
+			INSERT INTO individuals (
+				` + strings.Join(cols, ", ") + `,
+				updated_ts
+			) VALUES (
+				` + strings.Join(params, ", ") + `,
+				current_timestamp
+			) RETURNING id
+		`
+		err := s.tx.QueryRowContext(ctx, insertQ, args...).Scan(&individualID)
+		if err != nil {
+			return "", errors.Wrap(err, "inserting individual")
+		}
+		s.stats.IndividualsCreated++
+		s.stats.NewIndividuals = append(s.stats.NewIndividuals, a.FirstName+" "+a.LastName)
+		return individualID, s.recordIndividual(ctx, individualID, recordID, a, current, sources, hasAirtableID)
+	}
+
+	var sets []string
+	for i, c := range names {
+		sets = append(sets, pq.QuoteIdentifier(c)+" = $"+strconv.Itoa(i+2))
+	}
+	updateQ := `
+		UPDATE individuals SET
+			` + strings.Join(sets, ", ") + `,
+			updated_ts = current_timestamp
+		WHERE id = $1
+	`
+	_, err = s.tx.ExecContext(ctx, updateQ, append([]interface{}{individualID}, args...)...)
+	if err != nil {
+		return "", errors.Wrap(err, "updating individual")
+	}
+	s.stats.IndividualsUpdated++
+	if !hasAirtableID {
+		s.stats.IndividualsMatchedByName++
+	}
+	return individualID, s.recordIndividual(ctx, individualID, recordID, a, current, sources, hasAirtableID)
+}
+
+// recordIndividual logs the changes to an individual's fields from
+// their current values, which are empty for new individuals.
+func (s *syncer) recordIndividual(ctx context.Context, individualID, recordID string, a annotation, current []sql.NullString, sources []string, hasAirtableID bool) error {
+	change := func(field, old, new string) audit.Change {
+		return audit.Change{
+			Entity:       audit.EntityIndividual,
+			EntityID:     individualID,
+			IndividualID: individualID,
+			Field:        field,
+			Old:          old,
+			New:          new,
+		}
+	}
+	var changes []audit.Change
+	for i, c := range a.columnNames() {
+		changes = append(changes, change(c, current[i].String, a.Columns[c]))
+	}
+	changes = append(changes, change("source_urls", strings.Join(sources, "\n"), strings.Join(a.Sources, "\n")))
+	if !hasAirtableID {
+		changes = append(changes, change("airtable_id", "", recordID))
+	}
+	return s.record(ctx, changes...)
+}
+
+// sourceID returns the ID of the current record's source, inserting
+// it if needed. Records that don't change anything don't add sources.
+func (s *syncer) sourceID(ctx context.Context) (string, error) {
+	if s.sourceRow != "" {
+		return s.sourceRow, nil
+	}
+	id, err := provenance.Insert(ctx, s.tx, s.source)
+	if err != nil {
+		return "", errors.Wrap(err, "recording source")
+	}
+	s.sourceRow = id
+	return id, nil
+}
+
+// record logs changes taken from the current record.
+func (s *syncer) record(ctx context.Context, changes ...audit.Change) error {
+	sourceID, err := s.sourceID(ctx)
+	if err != nil {
+		return err
+	}
+	err = s.run.Record(ctx, s.tx, sourceID, changes...)
+	return errors.Wrap(err, "recording changes")
+}
+
+// columnValue stores empty Airtable values as NULL.
+func columnValue(s string) interface{} {
+	if s == "" {
+		return nil
+	}
+	return s
+}
+
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// upsertAssociations returns the individual's associations keyed on
+// association ID, creating associations as needed.
+func (s *syncer) upsertAssociations(ctx context.Context, a annotation) (map[string]datedAssociation, error) {
+	associations := make(map[string]datedAssociation)
+	for _, assoc := range a.Associations {
+		const associationQ = `SELECT id FROM associations WHERE description = $1`
+		var aid string
+		err := s.tx.QueryRowContext(ctx, associationQ, assoc.Description).Scan(&aid)
+		if err == sql.ErrNoRows {
+			sourceID, err := s.sourceID(ctx)
+			if err != nil {
+				return nil, err
+			}
+			const insertQ = `
+				INSERT INTO associations (
+					description,
+					source_id
+				) VALUES (
+					$1,
+					$2
+				) RETURNING id
+			`
+			err = s.tx.QueryRowContext(ctx, insertQ, assoc.Description, sourceID).Scan(&aid)
+			if err != nil {
+				return nil, errors.Wrap(err, "inserting association")
+			}
+			s.stats.AssociationsCreated++
+			s.stats.NewAssociations = append(s.stats.NewAssociations, assoc.Description)
+			err = s.record(ctx, audit.Change{
+				Entity:   audit.EntityAssociation,
+				EntityID: aid,
+				Field:    "description",
+				New:      assoc.Description,
+			})
+			if err != nil {
+				return nil, err
+			}
+		} else if err != nil {
+			return nil, errors.Wrap(err, "querying association")
+		}
+		associations[aid] = assoc
+	}
+	return associations, nil
+}
+
+// syncIndividualAssociations makes the individual's associations
+// and their dates exactly want, keyed on association ID.
+func (s *syncer) syncIndividualAssociations(ctx context.Context, individualID string, want map[string]datedAssociation) error {
+	const existingQ = `
+		SELECT association_id, associations.description, start_date, end_date
+		FROM individual_associations
+		JOIN associations
+		ON individual_associations.association_id = associations.id
+		WHERE individual_id = $1
+	`
+	rows, err := s.tx.QueryContext(ctx, existingQ, individualID)
+	if err != nil {
+		return errors.Wrap(err, "querying existing individual associations")
+	}
+	defer rows.Close()
+	existing := make(map[string]datedAssociation)
+	for rows.Next() {
+		var (
+			aid, desc  string
+			start, end sql.NullTime
+		)
+		err := rows.Scan(&aid, &desc, &start, &end)
+		if err != nil {
+			return errors.Wrap(err, "scanning individual association row")
+		}
+		existing[aid] = datedAssociation{Description: desc, Start: nullDate(start), End: nullDate(end)}
+	}
+	if err := rows.Err(); err != nil {
+		return errors.Wrap(err, "reading individual association rows")
+	}
+	change := func(aid, field, old, new string) audit.Change {
+		return audit.Change{
+			Entity:       audit.EntityIndividualAssociation,
+			EntityID:     aid,
+			IndividualID: individualID,
+			Field:        field,
+			Old:          old,
+			New:          new,
+		}
+	}
+
+	for aid, current := range existing {
+		if _, ok := want[aid]; ok {
+			continue
+		}
+		const deleteQ = `DELETE FROM individual_associations WHERE individual_id = $1 AND association_id = $2`
+		_, err := s.tx.ExecContext(ctx, deleteQ, individualID, aid)
+		if err != nil {
+			return errors.Wrap(err, "deleting individual association")
+		}
+		s.stats.LinksRemoved++
+		err = s.record(ctx,
+			change(aid, "association", current.Description, ""),
+			change(aid, "start_date", sqlutil.FormatDate(current.Start), ""),
+			change(aid, "end_date", sqlutil.FormatDate(current.End), ""),
+		)
+		if err != nil {
+			return err
+		}
+	}
+	for aid, a := range want {
+		current, ok := existing[aid]
+		if ok && equalDates(current.Start, a.Start) && equalDates(current.End, a.End) {
+			continue
+		}
+		sourceID, err := s.sourceID(ctx)
+		if err != nil {
+			return err
+		}
+		changes := []audit.Change{
+			change(aid, "start_date", sqlutil.FormatDate(current.Start), sqlutil.FormatDate(a.Start)),
+			change(aid, "end_date", sqlutil.FormatDate(current.End), sqlutil.FormatDate(a.End)),
+		}
+		if ok {
+			const updateQ = `
+				UPDATE individual_associations SET
+					start_date = $3,
+					end_date = $4,
+					source_id = $5,
+					updated_ts = current_timestamp
+				WHERE individual_id = $1 AND association_id = $2
+			`
+			_, err = s.tx.ExecContext(ctx, updateQ, individualID, aid, a.Start, a.End, sourceID)
+			if err != nil {
+				return errors.Wrap(err, "updating individual association")
+			}
+			s.stats.LinksUpdated++
+			err = s.record(ctx, changes...)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+		const insertQ = `
+			INSERT INTO individual_associations (
+				individual_id,
+				association_id,
+				start_date,
+				end_date,
+				source_id,
+				updated_ts
+			) VALUES (
+				$1,
+				$2,
+				$3,
+				$4,
+				$5,
+				current_timestamp
+			)
+		`
+		_, err = s.tx.ExecContext(ctx, insertQ, individualID, aid, a.Start, a.End, sourceID)
+		if err != nil {
+			return errors.Wrap(err, "inserting individual association")
+		}
+		s.stats.LinksAdded++
+		err = s.record(ctx, append(changes, change(aid, "association", "", a.Description))...)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// removeStale removes the associations of individuals whose
+// Airtable record was not seen during this run.
+func (s *syncer) removeStale(ctx context.Context) error {
+	if len(s.seen) == 0 {
+		// Guard against wiping every association if Airtable
+		// unexpectedly returns no records.
+		logging.Warn(ctx, "no records synced, skipping removal of stale records")
+		return nil
+	}
+	const staleQ = `
+		SELECT id, airtable_id
+		FROM individuals
+		WHERE airtable_id IS NOT NULL AND NOT (airtable_id = ANY($1::text[]))
+	`
+	rows, err := s.tx.QueryContext(ctx, staleQ, s.seen)
+	if err != nil {
+		return errors.Wrap(err, "querying stale individuals")
+	}
+	defer rows.Close()
+	stale := make(map[string]string) // individual ID : Airtable ID
+	for rows.Next() {
+		var id, recordID string
+		err := rows.Scan(&id, &recordID)
+		if err != nil {
+			return errors.Wrap(err, "scanning stale individual row")
+		}
+		stale[id] = recordID
+	}
+	if err := rows.Err(); err != nil {
+		return errors.Wrap(err, "reading stale individual rows")
+	}
+
+	for id, recordID := range stale {
+		s.source = s.cfg.Source
+		s.source.AirtableRecordID = recordID
+		s.source.Note = "record deleted"
+		s.sourceRow = ""
+		removed := s.stats.LinksRemoved
+		err := s.syncIndividualAssociations(ctx, id, nil)
+		if err != nil {
+			return errors.Wrapf(err, "removing associations for individual %s", id)
+		}
+		if s.stats.LinksRemoved > removed {
+			s.stats.IndividualsRemoved++
+		}
+	}
+	return nil
+}
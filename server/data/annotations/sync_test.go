@@ -0,0 +1,229 @@
+package annotations
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"reflect"
+	"testing"
+
+	"github.com/vickiniu/project-red-string/airtable"
+	"github.com/vickiniu/project-red-string/airtable/airtabletest"
+	"github.com/vickiniu/project-red-string/internal/testdb"
+	"github.com/vickiniu/project-red-string/logging"
+	"github.com/vickiniu/project-red-string/provenance"
+)
+
+func TestMain(m *testing.M) {
+	logging.Default = logging.New(ioutil.Discard, logging.LevelError)
+	os.Exit(testdb.Run(m))
+}
+
+func TestSyncAnnotations(t *testing.T) {
+	db, cleanup := testdb.New(t)
+	defer cleanup()
+	ctx := context.Background()
+
+	master := testdb.Path("annotations_master.csv")
+	src := FileSource{Paths: map[string]string{
+		"Master List": master,
+		"Categories":  testdb.Path("annotations_categories.csv"),
+	}}
+	cfg := SyncConfig{
+		MasterTable:     "Master List",
+		CategoriesTable: "Categories",
+		Fields:          DefaultFieldMap,
+		Source:          provenance.Source{Type: provenance.TypeFile, File: master},
+	}
+
+	stats, err := Sync(ctx, db, src, cfg)
+	if err != nil {
+		t.Fatalf("syncing: %v", err)
+	}
+	if stats.IndividualsCreated != 2 || stats.AssociationsCreated != 2 || stats.LinksAdded != 3 ||
+		stats.CategoriesCreated != 1 || stats.CategoryLinksAdded != 1 {
+		t.Errorf("got stats %+v, want 2 individuals, 2 associations, 3 links, 1 category and 1 category link", stats)
+	}
+	if len(stats.Uncategorized) != 1 || stats.Uncategorized[0] != "Parks Conservancy" {
+		t.Errorf("got uncategorized %v, want Parks Conservancy", stats.Uncategorized)
+	}
+
+	var cfbName, start, end string
+	err = db.QueryRow(`
+		SELECT i.cfb_name, ia.start_date::text, ia.end_date::text
+		FROM individuals i
+		JOIN individual_associations ia ON ia.individual_id = i.id
+		JOIN associations a ON a.id = ia.association_id
+		WHERE i.airtable_id = 'recAlice' AND a.description = 'Community Board 1'
+	`).Scan(&cfbName, &start, &end)
+	if err != nil {
+		t.Fatalf("reading Alice's community board: %v", err)
+	}
+	if cfbName != "Adams, Alice" || start != "2015-01-01" || end != "2019-12-31" {
+		t.Errorf("got %s on the board from %s to %s, want Adams, Alice from 2015-01-01 to 2019-12-31", cfbName, start, end)
+	}
+
+	// Syncing the same records again changes nothing
+	stats, err = Sync(ctx, db, src, cfg)
+	if err != nil {
+		t.Fatalf("syncing again: %v", err)
+	}
+	if stats.IndividualsUnchanged != 2 || stats.IndividualsCreated != 0 || stats.IndividualsUpdated != 0 ||
+		stats.LinksAdded != 0 || stats.LinksRemoved != 0 || stats.CategoryLinksAdded != 0 {
+		t.Errorf("got stats %+v syncing again, want nothing changed", stats)
+	}
+}
+
+func TestSyncAirtable(t *testing.T) {
+	db, cleanup := testdb.New(t)
+	defer cleanup()
+	ctx := context.Background()
+
+	// The records of the CSV exports, as the API returns them, one
+	// per page and rate limited partway through
+	at := airtabletest.NewServer("key")
+	defer at.Close()
+	at.PageSize = 1
+	at.AddRecords("Master List",
+		airtable.Record{ID: "recAlice", Fields: map[string]interface{}{
+			"First":        "Alice",
+			"Last":         "Adams",
+			"Role":         "Board Member",
+			"Title":        "Community Board 1",
+			"Associations": []interface{}{"Community Board 1 (2015-2019)", "Parks Conservancy"},
+			"Sources":      "https://example.com/alice",
+		}},
+		airtable.Record{ID: "recBob", Fields: map[string]interface{}{
+			"First":        "Bob",
+			"Last":         "Brown",
+			"Associations": []interface{}{"Parks Conservancy"},
+		}},
+	)
+	at.AddRecords("Categories", airtable.Record{ID: "recBoards", Fields: map[string]interface{}{
+		"Name":         "Community Boards",
+		"Associations": []interface{}{"Community Board 1"},
+	}})
+	at.FailNext(http.StatusTooManyRequests, "")
+
+	stats, err := Sync(ctx, db, at.Client("base"), SyncConfig{
+		MasterTable:     "Master List",
+		CategoriesTable: "Categories",
+		Fields:          DefaultFieldMap,
+		Source:          provenance.Source{Type: provenance.TypeAirtable},
+	})
+	if err != nil {
+		t.Fatalf("syncing: %v", err)
+	}
+	if stats.IndividualsCreated != 2 || stats.AssociationsCreated != 2 || stats.LinksAdded != 3 ||
+		stats.CategoriesCreated != 1 || stats.CategoryLinksAdded != 1 {
+		t.Errorf("got stats %+v, want 2 individuals, 2 associations, 3 links, 1 category and 1 category link", stats)
+	}
+	// 2 pages of individuals, 1 of categories and the retry
+	if at.Requests() != 4 {
+		t.Errorf("got %d requests to Airtable, want 4", at.Requests())
+	}
+
+	var sourceType, recordID string
+	err = db.QueryRow(`
+		SELECT s.source_type, s.airtable_record_id
+		FROM individuals i
+		JOIN sources s ON s.id = i.source_id
+		WHERE i.airtable_id = 'recBob'
+	`).Scan(&sourceType, &recordID)
+	if err != nil {
+		t.Fatalf("reading Bob's source: %v", err)
+	}
+	if sourceType != provenance.TypeAirtable || recordID != "recBob" {
+		t.Errorf("got source %s %s, want airtable recBob", sourceType, recordID)
+	}
+}
+
+func TestSyncDryRun(t *testing.T) {
+	db, cleanup := testdb.New(t)
+	defer cleanup()
+	ctx := context.Background()
+
+	master := testdb.Path("annotations_master.csv")
+	stats, err := Sync(ctx, db, FileSource{Paths: map[string]string{"Master List": master}}, SyncConfig{
+		MasterTable: "Master List",
+		Fields:      DefaultFieldMap,
+		Source:      provenance.Source{Type: provenance.TypeFile, File: master},
+		DryRun:      true,
+	})
+	if err != nil {
+		t.Fatalf("syncing: %v", err)
+	}
+	wantIndividuals := []string{"Alice Adams", "Bob Brown"}
+	wantAssociations := []string{"Community Board 1", "Parks Conservancy"}
+	if !reflect.DeepEqual(stats.NewIndividuals, wantIndividuals) || !reflect.DeepEqual(stats.NewAssociations, wantAssociations) {
+		t.Errorf("got new individuals %v and associations %v, want %v and %v",
+			stats.NewIndividuals, stats.NewAssociations, wantIndividuals, wantAssociations)
+	}
+	if stats.MatchRate() != 0 {
+		t.Errorf("got match rate %v, want 0", stats.MatchRate())
+	}
+
+	// Nothing was written
+	var individuals int
+	err = db.QueryRow(`SELECT count(*) FROM individuals`).Scan(&individuals)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if individuals != 0 {
+		t.Errorf("got %d individuals after a dry run, want 0", individuals)
+	}
+}
+
+func TestExport(t *testing.T) {
+	db, cleanup := testdb.New(t)
+	defer cleanup()
+	ctx := context.Background()
+
+	master := testdb.Path("annotations_master.csv")
+	_, err := Sync(ctx, db, FileSource{Paths: map[string]string{
+		"Master List": master,
+		"Categories":  testdb.Path("annotations_categories.csv"),
+	}}, SyncConfig{
+		MasterTable:     "Master List",
+		CategoriesTable: "Categories",
+		Fields:          DefaultFieldMap,
+		Source:          provenance.Source{Type: provenance.TypeFile, File: master},
+	})
+	if err != nil {
+		t.Fatalf("syncing: %v", err)
+	}
+
+	var individuals, categories bytes.Buffer
+	err = Export(ctx, db, &individuals, &categories)
+	if err != nil {
+		t.Fatalf("exporting: %v", err)
+	}
+	associations := func(b *bytes.Buffer) map[string]interface{} {
+		var records []airtable.Record
+		err := json.Unmarshal(b.Bytes(), &records)
+		if err != nil {
+			t.Fatalf("decoding export: %v", err)
+		}
+		res := make(map[string]interface{})
+		for _, r := range records {
+			res[r.ID] = r.Fields["Associations"]
+		}
+		return res
+	}
+	want := map[string]interface{}{
+		"recAlice": []interface{}{"Community Board 1 (2015-2019)", "Parks Conservancy"},
+		"recBob":   []interface{}{"Parks Conservancy"},
+	}
+	if got := associations(&individuals); !reflect.DeepEqual(got, want) {
+		t.Errorf("got individuals' associations %v, want %v", got, want)
+	}
+	want = map[string]interface{}{
+		"recBoards": []interface{}{"Community Board 1"},
+	}
+	if got := associations(&categories); !reflect.DeepEqual(got, want) {
+		t.Errorf("got categories' associations %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,574 @@
+// Package cfb imports contributions from the filing exports of the
+// NYC Campaign Finance Board.
+package cfb
+
+import (
+	"context"
+	"database/sql"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/vickiniu/project-red-string/audit"
+	"github.com/vickiniu/project-red-string/dataversion"
+	"github.com/vickiniu/project-red-string/internal/sqlutil"
+	"github.com/vickiniu/project-red-string/provenance"
+)
+
+// matchQ matches a CFB name to an individual by their cfb_name or
+// that of one of their aliases.
+const matchQ = `
+	SELECT id FROM individuals WHERE cfb_name = $1
+	UNION ALL
+	SELECT individual_id FROM individual_aliases WHERE cfb_name = $1
+	LIMIT 1
+`
+
+var headers = []string{
+	"election", // election (skip)
+	"office_cd",
+	"recip_id",
+	"can_class",
+	"recipient_name",
+	"committee",
+	"filing",
+	"schedule",
+	"", // pageno
+	"", // sequenceno
+	"ref_no",
+	"date",
+	"", // refunddate
+	"contributor_name",
+	"c_code",
+	"", // strno
+	"", //strname
+	"", //apartment
+	"borough",
+	"city",
+	"state",
+	"zip",
+	"occupation",
+	"employer_name",
+	"", // empstrno
+	"", // empstrname
+	"", // empcity
+	"", // empstate
+	"amount",
+	"", // matchamnt
+	"", // prevamnt
+	"", // pay_method
+	"", // intermno
+	"", // intermname
+	"", // intstrno
+	"", // instrnm
+	"", // intaptno
+	"", // intcity
+	"", // intst
+	"", // intzip
+	"", // intempname
+	"", // intempstno
+	"", // intempstnm
+	"", // intempcity
+	"", // intempst
+	"", // intoccupa
+	"", // purposecd
+	"", // exemptcd
+	"", // adjtypecd
+	"", // rr_ind
+	"", // seg_ind
+	"", // int_c_code
+}
+
+// Result summarizes an import.
+type Result struct {
+	// Read counts the records read. Each was either inserted,
+	// skipped, because its contributor matched no individual or it
+	// was already imported, or errored.
+	Read     int
+	Inserted int
+	Skipped  int
+	Errored  int
+	// Contributors and Recipients count how the records' names were
+	// matched to individuals
+	Contributors MatchStats
+	Recipients   MatchStats
+	// UnmatchedNames are the recipient names that matched no
+	// individual, sorted
+	UnmatchedNames []string
+	// Errors are the rows that couldn't be imported
+	Errors []RowError
+}
+
+// RowError is a row that couldn't be imported.
+type RowError struct {
+	// Row is the row's number in the file, counting the header as 1
+	Row   int    `json:"row"`
+	RefNo string `json:"refno,omitempty"`
+	Err   string `json:"error"`
+}
+
+// MatchStats counts how the names in one column of the records read
+// matched individuals.
+type MatchStats struct {
+	Exact int
+	// Trimmed counts names matched once their last word, such as a
+	// middle initial, was dropped
+	Trimmed   int
+	Unmatched int
+}
+
+// Rate returns the fraction of names matched, or 0 if there were
+// none.
+func (m MatchStats) Rate() float64 {
+	total := m.Exact + m.Trimmed + m.Unmatched
+	if total == 0 {
+		return 0
+	}
+	return float64(m.Exact+m.Trimmed) / float64(total)
+}
+
+// Print writes a report of the result to w.
+func (r *Result) Print(w io.Writer) {
+	fmt.Fprintf(w, "contributions: %d read, %d inserted, %d skipped, %d errored\n", r.Read, r.Inserted, r.Skipped, r.Errored)
+	for _, m := range []struct {
+		name  string
+		stats MatchStats
+	}{{"contributors", r.Contributors}, {"recipients", r.Recipients}} {
+		fmt.Fprintf(w, "%s: %.1f%% matched, %d exactly, %d without their last word, %d unmatched\n",
+			m.name, 100*m.stats.Rate(), m.stats.Exact, m.stats.Trimmed, m.stats.Unmatched)
+	}
+	for _, n := range r.UnmatchedNames {
+		fmt.Fprintf(w, "  unmatched recipient: %s\n", n)
+	}
+	for _, e := range r.Errors {
+		fmt.Fprintf(w, "  row %d (%s): %s\n", e.Row, e.RefNo, e.Err)
+	}
+}
+
+// Options configures an import.
+type Options struct {
+	// DryRun rolls the import back once it's done, so the result
+	// reports what it would change. Dry runs aren't recorded in
+	// cfb_imports.
+	DryRun bool
+	// MaxErrors is how many rows may fail to import, e.g. because
+	// of an unparseable date, before the whole import fails
+	MaxErrors int
+}
+
+// importer imports the records of a CFB export.
+type importer struct {
+	tx   *sql.Tx
+	run  *audit.Run
+	file string
+	opts Options
+	// unmatched are the recipient names that matched no individual
+	unmatched map[string]bool
+	res       Result
+}
+
+// Import imports the contributions in a CFB export named file, read
+// from r, skipping those already imported. Contributions are only
+// imported if the contributor matches an individual; recipients that
+// don't match are recorded as NULL. Rows that can't be imported are
+// skipped and reported in the result, unless there are more than
+// opts.MaxErrors of them. Nothing is committed unless the import
+// succeeds, or at all if opts.DryRun is set. Each run that isn't a
+// dry run is recorded in cfb_imports.
+func Import(ctx context.Context, db *sql.DB, file string, r io.Reader, opts Options) (*Result, error) {
+	if opts.DryRun {
+		return importFile(ctx, db, file, r, opts)
+	}
+	id, err := startReport(ctx, db, file)
+	if err != nil {
+		return nil, err
+	}
+	res, importErr := importFile(ctx, db, file, r, opts)
+	err = finishReport(db, id, res, importErr)
+	if importErr != nil {
+		return nil, importErr
+	}
+	if err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// importFile runs an import in a transaction. It returns what was
+// read even if the import fails.
+func importFile(ctx context.Context, db *sql.DB, file string, r io.Reader, opts Options) (*Result, error) {
+	imp := &importer{file: file, opts: opts, unmatched: make(map[string]bool)}
+	res := &imp.res
+	cr := csv.NewReader(r)
+	// Rows are read by position, so the header must be as wide as
+	// headers; the reader then holds every row to its width
+	header, err := cr.Read()
+	if err != nil {
+		return res, errors.Wrap(err, "reading header")
+	}
+	err = validHeader(header)
+	if err != nil {
+		return res, err
+	}
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return res, errors.Wrap(err, "beginning transaction")
+	}
+	defer tx.Rollback()
+	imp.tx = tx
+
+	imp.run, err = audit.StartRun(ctx, tx, "import cfb "+file)
+	if err != nil {
+		return res, errors.Wrap(err, "starting audit run")
+	}
+	for {
+		record, err := cr.Read()
+		if err == io.EOF {
+			break
+		}
+		imp.res.Read++
+		if perr, ok := err.(*csv.ParseError); ok {
+			err = imp.rowError(record, perr)
+		} else if err != nil {
+			return res, errors.Wrap(err, "reading row from csv")
+		} else {
+			err = imp.importRecord(ctx, record)
+		}
+		if err != nil {
+			return res, err
+		}
+	}
+	for n := range imp.unmatched {
+		res.UnmatchedNames = append(res.UnmatchedNames, n)
+	}
+	sort.Strings(res.UnmatchedNames)
+	if opts.DryRun {
+		return res, nil
+	}
+	// Invalidate the API's cached responses
+	err = dataversion.Bump(ctx, tx)
+	if err != nil {
+		return res, err
+	}
+	err = tx.Commit()
+	if err != nil {
+		return res, errors.Wrap(err, "committing import")
+	}
+	return res, nil
+}
+
+// importRecord imports a record within a savepoint, so that if it
+// fails, its changes are rolled back and the import can go on.
+func (imp *importer) importRecord(ctx context.Context, record []string) error {
+	_, err := imp.tx.ExecContext(ctx, `SAVEPOINT cfb_record`)
+	if err != nil {
+		return errors.Wrap(err, "saving record savepoint")
+	}
+	before := imp.res
+	var recipient string
+	if len(record) > 4 {
+		recipient = record[4] // recipient_name
+	}
+	wasUnmatched := imp.unmatched[recipient]
+
+	err = imp.handleRecord(ctx, record)
+	if err == nil {
+		_, err = imp.tx.ExecContext(ctx, `RELEASE SAVEPOINT cfb_record`)
+		return errors.Wrap(err, "releasing record savepoint")
+	}
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	_, rbErr := imp.tx.ExecContext(ctx, `ROLLBACK TO SAVEPOINT cfb_record`)
+	if rbErr != nil {
+		return errors.Wrap(rbErr, "rolling back record")
+	}
+	// Only count what was imported
+	imp.res = before
+	if !wasUnmatched {
+		delete(imp.unmatched, recipient)
+	}
+	return imp.rowError(record, err)
+}
+
+// rowError records that the record couldn't be imported, returning
+// an error if that's too many.
+func (imp *importer) rowError(record []string, err error) error {
+	e := RowError{Row: imp.res.Read + 1, Err: err.Error()}
+	if len(record) > 10 {
+		e.RefNo = record[10] // ref_no
+	}
+	imp.res.Errored++
+	imp.res.Errors = append(imp.res.Errors, e)
+	if imp.res.Errored > imp.opts.MaxErrors {
+		first := imp.res.Errors[0]
+		return fmt.Errorf("%d rows couldn't be imported, more than the %d allowed; the first was row %d: %s",
+			imp.res.Errored, imp.opts.MaxErrors, first.Row, first.Err)
+	}
+	return nil
+}
+
+// cfbrecord defines a CFB record, fields corresponding to our
+// DB columns.
+type cfbrecord struct {
+	election        string
+	officeCD        string
+	recipientID     string
+	cfbRecipientID  string
+	canClass        string
+	recipientName   string
+	committee       string
+	filing          string
+	schedule        string
+	refNo           string
+	date            time.Time
+	contributorName string
+	contributorID   string
+	cCode           string
+	borough         string
+	city            string
+	state           string
+	zip             string
+	occupation      string
+	employerName    string
+	amount          int
+
+	// cfb_name each of the contributor and recipient were matched
+	// on, if they were
+	contributorMatch string
+	recipientMatch   string
+}
+
+// match matches a CFB name to an individual, first as it is and then
+// without its last word, counting the outcome in stats. It returns
+// the individual's ID and the name they matched on, or empty strings
+// if nobody matched.
+func (imp *importer) match(ctx context.Context, name string, stats *MatchStats) (id, match string, err error) {
+	err = imp.tx.QueryRowContext(ctx, matchQ, name).Scan(&id)
+	if err == nil {
+		stats.Exact++
+		return id, name, nil
+	} else if err != sql.ErrNoRows {
+		return "", "", err
+	}
+	// Try again, stripping the last space
+	parts := strings.Split(name, " ")
+	trimmed := strings.Join(parts[0:len(parts)-1], " ")
+	err = imp.tx.QueryRowContext(ctx, matchQ, trimmed).Scan(&id)
+	if err == nil {
+		stats.Trimmed++
+		return id, trimmed, nil
+	} else if err != sql.ErrNoRows {
+		return "", "", err
+	}
+	stats.Unmatched++
+	return "", "", nil
+}
+
+func (imp *importer) handleRecord(ctx context.Context, record []string) error {
+	c := cfbrecord{}
+	for i, val := range record {
+		if i >= len(headers) {
+			break
+		}
+		if val == "" || headers[i] == "" {
+			continue
+		}
+		switch headers[i] {
+		case "election":
+			c.election = val
+		case "office_cd":
+			c.officeCD = val
+		case "recip_id":
+			c.cfbRecipientID = val
+		case "can_class":
+			c.canClass = val
+		case "recipient_name":
+			c.recipientName = val
+			id, match, err := imp.match(ctx, val, &imp.res.Recipients)
+			if err != nil {
+				return errors.Wrap(err, "matching recipient")
+			}
+			if id == "" {
+				imp.unmatched[val] = true
+			}
+			c.recipientID, c.recipientMatch = id, match
+		case "committee":
+			c.committee = val
+		case "filing":
+			c.filing = val
+		case "schedule":
+			c.schedule = val
+		case "ref_no":
+			c.refNo = val
+		case "date":
+			d, err := time.Parse("1/2/2006", val)
+			if err != nil {
+				return errors.Wrap(err, "parsing date")
+			}
+			c.date = d
+		case "contributor_name":
+			// Check if contributor is an individual in the DB
+			// TODO: handle casing as well
+			c.contributorName = val
+			id, match, err := imp.match(ctx, val, &imp.res.Contributors)
+			if err != nil {
+				return errors.Wrap(err, "matching contributor")
+			}
+			if id == "" {
+				imp.res.Skipped++
+				return nil
+			}
+			c.contributorID, c.contributorMatch = id, match
+		case "c_code":
+			c.cCode = val
+		case "borough":
+			c.borough = val
+		case "city":
+			c.city = val
+		case "state":
+			c.state = val
+		case "zip":
+			c.zip = val
+		case "occupation":
+			c.occupation = val
+		case "employer_name":
+			c.employerName = val
+		case "amount":
+			amt, err := strconv.ParseFloat(val, 64)
+			if err != nil {
+				return errors.Wrap(err, "parsing amount")
+			}
+			amtUnits := int(amt * 100)
+			c.amount = amtUnits
+		}
+	}
+	return imp.upsertRecord(ctx, c)
+}
+
+func (imp *importer) upsertRecord(ctx context.Context, c cfbrecord) error {
+	tx, run := imp.tx, imp.run
+	if c.refNo == "" {
+		return errors.New("record is missing a reference number")
+	}
+	var refno string
+	const q = `SELECT id FROM contributions WHERE refno = $1`
+	err := tx.QueryRowContext(ctx, q, c.refNo).Scan(&refno)
+	if err == sql.ErrNoRows {
+		contributorSourceID, err := imp.matchSource(ctx, c, c.contributorMatch)
+		if err != nil {
+			return errors.Wrap(err, "recording contributor source")
+		}
+		recipientSourceID, err := imp.matchSource(ctx, c, c.recipientMatch)
+		if err != nil {
+			return errors.Wrap(err, "recording recipient source")
+		}
+		const insertQ = `
+		INSERT INTO contributions (
+			refno,
+			amount,
+			date,
+			contributor_name,
+			contributor_id,
+			recipient_name,
+			recipient_id,
+			cfb_recipient_id,
+			election,
+			office_cd,
+			can_class,
+			committee,
+			filing,
+			schedule,
+			c_code,
+			borough,
+			city,
+			state,
+			zip,
+			occupation,
+			employer_name,
+			contributor_source_id,
+			recipient_source_id
+		) VALUES (
+			$1,$2,$3,$4,$5,$6,$7,$8,$9,$10,$11,$12,$13,$14,$15,$16,$17,$18,$19,$20,$21,$22,$23
+		) RETURNING id
+	`
+		var id string
+		err = tx.QueryRowContext(
+			ctx,
+			insertQ,
+			c.refNo,
+			c.amount,
+			c.date,
+			c.contributorName,
+			c.contributorID,
+			c.recipientName,
+			sqlutil.NullString(c.recipientID),
+			c.cfbRecipientID,
+			c.election,
+			c.officeCD,
+			c.canClass,
+			c.committee,
+			c.filing,
+			c.schedule,
+			c.cCode,
+			c.borough,
+			c.city,
+			c.state,
+			c.zip,
+			c.occupation,
+			c.employerName,
+			contributorSourceID,
+			recipientSourceID,
+		).Scan(&id)
+		if err != nil {
+			return errors.Wrap(err, "inserting CFB record")
+		}
+		err = run.Record(ctx, tx, contributorSourceID.String, audit.Change{
+			Entity:       audit.EntityContribution,
+			EntityID:     id,
+			IndividualID: c.contributorID,
+			Field:        "contributor_id",
+			New:          c.contributorID,
+		})
+		if err != nil {
+			return errors.Wrap(err, "recording contributor match")
+		}
+		err = run.Record(ctx, tx, recipientSourceID.String, audit.Change{
+			Entity:       audit.EntityContribution,
+			EntityID:     id,
+			IndividualID: c.recipientID,
+			Field:        "recipient_id",
+			New:          c.recipientID,
+		})
+		if err != nil {
+			return errors.Wrap(err, "recording recipient match")
+		}
+		imp.res.Inserted++
+	} else if err != nil {
+		return errors.Wrap(err, "querying for record by refno")
+	} else {
+		imp.res.Skipped++
+	}
+	return nil
+}
+
+// matchSource records the provenance of matching the record's
+// contributor or recipient to an individual by their cfb_name, and
+// returns its ID. If nothing was matched, it returns NULL.
+func (imp *importer) matchSource(ctx context.Context, c cfbrecord, match string) (sql.NullString, error) {
+	if match == "" {
+		return sql.NullString{}, nil
+	}
+	id, err := provenance.Insert(ctx, imp.tx, provenance.Source{
+		Type:     provenance.TypeCFB,
+		File:     imp.file,
+		CFBRefNo: c.refNo,
+		Note:     fmt.Sprintf("matched on cfb_name %q", match),
+	})
+	return sqlutil.NullString(id), err
+}
@@ -0,0 +1,264 @@
+package cfb
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/csv"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/vickiniu/project-red-string/internal/testdb"
+)
+
+func TestMain(m *testing.M) {
+	os.Exit(testdb.Run(m))
+}
+
+func TestImportCSV(t *testing.T) {
+	db, cleanup := testdb.New(t)
+	defer cleanup()
+	testdb.LoadFixtures(t, db)
+	ctx := context.Background()
+
+	importSample := func() *Result {
+		t.Helper()
+		f, err := os.Open(testdb.Path("CFB_sample.csv"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+		res, err := Import(ctx, db, "CFB_sample.csv", f, Options{})
+		if err != nil {
+			t.Fatalf("importing: %v", err)
+		}
+		return res
+	}
+	res := importSample()
+
+	type row struct {
+		amount        int
+		contributorID string
+		recipientID   sql.NullString
+	}
+	want := map[string]row{
+		// Both matched
+		"S1": {amount: 10000, contributorID: "1002", recipientID: sql.NullString{String: "1001", Valid: true}},
+		// Contributor matched without the middle initial; recipient
+		// unmatched
+		"S2": {amount: 2550, contributorID: "1001"},
+	}
+	for refno, w := range want {
+		var got row
+		err := db.QueryRow(`SELECT amount, contributor_id, recipient_id FROM contributions WHERE refno = $1`, refno).
+			Scan(&got.amount, &got.contributorID, &got.recipientID)
+		if err != nil {
+			t.Fatalf("reading %s: %v", refno, err)
+		}
+		if got != w {
+			t.Errorf("%s: got %+v, want %+v", refno, got, w)
+		}
+	}
+	wantResult := Result{
+		Read:           4,
+		Inserted:       2,
+		Skipped:        2,
+		Contributors:   MatchStats{Exact: 2, Trimmed: 1, Unmatched: 1},
+		Recipients:     MatchStats{Exact: 3, Unmatched: 1},
+		UnmatchedNames: []string{"Someone Else"},
+	}
+	if !reflect.DeepEqual(*res, wantResult) {
+		t.Errorf("got %+v, want %+v", *res, wantResult)
+	}
+
+	// The unknown contributor is skipped, R1 was already imported,
+	// and importing again changes nothing
+	if res := importSample(); res.Inserted != 0 || res.Skipped != 4 {
+		t.Errorf("got %+v importing again, want everything skipped", *res)
+	}
+	var n int
+	err := db.QueryRow(`SELECT count(*) FROM contributions`).Scan(&n)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 5 {
+		t.Errorf("got %d contributions, want 5", n)
+	}
+
+	var sources int
+	err = db.QueryRow(`SELECT count(*) FROM sources WHERE source_type = 'cfb' AND file = 'CFB_sample.csv'`).Scan(&sources)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sources != 3 {
+		t.Errorf("got %d match sources, want 3", sources)
+	}
+}
+
+func TestImportDryRun(t *testing.T) {
+	db, cleanup := testdb.New(t)
+	defer cleanup()
+	testdb.LoadFixtures(t, db)
+	ctx := context.Background()
+
+	f, err := os.Open(testdb.Path("CFB_sample.csv"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	res, err := Import(ctx, db, "CFB_sample.csv", f, Options{DryRun: true})
+	if err != nil {
+		t.Fatalf("importing: %v", err)
+	}
+	if res.Inserted != 2 || res.Contributors.Rate() != 0.75 {
+		t.Errorf("got %+v, want 2 inserted and 75%% of contributors matched", *res)
+	}
+
+	// Nothing was written
+	var contributions, sources, runs int
+	err = db.QueryRow(`
+		SELECT
+			(SELECT count(*) FROM contributions),
+			(SELECT count(*) FROM sources WHERE file = 'CFB_sample.csv'),
+			(SELECT count(*) FROM audit_runs)
+	`).Scan(&contributions, &sources, &runs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if contributions != 3 || sources != 0 || runs != 0 {
+		t.Errorf("got %d contributions, %d sources and %d audit runs after a dry run, want 3, 0 and 0",
+			contributions, sources, runs)
+	}
+}
+
+func TestImportErrors(t *testing.T) {
+	db, cleanup := testdb.New(t)
+	defer cleanup()
+	testdb.LoadFixtures(t, db)
+	ctx := context.Background()
+
+	b, err := ioutil.ReadFile(testdb.Path("CFB_sample.csv"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// S2's date can't be parsed
+	sample := strings.Replace(string(b), "4/15/2020", "April 15", 1)
+
+	// One bad row is more than none
+	_, err = Import(ctx, db, "bad.csv", strings.NewReader(sample), Options{})
+	if err == nil {
+		t.Fatal("got no error importing a bad row with MaxErrors 0")
+	}
+	res, err := Import(ctx, db, "bad.csv", strings.NewReader(sample), Options{MaxErrors: 1})
+	if err != nil {
+		t.Fatalf("importing: %v", err)
+	}
+	if res.Inserted != 1 || res.Errored != 1 || len(res.Errors) != 1 || res.Errors[0].Row != 3 || res.Errors[0].RefNo != "S2" {
+		t.Errorf("got %+v, want S1 inserted and an error in row 3", *res)
+	}
+	// S2's recipient isn't reported, since S2 wasn't imported
+	if len(res.UnmatchedNames) != 0 {
+		t.Errorf("got unmatched names %v, want none", res.UnmatchedNames)
+	}
+
+	reports, err := Reports(ctx, db, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(reports) != 2 {
+		t.Fatalf("got %d reports, want 2", len(reports))
+	}
+	failed, succeeded := reports[1], reports[0]
+	// S1 was inserted before the import failed, but rolled back
+	if failed.Status != statusFailed || failed.Error == "" || failed.Errored != 1 || failed.Inserted != 0 {
+		t.Errorf("got %+v, want the failed import, with nothing inserted", failed)
+	}
+	if succeeded.Status != statusSucceeded || succeeded.Read != 4 || succeeded.Inserted != 1 ||
+		succeeded.Skipped != 2 || succeeded.Errored != 1 || succeeded.ContributorMatchRate != 2.0/3 {
+		t.Errorf("got %+v, want the successful import", succeeded)
+	}
+	if !reflect.DeepEqual(succeeded.Errors, res.Errors) {
+		t.Errorf("got row errors %+v, want %+v", succeeded.Errors, res.Errors)
+	}
+}
+
+func TestImportBadHeader(t *testing.T) {
+	db, cleanup := testdb.New(t)
+	defer cleanup()
+	testdb.LoadFixtures(t, db)
+	ctx := context.Background()
+
+	f, err := os.Open(testdb.Path("CFB_sample.csv"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	records, err := csv.NewReader(f).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// reshape returns the sample with each row changed by fn
+	reshape := func(fn func([]string) []string) string {
+		var b bytes.Buffer
+		w := csv.NewWriter(&b)
+		for _, r := range records {
+			w.Write(fn(append([]string(nil), r...)))
+		}
+		w.Flush()
+		return b.String()
+	}
+	tests := []struct {
+		name string
+		file string
+	}{
+		{"narrow", reshape(func(r []string) []string { return r[:4] })},
+		{"wide", reshape(func(r []string) []string { return append(r, "extra") })},
+	}
+	for _, tt := range tests {
+		_, err := Import(ctx, db, tt.name+".csv", strings.NewReader(tt.file), Options{MaxErrors: 100})
+		if err == nil || !strings.Contains(err.Error(), "not a CFB export") {
+			t.Errorf("%s: got error %v, want the header rejected", tt.name, err)
+		}
+	}
+	var contributions int
+	err = db.QueryRow(`SELECT count(*) FROM contributions`).Scan(&contributions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if contributions != 3 {
+		t.Errorf("got %d contributions, want only the fixtures' 3", contributions)
+	}
+}
+
+func TestUnmatchedRecipients(t *testing.T) {
+	db, cleanup := testdb.New(t)
+	defer cleanup()
+	testdb.LoadFixtures(t, db)
+	ctx := context.Background()
+
+	f, err := os.Open(testdb.Path("CFB_sample.csv"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	_, err = Import(ctx, db, "CFB_sample.csv", f, Options{})
+	if err != nil {
+		t.Fatalf("importing: %v", err)
+	}
+
+	got, err := UnmatchedRecipients(ctx, db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// R3 from the fixtures and S2 from the sample
+	want := []UnmatchedRecipient{
+		{Name: "Friends of Someone", CFBRecipientID: "C2", Contributions: 1, Amount: 5000},
+		{Name: "Someone Else", CFBRecipientID: "C3", Contributions: 1, Amount: 2550},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+}
@@ -0,0 +1,138 @@
+package cfb
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/csv"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Download is a CFB export fetched by Fetch.
+type Download struct {
+	// Path is where the export is stored
+	Path   string
+	SHA256 string
+	Size   int64
+	// New is whether the export hasn't been downloaded before. If
+	// not, Path is the file it was first stored in, which may have
+	// since been removed.
+	New bool
+}
+
+// Fetch downloads the CFB export at url into dir, named
+// CFB_<timestamp>.csv like the exports downloaded by hand. Each
+// export's SHA-256 hash is recorded in cfb_downloads, and exports
+// that have been downloaded before aren't stored again.
+func Fetch(ctx context.Context, db *sql.DB, client *http.Client, url, dir string) (*Download, error) {
+	d, err := download(ctx, client, url, dir)
+	if err != nil {
+		return nil, err
+	}
+	const existingQ = `SELECT file FROM cfb_downloads WHERE sha256 = $1`
+	var file string
+	err = db.QueryRowContext(ctx, existingQ, d.SHA256).Scan(&file)
+	if err == nil {
+		os.Remove(d.Path)
+		d.Path = filepath.Join(dir, file)
+		return d, nil
+	} else if err != sql.ErrNoRows {
+		os.Remove(d.Path)
+		return nil, errors.Wrap(err, "querying downloads")
+	}
+
+	name := "CFB_" + time.Now().UTC().Format("20060102150405")
+	path := filepath.Join(dir, name+".csv")
+	if _, err := os.Stat(path); err == nil {
+		// Downloaded within the same second as another export
+		path = filepath.Join(dir, name+"_"+d.SHA256[:8]+".csv")
+	}
+	err = os.Rename(d.Path, path)
+	if err != nil {
+		os.Remove(d.Path)
+		return nil, errors.Wrap(err, "storing download")
+	}
+	d.Path, d.New = path, true
+	const insertQ = `
+		INSERT INTO cfb_downloads (sha256, url, file, size, downloaded_ts)
+		VALUES ($1, $2, $3, $4, current_timestamp)
+	`
+	_, err = db.ExecContext(ctx, insertQ, d.SHA256, url, filepath.Base(path), d.Size)
+	if err != nil {
+		return nil, errors.Wrap(err, "recording download")
+	}
+	return d, nil
+}
+
+// download downloads the export at url into a temporary file in dir,
+// checking it has the columns of a CFB export.
+func download(ctx context.Context, client *http.Client, url, dir string) (*Download, error) {
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return nil, errors.Wrap(err, "creating request")
+	}
+	resp, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, errors.Wrap(err, "requesting export")
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("requesting export: %s", resp.Status)
+	}
+
+	err = os.MkdirAll(dir, 0755)
+	if err != nil {
+		return nil, errors.Wrap(err, "creating download directory")
+	}
+	f, err := ioutil.TempFile(dir, ".download-")
+	if err != nil {
+		return nil, errors.Wrap(err, "creating download file")
+	}
+	d := &Download{Path: f.Name()}
+	h := sha256.New()
+	d.Size, err = io.Copy(io.MultiWriter(f, h), resp.Body)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = checkHeader(d.Path)
+	}
+	if err != nil {
+		os.Remove(d.Path)
+		return nil, errors.Wrap(err, "downloading export")
+	}
+	d.SHA256 = hex.EncodeToString(h.Sum(nil))
+	return d, nil
+}
+
+// checkHeader checks that the file at path starts with a header of as
+// many columns as a CFB export, e.g. rather than an error page.
+func checkHeader(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	header, err := csv.NewReader(f).Read()
+	if err != nil {
+		return errors.Wrap(err, "reading header")
+	}
+	return validHeader(header)
+}
+
+// validHeader checks that header has as many columns as a CFB export.
+func validHeader(header []string) error {
+	if len(header) != len(headers) {
+		return fmt.Errorf("got %d columns, want %d: not a CFB export", len(header), len(headers))
+	}
+	return nil
+}
@@ -0,0 +1,153 @@
+package cfb
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/vickiniu/project-red-string/internal/testdb"
+)
+
+// exportServer stands in for the CFB open data site, serving the
+// fixture file it's set to.
+type exportServer struct {
+	mu   sync.Mutex
+	file string
+}
+
+func (s *exportServer) set(file string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.file = file
+}
+
+func (s *exportServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.file == "" {
+		http.Error(w, "<html>maintenance</html>", http.StatusServiceUnavailable)
+		return
+	}
+	http.ServeFile(w, r, testdb.Path(s.file))
+}
+
+func tempDir(t *testing.T) (string, func()) {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "cfb-fetch")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dir, func() { os.RemoveAll(dir) }
+}
+
+func TestDownload(t *testing.T) {
+	s := &exportServer{file: "CFB_sample.csv"}
+	srv := httptest.NewServer(s)
+	defer srv.Close()
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+	ctx := context.Background()
+
+	d, err := download(ctx, srv.Client(), srv.URL, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := ioutil.ReadFile(testdb.Path("CFB_sample.csv"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sum := sha256.Sum256(b)
+	if d.SHA256 != hex.EncodeToString(sum[:]) || d.Size != int64(len(b)) {
+		t.Errorf("got hash %s and size %d, want %x and %d", d.SHA256, d.Size, sum, len(b))
+	}
+	got, err := ioutil.ReadFile(d.Path)
+	if err != nil || string(got) != string(b) {
+		t.Errorf("download doesn't match the export: %v", err)
+	}
+	os.Remove(d.Path)
+
+	// Errors and files that aren't exports leave nothing behind
+	s.set("")
+	_, err = download(ctx, srv.Client(), srv.URL, dir)
+	if err == nil {
+		t.Error("got no error downloading during maintenance")
+	}
+	s.set("annotations_master.csv")
+	_, err = download(ctx, srv.Client(), srv.URL, dir)
+	if err == nil {
+		t.Error("got no error downloading a file that isn't an export")
+	}
+	files, _ := ioutil.ReadDir(dir)
+	if len(files) != 0 {
+		t.Errorf("got %d files left in the download directory, want none", len(files))
+	}
+}
+
+func TestFetch(t *testing.T) {
+	db, cleanup := testdb.New(t)
+	defer cleanup()
+	testdb.LoadFixtures(t, db)
+	s := &exportServer{file: "CFB_sample.csv"}
+	srv := httptest.NewServer(s)
+	defer srv.Close()
+	dir, removeDir := tempDir(t)
+	defer removeDir()
+	ctx := context.Background()
+
+	fetch := func() *Download {
+		t.Helper()
+		d, err := Fetch(ctx, db, srv.Client(), srv.URL, dir)
+		if err != nil {
+			t.Fatalf("fetching: %v", err)
+		}
+		return d
+	}
+	first := fetch()
+	if !first.New || filepath.Dir(first.Path) != dir {
+		t.Fatalf("got %+v, want a new download in %s", first, dir)
+	}
+	if again := fetch(); again.New || again.Path != first.Path {
+		t.Errorf("got %+v fetching the same export, want %s unchanged", again, first.Path)
+	}
+
+	s.set("CFB_sample_update.csv")
+	update := fetch()
+	if !update.New || update.Path == first.Path {
+		t.Fatalf("got %+v fetching an updated export, want a new file", update)
+	}
+	files, _ := ioutil.ReadDir(dir)
+	if len(files) != 2 {
+		t.Errorf("got %d files in the download directory, want 2", len(files))
+	}
+
+	// The update has one more contribution than the first export
+	imports := []struct {
+		path     string
+		inserted int
+	}{
+		{first.Path, 2},
+		{update.Path, 1},
+	}
+	for _, imp := range imports {
+		path, inserted := imp.path, imp.inserted
+		f, err := os.Open(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res, err := Import(ctx, db, filepath.Base(path), f, Options{})
+		f.Close()
+		if err != nil {
+			t.Fatalf("importing %s: %v", path, err)
+		}
+		if res.Inserted != inserted {
+			t.Errorf("%s: got %d inserted, want %d", path, res.Inserted, inserted)
+		}
+	}
+}
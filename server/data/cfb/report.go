@@ -0,0 +1,184 @@
+package cfb
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"github.com/lib/pq"
+	"github.com/pkg/errors"
+)
+
+// Import statuses, as in job_runs
+const (
+	statusRunning   = "running"
+	statusSucceeded = "succeeded"
+	statusFailed    = "failed"
+)
+
+// Report is a row of cfb_imports, reporting an import run.
+type Report struct {
+	ID       string `json:"id"`
+	File     string `json:"file"`
+	Status   string `json:"status"`
+	Read     int    `json:"rows_read"`
+	Inserted int    `json:"rows_inserted"`
+	Skipped  int    `json:"rows_skipped"`
+	Errored  int    `json:"rows_errored"`
+	// ContributorMatchRate and RecipientMatchRate are the fractions
+	// of the rows read whose names matched an individual
+	ContributorMatchRate float64    `json:"contributor_match_rate"`
+	RecipientMatchRate   float64    `json:"recipient_match_rate"`
+	UnmatchedRecipients  int        `json:"unmatched_recipients"`
+	Error                string     `json:"error,omitempty"`
+	StartedTS            time.Time  `json:"started_ts"`
+	FinishedTS           *time.Time `json:"finished_ts"`
+	// Errors are the rows that couldn't be imported
+	Errors []RowError `json:"errors"`
+}
+
+// startReport records the start of an import of file, returning the
+// report's ID.
+func startReport(ctx context.Context, db *sql.DB, file string) (string, error) {
+	const q = `
+		INSERT INTO cfb_imports (file, status, started_ts)
+		VALUES ($1, $2, current_timestamp)
+		RETURNING id
+	`
+	var id string
+	err := db.QueryRowContext(ctx, q, file, statusRunning).Scan(&id)
+	if err != nil {
+		return "", errors.Wrap(err, "recording import start")
+	}
+	return id, nil
+}
+
+// finishReport records the result of the import, and the error it
+// failed with if it did. A failed import's transaction was rolled
+// back, so it's recorded as having inserted nothing.
+func finishReport(db *sql.DB, id string, res *Result, importErr error) error {
+	// Record the result even if the import was canceled
+	ctx := context.Background()
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return errors.Wrap(err, "beginning transaction")
+	}
+	defer tx.Rollback()
+
+	status, message, inserted := statusSucceeded, "", res.Inserted
+	if importErr != nil {
+		status, message, inserted = statusFailed, importErr.Error(), 0
+	}
+	const q = `
+		UPDATE cfb_imports SET
+			status = $2,
+			rows_read = $3,
+			rows_inserted = $4,
+			rows_skipped = $5,
+			rows_errored = $6,
+			contributor_match_rate = $7,
+			recipient_match_rate = $8,
+			unmatched_recipients = $9,
+			error = NULLIF($10, ''),
+			finished_ts = current_timestamp
+		WHERE id = $1
+	`
+	_, err = tx.ExecContext(ctx, q, id, status, res.Read, inserted, res.Skipped, res.Errored,
+		res.Contributors.Rate(), res.Recipients.Rate(), len(res.UnmatchedNames), message)
+	if err != nil {
+		return errors.Wrap(err, "recording import result")
+	}
+	const errorQ = `
+		INSERT INTO cfb_import_errors (import_id, row_number, refno, error)
+		VALUES ($1, $2, NULLIF($3, ''), $4)
+	`
+	for _, e := range res.Errors {
+		_, err = tx.ExecContext(ctx, errorQ, id, e.Row, e.RefNo, e.Err)
+		if err != nil {
+			return errors.Wrap(err, "recording row error")
+		}
+	}
+	err = tx.Commit()
+	return errors.Wrap(err, "committing import report")
+}
+
+// Reports returns up to limit of the latest import reports, most
+// recent first, with their row errors.
+func Reports(ctx context.Context, db *sql.DB, limit int) ([]Report, error) {
+	const q = `
+		SELECT
+			id,
+			file,
+			status,
+			rows_read,
+			rows_inserted,
+			rows_skipped,
+			rows_errored,
+			contributor_match_rate,
+			recipient_match_rate,
+			unmatched_recipients,
+			COALESCE(error, ''),
+			started_ts,
+			finished_ts
+		FROM cfb_imports
+		ORDER BY started_ts DESC, id DESC
+		LIMIT $1
+	`
+	rows, err := db.QueryContext(ctx, q, limit)
+	if err != nil {
+		return nil, errors.Wrap(err, "querying import reports")
+	}
+	defer rows.Close()
+	res := []Report{}
+	byID := make(map[string]*Report)
+	var ids []string
+	for rows.Next() {
+		var r Report
+		err := rows.Scan(&r.ID, &r.File, &r.Status, &r.Read, &r.Inserted, &r.Skipped, &r.Errored,
+			&r.ContributorMatchRate, &r.RecipientMatchRate, &r.UnmatchedRecipients, &r.Error,
+			&r.StartedTS, &r.FinishedTS)
+		if err != nil {
+			return nil, errors.Wrap(err, "scanning import report row")
+		}
+		r.Errors = []RowError{}
+		res = append(res, r)
+		ids = append(ids, r.ID)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, errors.Wrap(err, "reading import report rows")
+	}
+	for i := range res {
+		byID[res[i].ID] = &res[i]
+	}
+	if len(ids) == 0 {
+		return res, nil
+	}
+
+	const errorsQ = `
+		SELECT import_id, row_number, COALESCE(refno, ''), error
+		FROM cfb_import_errors
+		WHERE import_id = ANY($1)
+		ORDER BY import_id, row_number
+	`
+	rows, err = db.QueryContext(ctx, errorsQ, pq.StringArray(ids))
+	if err != nil {
+		return nil, errors.Wrap(err, "querying row errors")
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var (
+			id string
+			e  RowError
+		)
+		err := rows.Scan(&id, &e.Row, &e.RefNo, &e.Err)
+		if err != nil {
+			return nil, errors.Wrap(err, "scanning row error")
+		}
+		r := byID[id]
+		r.Errors = append(r.Errors, e)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, errors.Wrap(err, "reading row errors")
+	}
+	return res, nil
+}
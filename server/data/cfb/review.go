@@ -0,0 +1,77 @@
+package cfb
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/pkg/errors"
+)
+
+// UnmatchedRecipient is a recipient named in imported contributions
+// who matched no individual.
+type UnmatchedRecipient struct {
+	Name           string
+	CFBRecipientID string
+	// Contributions and Amount (in cents) are the contributions
+	// received under the name
+	Contributions int
+	Amount        int64
+	// Candidates are individuals with the same last name, who may be
+	// the recipient
+	Candidates []Candidate
+}
+
+// Candidate is an individual who may be an unmatched recipient.
+type Candidate struct {
+	ID      string
+	CFBName string
+}
+
+// UnmatchedRecipients returns the recipients of imported
+// contributions who matched no individual, most money received
+// first, for review. A recipient is matched by adding their CFB name
+// as an alias of the individual, or fixing the individual's name, and
+// importing again.
+func UnmatchedRecipients(ctx context.Context, db *sql.DB) ([]UnmatchedRecipient, error) {
+	const q = `
+		WITH unmatched AS (
+			SELECT recipient_name, cfb_recipient_id, count(*) AS n, sum(amount) AS amount
+			FROM contributions
+			WHERE recipient_id IS NULL
+			GROUP BY recipient_name, cfb_recipient_id
+		)
+		SELECT u.recipient_name, u.cfb_recipient_id, u.n, u.amount, i.id, i.cfb_name
+		FROM unmatched u
+		LEFT JOIN individuals i
+		ON lower(i.last_name) = lower(trim(split_part(u.recipient_name, ',', 1)))
+		ORDER BY u.amount DESC, u.recipient_name, u.cfb_recipient_id, i.cfb_name
+	`
+	rows, err := db.QueryContext(ctx, q)
+	if err != nil {
+		return nil, errors.Wrap(err, "querying unmatched recipients")
+	}
+	defer rows.Close()
+	var res []UnmatchedRecipient
+	for rows.Next() {
+		var (
+			u                UnmatchedRecipient
+			candidateID, cfb sql.NullString
+		)
+		err := rows.Scan(&u.Name, &u.CFBRecipientID, &u.Contributions, &u.Amount, &candidateID, &cfb)
+		if err != nil {
+			return nil, errors.Wrap(err, "scanning unmatched recipient row")
+		}
+		// Rows are ordered by recipient, one per candidate
+		if n := len(res); n == 0 || res[n-1].Name != u.Name || res[n-1].CFBRecipientID != u.CFBRecipientID {
+			res = append(res, u)
+		}
+		if candidateID.Valid {
+			last := &res[len(res)-1]
+			last.Candidates = append(last.Candidates, Candidate{ID: candidateID.String, CFBName: cfb.String})
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, errors.Wrap(err, "reading unmatched recipient rows")
+	}
+	return res, nil
+}
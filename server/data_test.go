@@ -0,0 +1,70 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/vickiniu/project-red-string/data/cfb"
+	"github.com/vickiniu/project-red-string/internal/testdb"
+	"github.com/vickiniu/project-red-string/jobs"
+	"github.com/vickiniu/project-red-string/logging"
+)
+
+func TestMain(m *testing.M) {
+	logging.Default = logging.New(ioutil.Discard, logging.LevelError)
+	os.Exit(testdb.Run(m))
+}
+
+func TestImportCFBDir(t *testing.T) {
+	db, cleanup := testdb.New(t)
+	defer cleanup()
+	testdb.LoadFixtures(t, db)
+	ctx := context.Background()
+
+	dir, err := ioutil.TempDir("", "redstring-cfb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	sample, err := ioutil.ReadFile(testdb.Path("CFB_sample.csv"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The older export has a row that can't be imported
+	bad := strings.Replace(string(sample), "4/15/2020", "April 15", 1)
+	err = ioutil.WriteFile(filepath.Join(dir, "CFB_1.csv"), []byte(bad), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(filepath.Join(dir, "CFB_2.csv"), sample, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The bad export doesn't hold up the newer one
+	err = importCFBDir(ctx, db, dir, cfb.Options{})
+	if err == nil || !strings.Contains(err.Error(), "CFB_1.csv") {
+		t.Errorf("got error %v, want CFB_1.csv to have failed", err)
+	}
+	ok, err := jobs.Succeeded(ctx, db, jobImportCFB, "CFB_2.csv")
+	if err != nil || !ok {
+		t.Errorf("got %v, %v for CFB_2.csv, want it imported", ok, err)
+	}
+
+	// Nor is it tried again
+	err = importCFBDir(ctx, db, dir, cfb.Options{})
+	if err != nil {
+		t.Errorf("got error %v importing again, want the bad export skipped", err)
+	}
+	runs, err := jobs.History(ctx, db, jobImportCFB, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(runs) != 2 {
+		t.Errorf("got runs %+v, want one of each export", runs)
+	}
+}
@@ -0,0 +1,32 @@
+// Package dataversion tracks a counter that's bumped whenever the
+// data served by the API changes, so servers can tell when their
+// cached responses are stale.
+//
+// Commands that change data, such as the importers, call Bump when
+// they're done, ideally within their transaction so the version
+// changes exactly when the data does.
+package dataversion
+
+import (
+	"context"
+
+	"github.com/pkg/errors"
+	"github.com/vickiniu/project-red-string/internal/sqlutil"
+)
+
+// Bump increments the data version.
+func Bump(ctx context.Context, db sqlutil.Querier) error {
+	const q = `
+		UPDATE data_version
+		SET version = version + 1, updated_ts = current_timestamp
+	`
+	_, err := db.ExecContext(ctx, q)
+	return errors.Wrap(err, "bumping data version")
+}
+
+// Get returns the current data version.
+func Get(ctx context.Context, db sqlutil.Querier) (int64, error) {
+	var v int64
+	err := db.QueryRowContext(ctx, `SELECT version FROM data_version`).Scan(&v)
+	return v, errors.Wrap(err, "getting data version")
+}
@@ -5,4 +5,5 @@ go 1.13
 require (
 	github.com/lib/pq v1.8.0
 	github.com/pkg/errors v0.9.1
+	gopkg.in/yaml.v2 v2.4.0
 )
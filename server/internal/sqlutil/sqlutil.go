@@ -0,0 +1,38 @@
+// Package sqlutil holds the helpers shared by the packages that read
+// and write the database.
+package sqlutil
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+// Querier runs queries; *sql.DB, *sql.Tx and *sql.Conn all satisfy
+// it, so functions taking one can run in or out of a transaction.
+type Querier interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+}
+
+// NullString stores empty strings as NULL.
+func NullString(s string) sql.NullString {
+	return sql.NullString{String: s, Valid: s != ""}
+}
+
+// FormatDate formats a date column's value as YYYY-MM-DD, or returns
+// "" if it's unknown.
+func FormatDate(t *time.Time) string {
+	if t == nil {
+		return ""
+	}
+	return t.Format("2006-01-02")
+}
+
+// CFBName formats a name the way CFB filings do, "Last, First", as
+// stored in cfb_name.
+func CFBName(first, last string) string {
+	return fmt.Sprintf("%s, %s", last, first)
+}
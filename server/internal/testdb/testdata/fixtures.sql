@@ -0,0 +1,34 @@
+-- Fixture dataset for integration tests; see testdb.LoadFixtures.
+
+INSERT INTO sources (id, source_type, note, added_by, added_ts) VALUES
+    ('1000', 'manual', 'test fixtures', 'tests', '2020-11-01');
+
+INSERT INTO individuals (id, first_name, last_name, cfb_name, updated_ts, role, title, source_urls, source_id) VALUES
+    ('1001', 'Jane', 'Doe', 'Doe, Jane', '2020-11-01', 'Council Member', 'District 3', '{https://example.com/jane}', '1000'),
+    ('1002', 'John', 'Smith', 'Smith, John', '2020-11-01', NULL, NULL, '{}', '1000');
+
+INSERT INTO categories (id, description) VALUES
+    ('1020', 'Community Boards');
+
+INSERT INTO associations (id, description, category_id, source_id) VALUES
+    ('1010', 'Community Board 3', '1020', '1000'),
+    ('1011', 'Tenants Union', NULL, '1000'),
+    ('1012', 'Block Association', NULL, '1000');
+
+INSERT INTO association_categories (association_id, category_id, updated_ts) VALUES
+    ('1010', '1020', '2020-11-01');
+
+INSERT INTO individual_associations (individual_id, association_id, updated_ts, source_id, start_date, end_date) VALUES
+    ('1001', '1010', '2020-11-01', '1000', '2015-01-01', '2017-12-31'),
+    ('1001', '1011', '2020-11-01', '1000', NULL, NULL),
+    ('1002', '1011', '2020-11-01', '1000', NULL, NULL);
+
+INSERT INTO individual_roles (id, individual_id, role, title, start_date, end_date, source_id, updated_ts) VALUES
+    ('1030', '1001', 'Council Member', 'District 3', '2018-01-01', NULL, '1000', '2020-11-01');
+
+INSERT INTO contributions (id, refno, amount, date, contributor_name, contributor_id, recipient_name, recipient_id, cfb_recipient_id, election, city, state, zip) VALUES
+    ('1040', 'R1', 10000, '2016-06-01', 'Smith, John', '1002', 'Doe, Jane', '1001', 'C1', '2017', 'New York', 'NY', '10001'),
+    ('1041', 'R2', 25000, '2019-03-01', 'Smith, John', '1002', 'Doe, Jane', '1001', 'C1', '2021', 'New York', 'NY', '10001'),
+    ('1042', 'R3', 5000, '2019-05-01', 'Doe, Jane', '1001', 'Friends of Someone', NULL, 'C2', '2021', 'New York', 'NY', '10002');
+
+SELECT setval('next_id', 2000);
@@ -0,0 +1,236 @@
+// Package testdb provides Postgres databases for integration tests.
+//
+// Each test gets a new database with schema.sql applied, created on
+// the server at TEST_DATABASE_URL if it's set, or else on a throwaway
+// server started from the initdb and pg_ctl binaries on the PATH (or
+// in /usr/lib/postgresql/*/bin). Tests are skipped if neither is
+// available, unless CI is set, when they fail instead. Packages using
+// it run their tests with Run:
+//
+//	func TestMain(m *testing.M) {
+//		os.Exit(testdb.Run(m))
+//	}
+package testdb
+
+import (
+	"database/sql"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	_ "github.com/lib/pq" // Postgres driver
+)
+
+var (
+	startOnce sync.Once
+	// serverURL connects to the server's maintenance database, or
+	// is empty if there's no server
+	serverURL string
+	// skipReason is why there's no server
+	skipReason string
+	// tempDir holds the throwaway server's data, if it was started
+	tempDir string
+	// created counts the databases created, to name them
+	created int64
+)
+
+// Run runs the tests, then stops the throwaway server if one was
+// started. It returns the exit code for os.Exit.
+func Run(m *testing.M) int {
+	code := m.Run()
+	if tempDir != "" {
+		stop()
+	}
+	return code
+}
+
+// New returns a connection to a new database with the schema
+// applied, and a function dropping it. It skips the test if there's
+// no Postgres server.
+func New(t *testing.T) (*sql.DB, func()) {
+	t.Helper()
+	db, cleanup := NewEmpty(t)
+	err := execFile(db, filepath.Join(repoRoot(), "schema.sql"))
+	if err != nil {
+		cleanup()
+		t.Fatalf("applying schema: %v", err)
+	}
+	return db, cleanup
+}
+
+// NewEmpty is like New, but returns an empty database, for testing
+// migrations.
+func NewEmpty(t *testing.T) (*sql.DB, func()) {
+	t.Helper()
+	startOnce.Do(start)
+	if serverURL == "" && os.Getenv("CI") != "" {
+		t.Fatal(skipReason)
+	} else if serverURL == "" {
+		t.Skip(skipReason)
+	}
+
+	admin, err := sql.Open("postgres", serverURL)
+	if err != nil {
+		t.Fatalf("connecting to test server: %v", err)
+	}
+	name := fmt.Sprintf("redstring_test_%d_%d", os.Getpid(), atomic.AddInt64(&created, 1))
+	_, err = admin.Exec("CREATE DATABASE " + name)
+	if err != nil {
+		admin.Close()
+		t.Fatalf("creating test database: %v", err)
+	}
+	drop := func() {
+		admin.Exec("DROP DATABASE IF EXISTS " + name)
+		admin.Close()
+	}
+
+	db, err := sql.Open("postgres", withDatabase(serverURL, name))
+	if err != nil {
+		drop()
+		t.Fatalf("connecting to test database: %v", err)
+	}
+	return db, func() {
+		db.Close()
+		drop()
+	}
+}
+
+// LoadFixtures loads the fixture dataset in testdata/fixtures.sql:
+//
+//   - Jane Doe (1001), a council member since 2018 who was on
+//     Community Board 3 (1010) from 2015 to 2017 and is in the
+//     Tenants Union (1011)
+//   - John Smith (1002), also in the Tenants Union, who gave to Jane
+//     in 2016 and 2019 (contributions R1 and R2)
+//   - Community Boards (1020), a category of Community Board 3;
+//     nobody is in the Block Association (1012)
+//   - Jane's contribution R3 to an unmatched recipient
+//
+// IDs of rows created by tests start at 2000.
+func LoadFixtures(t *testing.T, db *sql.DB) {
+	t.Helper()
+	err := execFile(db, Path("fixtures.sql"))
+	if err != nil {
+		t.Fatalf("loading fixtures: %v", err)
+	}
+}
+
+// Path returns the path of a file in testdata, such as the sample
+// CFB export CFB_sample.csv.
+func Path(name string) string {
+	_, file, _, _ := runtime.Caller(0)
+	return filepath.Join(filepath.Dir(file), "testdata", name)
+}
+
+// repoRoot returns the root of the repository, where schema.sql is.
+func repoRoot() string {
+	_, file, _, _ := runtime.Caller(0)
+	return filepath.Join(filepath.Dir(file), "..", "..", "..")
+}
+
+func execFile(db *sql.DB, path string) error {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	_, err = db.Exec(string(b))
+	return err
+}
+
+// withDatabase returns the connection string connecting to the named
+// database instead.
+func withDatabase(conn, name string) string {
+	if strings.HasPrefix(conn, "postgres://") || strings.HasPrefix(conn, "postgresql://") {
+		u, err := url.Parse(conn)
+		if err == nil {
+			u.Path = "/" + name
+			return u.String()
+		}
+	}
+	// Later keys override earlier ones
+	return conn + " dbname=" + name
+}
+
+// start finds a server to create test databases on.
+func start() {
+	// Not DATABASE_URL, so tests can't be pointed at the production
+	// database by accident
+	if u := os.Getenv("TEST_DATABASE_URL"); u != "" {
+		serverURL = u
+		return
+	}
+	initdb, pgctl := findBinary("initdb"), findBinary("pg_ctl")
+	if initdb == "" || pgctl == "" {
+		skipReason = "no Postgres available: set TEST_DATABASE_URL or install Postgres"
+		return
+	}
+	dir, err := ioutil.TempDir("", "redstring-pg")
+	if err != nil {
+		skipReason = fmt.Sprintf("creating Postgres data directory: %v", err)
+		return
+	}
+	data := filepath.Join(dir, "data")
+	out, err := exec.Command(initdb, "-D", data, "-U", "postgres", "-A", "trust", "--no-sync").CombinedOutput()
+	if err != nil {
+		os.RemoveAll(dir)
+		skipReason = fmt.Sprintf("initdb failed: %v: %s", err, out)
+		return
+	}
+	// Listen only on a socket in the data directory, so the server
+	// can't clash with another
+	out, err = exec.Command(pgctl, "start", "-w", "-D", data, "-l", filepath.Join(dir, "log"),
+		"-o", fmt.Sprintf("-k %s -c listen_addresses='' -F", dir)).CombinedOutput()
+	if err != nil {
+		os.RemoveAll(dir)
+		skipReason = fmt.Sprintf("starting Postgres failed: %v: %s", err, out)
+		return
+	}
+	tempDir = dir
+	serverURL = fmt.Sprintf("host=%s user=postgres dbname=postgres sslmode=disable", dir)
+
+	// Make sure it's accepting connections
+	db, err := sql.Open("postgres", serverURL)
+	if err == nil {
+		for i := 0; i < 50; i++ {
+			if err = db.Ping(); err == nil {
+				break
+			}
+			time.Sleep(100 * time.Millisecond)
+		}
+		db.Close()
+	}
+	if err != nil {
+		stop()
+		serverURL = ""
+		skipReason = fmt.Sprintf("connecting to Postgres: %v", err)
+	}
+}
+
+// stop stops the throwaway server and deletes its data.
+func stop() {
+	exec.Command(findBinary("pg_ctl"), "stop", "-D", filepath.Join(tempDir, "data"), "-m", "immediate").Run()
+	os.RemoveAll(tempDir)
+	tempDir = ""
+}
+
+// findBinary returns the path of a Postgres binary, or "".
+func findBinary(name string) string {
+	if path, err := exec.LookPath(name); err == nil {
+		return path
+	}
+	// Debian and Ubuntu don't put the server binaries on the PATH
+	matches, _ := filepath.Glob(filepath.Join("/usr/lib/postgresql/*/bin", name))
+	if len(matches) > 0 {
+		return matches[len(matches)-1]
+	}
+	return ""
+}
@@ -0,0 +1,217 @@
+// Package jobs runs background jobs, such as imports, and records
+// their history in job_runs.
+//
+// Each run of a job takes a Postgres advisory lock named after the
+// job, so a job never runs twice at once, whether it's run by the
+// scheduler of one of several servers or from the command line.
+package jobs
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"hash/fnv"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Run statuses
+const (
+	StatusRunning   = "running"
+	StatusSucceeded = "succeeded"
+	StatusFailed    = "failed"
+)
+
+// ErrLocked is returned by Run when the job is already running.
+var ErrLocked = errors.New("job is already running")
+
+// Counts are the numbers of rows a run read or changed, by name,
+// e.g. "inserted".
+type Counts map[string]int
+
+// RunRecord is a row of job_runs.
+type RunRecord struct {
+	ID  string `json:"id"`
+	Job string `json:"job"`
+	// Target is what the run worked on, e.g. the file imported, if
+	// anything in particular
+	Target string `json:"target,omitempty"`
+	// Checksum is the SHA-256 of the file the run worked on, if any
+	Checksum   string     `json:"checksum,omitempty"`
+	Status     string     `json:"status"`
+	Counts     Counts     `json:"counts"`
+	Error      string     `json:"error,omitempty"`
+	StartedTS  time.Time  `json:"started_ts"`
+	FinishedTS *time.Time `json:"finished_ts"`
+}
+
+// Run runs fn as a run of the named job, recording it in job_runs
+// with its counts and any error. It returns ErrLocked without
+// running fn if the job is already running.
+func Run(ctx context.Context, db *sql.DB, job, target string, fn func(ctx context.Context) (Counts, error)) error {
+	return RunChecksum(ctx, db, job, target, "", fn)
+}
+
+// RunChecksum is like Run, also recording the checksum of the
+// target's contents, so that FailedChecksum can tell whether the same
+// contents have failed before.
+func RunChecksum(ctx context.Context, db *sql.DB, job, target, checksum string, fn func(ctx context.Context) (Counts, error)) error {
+	// Session advisory locks belong to a connection, so the lock is
+	// taken and released on one set aside for it
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return errors.Wrap(err, "getting connection for lock")
+	}
+	defer conn.Close()
+	key := lockKey(job)
+	var locked bool
+	err = conn.QueryRowContext(ctx, `SELECT pg_try_advisory_lock($1)`, key).Scan(&locked)
+	if err != nil {
+		return errors.Wrap(err, "taking job lock")
+	}
+	if !locked {
+		return ErrLocked
+	}
+	defer conn.ExecContext(context.Background(), `SELECT pg_advisory_unlock($1)`, key)
+
+	// Nothing else is running the job, so runs still marked running
+	// were interrupted, e.g. by a server being killed
+	const interruptedQ = `
+		UPDATE job_runs
+		SET status = $2, error = 'interrupted', finished_ts = current_timestamp
+		WHERE job = $1 AND status = $3
+	`
+	_, err = db.ExecContext(ctx, interruptedQ, job, StatusFailed, StatusRunning)
+	if err != nil {
+		return errors.Wrap(err, "marking interrupted runs")
+	}
+	const startQ = `
+		INSERT INTO job_runs (job, target, checksum, status, counts, started_ts)
+		VALUES ($1, NULLIF($2, ''), NULLIF($3, ''), $4, '{}', current_timestamp)
+		RETURNING id
+	`
+	var id string
+	err = db.QueryRowContext(ctx, startQ, job, target, checksum, StatusRunning).Scan(&id)
+	if err != nil {
+		return errors.Wrap(err, "recording job start")
+	}
+
+	counts, runErr := call(ctx, fn)
+	status, message := StatusSucceeded, ""
+	if runErr != nil {
+		status, message = StatusFailed, runErr.Error()
+		if ctx.Err() != nil {
+			// Stopped, e.g. by the server shutting down, rather
+			// than failed
+			message = "interrupted"
+		}
+	}
+	if counts == nil {
+		counts = Counts{}
+	}
+	b, err := json.Marshal(counts)
+	if err != nil {
+		return errors.Wrap(err, "marshaling counts")
+	}
+	const finishQ = `
+		UPDATE job_runs
+		SET status = $2, counts = $3, error = NULLIF($4, ''), finished_ts = current_timestamp
+		WHERE id = $1
+	`
+	// Record the result even if the run was canceled
+	_, err = db.ExecContext(context.Background(), finishQ, id, status, string(b), message)
+	if err != nil {
+		return errors.Wrap(err, "recording job result")
+	}
+	return runErr
+}
+
+// call calls fn, returning a panic as an error so the run is recorded
+// as failed rather than left running.
+func call(ctx context.Context, fn func(ctx context.Context) (Counts, error)) (counts Counts, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = errors.Errorf("panic: %v", r)
+		}
+	}()
+	return fn(ctx)
+}
+
+// lockKey returns the advisory lock key of a job.
+func lockKey(job string) int64 {
+	h := fnv.New64a()
+	h.Write([]byte("redstring job " + job))
+	return int64(h.Sum64())
+}
+
+// Succeeded reports whether a run of the job on the target has
+// succeeded.
+func Succeeded(ctx context.Context, db *sql.DB, job, target string) (bool, error) {
+	const q = `
+		SELECT EXISTS (
+			SELECT 1 FROM job_runs WHERE job = $1 AND target = $2 AND status = $3
+		)
+	`
+	var ok bool
+	err := db.QueryRowContext(ctx, q, job, target, StatusSucceeded).Scan(&ok)
+	if err != nil {
+		return false, errors.Wrap(err, "querying job runs")
+	}
+	return ok, nil
+}
+
+// FailedChecksum reports whether a run of the job on contents with
+// the checksum has failed, other than by being interrupted, and none
+// has succeeded.
+func FailedChecksum(ctx context.Context, db *sql.DB, job, checksum string) (bool, error) {
+	const q = `
+		SELECT
+			bool_or(status = $3 AND error IS DISTINCT FROM 'interrupted') AND NOT bool_or(status = $4)
+		FROM job_runs
+		WHERE job = $1 AND checksum = $2
+	`
+	var failed sql.NullBool
+	err := db.QueryRowContext(ctx, q, job, checksum, StatusFailed, StatusSucceeded).Scan(&failed)
+	if err != nil {
+		return false, errors.Wrap(err, "querying job runs")
+	}
+	return failed.Bool, nil
+}
+
+// History returns up to limit of the latest runs, of the named job
+// or of every job if job is empty, most recent first.
+func History(ctx context.Context, db *sql.DB, job string, limit int) ([]RunRecord, error) {
+	const q = `
+		SELECT id, job, COALESCE(target, ''), COALESCE(checksum, ''), status, counts, COALESCE(error, ''), started_ts, finished_ts
+		FROM job_runs
+		WHERE $1 = '' OR job = $1
+		ORDER BY started_ts DESC, id DESC
+		LIMIT $2
+	`
+	rows, err := db.QueryContext(ctx, q, job, limit)
+	if err != nil {
+		return nil, errors.Wrap(err, "querying job runs")
+	}
+	defer rows.Close()
+	res := []RunRecord{}
+	for rows.Next() {
+		var (
+			r      RunRecord
+			counts []byte
+		)
+		err := rows.Scan(&r.ID, &r.Job, &r.Target, &r.Checksum, &r.Status, &counts, &r.Error, &r.StartedTS, &r.FinishedTS)
+		if err != nil {
+			return nil, errors.Wrap(err, "scanning job run row")
+		}
+		err = json.Unmarshal(counts, &r.Counts)
+		if err != nil {
+			return nil, errors.Wrap(err, "unmarshaling counts")
+		}
+		res = append(res, r)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, errors.Wrap(err, "reading job run rows")
+	}
+	return res, nil
+}
@@ -0,0 +1,207 @@
+package jobs
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/vickiniu/project-red-string/internal/testdb"
+	"github.com/vickiniu/project-red-string/logging"
+)
+
+func TestMain(m *testing.M) {
+	logging.Default = logging.New(ioutil.Discard, logging.LevelError)
+	os.Exit(testdb.Run(m))
+}
+
+func TestRun(t *testing.T) {
+	db, cleanup := testdb.New(t)
+	defer cleanup()
+	ctx := context.Background()
+
+	err := Run(ctx, db, "import", "a.csv", func(ctx context.Context) (Counts, error) {
+		return Counts{"inserted": 3}, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	failure := errors.New("bad row")
+	err = Run(ctx, db, "import", "b.csv", func(ctx context.Context) (Counts, error) {
+		return nil, failure
+	})
+	if err != failure {
+		t.Fatalf("got error %v, want %v", err, failure)
+	}
+
+	// A run holding the lock keeps others from running
+	err = Run(ctx, db, "import", "c.csv", func(ctx context.Context) (Counts, error) {
+		err := Run(ctx, db, "import", "d.csv", func(ctx context.Context) (Counts, error) {
+			t.Error("ran while locked")
+			return nil, nil
+		})
+		if err != ErrLocked {
+			t.Errorf("got error %v running while locked, want ErrLocked", err)
+		}
+		// Other jobs can run
+		return nil, Run(ctx, db, "sync", "", func(ctx context.Context) (Counts, error) {
+			return nil, nil
+		})
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ok, err := Succeeded(ctx, db, "import", "a.csv")
+	if err != nil || !ok {
+		t.Errorf("got %v, %v for a.csv, want it to have succeeded", ok, err)
+	}
+	ok, err = Succeeded(ctx, db, "import", "b.csv")
+	if err != nil || ok {
+		t.Errorf("got %v, %v for b.csv, want it to have failed", ok, err)
+	}
+
+	runs, err := History(ctx, db, "import", 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(runs) != 3 {
+		t.Fatalf("got %d import runs, want 3", len(runs))
+	}
+	c, b, a := runs[0], runs[1], runs[2]
+	if a.Target != "a.csv" || a.Status != StatusSucceeded || a.Counts["inserted"] != 3 || a.FinishedTS == nil {
+		t.Errorf("got %+v, want a.csv to have succeeded inserting 3", a)
+	}
+	if b.Status != StatusFailed || b.Error != "bad row" {
+		t.Errorf("got %+v, want b.csv to have failed", b)
+	}
+	if c.Target != "c.csv" || c.Status != StatusSucceeded {
+		t.Errorf("got %+v, want c.csv to have succeeded", c)
+	}
+	runs, err = History(ctx, db, "", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(runs) != 1 || runs[0].Job != "sync" {
+		t.Errorf("got %+v, want the sync run, the latest to start", runs)
+	}
+}
+
+func TestFailedChecksum(t *testing.T) {
+	db, cleanup := testdb.New(t)
+	defer cleanup()
+	ctx := context.Background()
+
+	failed := func(checksum string) bool {
+		t.Helper()
+		ok, err := FailedChecksum(ctx, db, "import", checksum)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return ok
+	}
+	run := func(ctx context.Context, target, checksum string, err error) {
+		t.Helper()
+		RunChecksum(ctx, db, "import", target, checksum, func(ctx context.Context) (Counts, error) {
+			return nil, err
+		})
+	}
+
+	run(ctx, "a.csv", "aaaa", errors.New("bad row"))
+	if !failed("aaaa") {
+		t.Error("got a.csv's contents not failed, want failed")
+	}
+	if failed("bbbb") {
+		t.Error("got unknown contents failed")
+	}
+	// The same contents under another name succeeding clears them
+	run(ctx, "a2.csv", "aaaa", nil)
+	if failed("aaaa") {
+		t.Error("got a.csv's contents failed after succeeding")
+	}
+
+	// Runs that were stopped rather than failing don't count
+	stopped, cancel := context.WithCancel(ctx)
+	RunChecksum(stopped, db, "import", "c.csv", "cccc", func(ctx context.Context) (Counts, error) {
+		cancel()
+		return nil, ctx.Err()
+	})
+	if failed("cccc") {
+		t.Error("got an interrupted run's contents failed")
+	}
+	runs, err := History(ctx, db, "import", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(runs) != 1 || runs[0].Checksum != "cccc" || runs[0].Error != "interrupted" {
+		t.Errorf("got %+v, want c.csv interrupted", runs)
+	}
+}
+
+func TestRunPanic(t *testing.T) {
+	db, cleanup := testdb.New(t)
+	defer cleanup()
+	ctx := context.Background()
+
+	err := Run(ctx, db, "import", "bad.csv", func(ctx context.Context) (Counts, error) {
+		panic("index out of range")
+	})
+	if err == nil {
+		t.Fatal("got no error from a run that panicked")
+	}
+	runs, err := History(ctx, db, "import", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(runs) != 1 || runs[0].Status != StatusFailed || runs[0].Error != "panic: index out of range" {
+		t.Errorf("got %+v, want the run recorded as failed", runs)
+	}
+}
+
+func TestScheduler(t *testing.T) {
+	var runs int32
+	ctx, cancel := context.WithCancel(context.Background())
+	s := NewScheduler(Job{
+		Name:     "test",
+		Interval: 10 * time.Millisecond,
+		Func: func(ctx context.Context) error {
+			atomic.AddInt32(&runs, 1)
+			return ErrLocked
+		},
+	})
+	s.Start(ctx)
+	time.Sleep(55 * time.Millisecond)
+	cancel()
+	s.Wait()
+	n := atomic.LoadInt32(&runs)
+	if n < 2 {
+		t.Errorf("got %d runs, want several", n)
+	}
+	time.Sleep(20 * time.Millisecond)
+	if after := atomic.LoadInt32(&runs); after != n {
+		t.Errorf("got %d runs after stopping, want %d", after, n)
+	}
+}
+
+func TestSchedulerPanic(t *testing.T) {
+	var runs int32
+	ctx, cancel := context.WithCancel(context.Background())
+	s := NewScheduler(Job{
+		Name:     "test",
+		Interval: 10 * time.Millisecond,
+		Func: func(ctx context.Context) error {
+			atomic.AddInt32(&runs, 1)
+			panic("index out of range")
+		},
+	})
+	s.Start(ctx)
+	time.Sleep(35 * time.Millisecond)
+	cancel()
+	s.Wait()
+	if n := atomic.LoadInt32(&runs); n < 2 {
+		t.Errorf("got %d runs, want the job run again after panicking", n)
+	}
+}
@@ -0,0 +1,85 @@
+package jobs
+
+import (
+	"context"
+	"fmt"
+	"runtime/debug"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/vickiniu/project-red-string/logging"
+)
+
+// Job is a job run periodically by a Scheduler.
+type Job struct {
+	Name     string
+	Interval time.Duration
+	// Func runs the job, recording its runs with Run. It returns
+	// ErrLocked if the job is already running elsewhere.
+	Func func(ctx context.Context) error
+}
+
+// Scheduler runs jobs at their intervals, starting as soon as it's
+// started. Failed runs are logged and retried at the next interval.
+type Scheduler struct {
+	jobs []Job
+	wg   sync.WaitGroup
+}
+
+// NewScheduler returns a Scheduler running the jobs.
+func NewScheduler(jobs ...Job) *Scheduler {
+	return &Scheduler{jobs: jobs}
+}
+
+// Start starts running the jobs in the background, until ctx is
+// canceled.
+func (s *Scheduler) Start(ctx context.Context) {
+	for _, j := range s.jobs {
+		logging.Info(ctx, "scheduling job", "job", j.Name, "interval", j.Interval.String())
+		s.wg.Add(1)
+		go s.loop(ctx, j)
+	}
+}
+
+// Wait waits for the jobs to stop after the context passed to Start
+// is canceled.
+func (s *Scheduler) Wait() {
+	s.wg.Wait()
+}
+
+func (s *Scheduler) loop(ctx context.Context, j Job) {
+	defer s.wg.Done()
+	t := time.NewTicker(j.Interval)
+	defer t.Stop()
+	for {
+		s.run(ctx, j)
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+	}
+}
+
+func (s *Scheduler) run(ctx context.Context, j Job) {
+	start := time.Now()
+	// A panicking job mustn't take the server down with it
+	defer func() {
+		if r := recover(); r != nil {
+			logging.Error(ctx, "job panicked", "job", j.Name, "panic", fmt.Sprint(r),
+				"stack", string(debug.Stack()), "duration", time.Since(start).String())
+		}
+	}()
+	err := j.Func(ctx)
+	switch {
+	case errors.Cause(err) == ErrLocked:
+		logging.Info(ctx, "job already running, skipping", "job", j.Name)
+	case err != nil && ctx.Err() != nil:
+		logging.Warn(ctx, "job canceled", "job", j.Name, "error", err)
+	case err != nil:
+		logging.Error(ctx, "job failed", "job", j.Name, "error", err, "duration", time.Since(start).String())
+	default:
+		logging.Info(ctx, "job finished", "job", j.Name, "duration", time.Since(start).String())
+	}
+}
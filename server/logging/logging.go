@@ -0,0 +1,185 @@
+// Package logging writes leveled, structured logs as JSON lines.
+//
+// Each entry has a timestamp, level and message, the ID of the
+// request it was logged for if any, and any other fields given as
+// alternating keys and values:
+//
+//	logging.Info(ctx, "request", "status", 200, "duration_ms", 12)
+//
+// writes
+//
+//	{"ts":"2020-11-16T12:00:00Z","level":"info","msg":"request","request_id":"1f2e...","status":200,"duration_ms":12}
+package logging
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Level is the severity of a log entry.
+type Level int
+
+// Levels, least severe first.
+const (
+	LevelDebug Level = iota
+	LevelInfo
+	LevelWarn
+	LevelError
+)
+
+var levelNames = []string{"debug", "info", "warn", "error"}
+
+func (l Level) String() string {
+	if l < LevelDebug || l > LevelError {
+		return fmt.Sprintf("level(%d)", int(l))
+	}
+	return levelNames[l]
+}
+
+// ParseLevel parses a level name such as "info".
+func ParseLevel(s string) (Level, error) {
+	for i, name := range levelNames {
+		if strings.EqualFold(s, name) {
+			return Level(i), nil
+		}
+	}
+	return LevelInfo, fmt.Errorf("unknown log level %q", s)
+}
+
+// Logger writes entries at or above its level to w.
+type Logger struct {
+	mu    sync.Mutex
+	w     io.Writer
+	level Level
+	now   func() time.Time
+}
+
+// New returns a Logger writing entries at or above level to w.
+func New(w io.Writer, level Level) *Logger {
+	return &Logger{w: w, level: level, now: time.Now}
+}
+
+// SetLevel sets the minimum level of entries written.
+func (l *Logger) SetLevel(level Level) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.level = level
+}
+
+// Enabled reports whether entries at level are written.
+func (l *Logger) Enabled(level Level) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return level >= l.level
+}
+
+// Log writes an entry. kv are alternating keys and values; values
+// that are errors are written as their message.
+func (l *Logger) Log(ctx context.Context, level Level, msg string, kv ...interface{}) {
+	if !l.Enabled(level) {
+		return
+	}
+	var b bytes.Buffer
+	b.WriteByte('{')
+	writeField(&b, "ts", l.now().UTC().Format(time.RFC3339Nano))
+	b.WriteByte(',')
+	writeField(&b, "level", level.String())
+	b.WriteByte(',')
+	writeField(&b, "msg", msg)
+	if id := RequestID(ctx); id != "" {
+		b.WriteByte(',')
+		writeField(&b, "request_id", id)
+	}
+	for i := 0; i < len(kv); i += 2 {
+		key := fmt.Sprint(kv[i])
+		var v interface{} = "(missing)"
+		if i+1 < len(kv) {
+			v = kv[i+1]
+		}
+		b.WriteByte(',')
+		writeField(&b, key, v)
+	}
+	b.WriteString("}\n")
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.w.Write(b.Bytes())
+}
+
+func writeField(b *bytes.Buffer, key string, v interface{}) {
+	if err, ok := v.(error); ok {
+		v = err.Error()
+	}
+	k, _ := json.Marshal(key)
+	b.Write(k)
+	b.WriteByte(':')
+	j, err := json.Marshal(v)
+	if err != nil {
+		j, _ = json.Marshal(fmt.Sprint(v))
+	}
+	b.Write(j)
+}
+
+// Writer returns an io.Writer logging each write as an entry at
+// level, for use with the standard library's log package.
+func (l *Logger) Writer(level Level) io.Writer {
+	return writer{l: l, level: level}
+}
+
+type writer struct {
+	l     *Logger
+	level Level
+}
+
+func (w writer) Write(p []byte) (int, error) {
+	w.l.Log(context.Background(), w.level, strings.TrimSuffix(string(p), "\n"))
+	return len(p), nil
+}
+
+// Default is the logger used by the package-level functions. It
+// logs at info level to stderr.
+var Default = New(os.Stderr, LevelInfo)
+
+// Debug logs to Default at debug level.
+func Debug(ctx context.Context, msg string, kv ...interface{}) {
+	Default.Log(ctx, LevelDebug, msg, kv...)
+}
+
+// Info logs to Default at info level.
+func Info(ctx context.Context, msg string, kv ...interface{}) {
+	Default.Log(ctx, LevelInfo, msg, kv...)
+}
+
+// Warn logs to Default at warn level.
+func Warn(ctx context.Context, msg string, kv ...interface{}) {
+	Default.Log(ctx, LevelWarn, msg, kv...)
+}
+
+// Error logs to Default at error level.
+func Error(ctx context.Context, msg string, kv ...interface{}) {
+	Default.Log(ctx, LevelError, msg, kv...)
+}
+
+type requestIDKey struct{}
+
+// WithRequestID returns a context carrying the request ID, which is
+// added to every entry logged with it.
+func WithRequestID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, requestIDKey{}, id)
+}
+
+// RequestID returns the context's request ID, or "".
+func RequestID(ctx context.Context) string {
+	if ctx == nil {
+		return ""
+	}
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
@@ -1,38 +1,299 @@
 package main
 
 import (
+	"context"
 	"database/sql"
+	"flag"
+	"fmt"
 	"log"
 	"net/http"
 	"os"
+	"os/signal"
+	"strconv"
+	"syscall"
+	"time"
 
+	"github.com/pkg/errors"
 	"github.com/vickiniu/project-red-string/api"
+	"github.com/vickiniu/project-red-string/config"
+	"github.com/vickiniu/project-red-string/jobs"
+	"github.com/vickiniu/project-red-string/logging"
+	"github.com/vickiniu/project-red-string/migrate"
 
 	_ "github.com/lib/pq"
 )
 
+// usage lists the subcommands; run with -h for the flags shared by
+// all of them.
+const usage = `usage: redstring [flags] COMMAND
+
+commands:
+  serve                      serve the API (the default)
+  migrate [up|down|status|repair]
+                             manage the database schema
+  users add NAME ROLE | users revoke NAME
+                             manage API users
+  import cfb [-unmatched-file FILE] FILE
+                             import contributions from a CFB export
+  fetch cfb                  download the CFB export from cfb-url and
+                             import it if it's changed
+  sync annotations [-master-file FILE [-categories-file FILE]]
+                             sync annotations from Airtable or files
+  match review               list CFB recipients that matched no one
+  export [-master-file FILE] [-categories-file FILE]
+                             export annotations as files sync can read`
+
+// commands are the subcommands, by name.
+var commands = map[string]func(ctx context.Context, cfg *config.Config, db *sql.DB, args []string){
+	"serve":   serve,
+	"migrate": runMigrate,
+	"users":   runUsers,
+	"import":  runImport,
+	"fetch":   runFetch,
+	"sync":    runSync,
+	"match":   runMatch,
+	"export":  runExport,
+}
+
 func main() {
-	// TODO(vicki): actually configure
-	port := envString("LISTEN", ":8080")
-	dbURL := envString("DATABASE_URL", "postgres:///redstring?sslmode=disable")
-	db, err := sql.Open("postgres", dbURL)
+	cfg, args, err := config.Load("redstring", os.Args[1:])
+	if err == flag.ErrHelp {
+		fmt.Fprintln(os.Stderr, usage)
+		os.Exit(2)
+	} else if err != nil {
+		log.Fatalf("error loading configuration: %v\n", err)
+	}
+	// Every command logs JSON, at the configured level and above
+	level, err := logging.ParseLevel(cfg.LogLevel)
 	if err != nil {
-		log.Fatalf("error opening database connection: %v\n", err)
+		log.Fatal(err)
+	}
+	logging.Default.SetLevel(level)
+	log.SetFlags(0)
+	log.SetOutput(logging.Default.Writer(logging.LevelInfo))
+
+	name := "serve"
+	if len(args) > 0 {
+		name, args = args[0], args[1:]
+	}
+	run, ok := commands[name]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "unknown command %q\n%s\n", name, usage)
+		os.Exit(2)
+	}
+
+	ctx := context.Background()
+	db, err := openDB(ctx, cfg)
+	if err != nil {
+		logging.Error(ctx, "error connecting to database", "error", err)
+		os.Exit(1)
+	}
+	defer db.Close()
+	run(ctx, cfg, db, args)
+}
+
+// openDB opens the database with the configured pool settings, and
+// waits for it to accept connections, retrying with backoff for up
+// to DBConnectTimeout so the server can start alongside it.
+func openDB(ctx context.Context, cfg *config.Config) (*sql.DB, error) {
+	db, err := sql.Open("postgres", cfg.DatabaseURL)
+	if err != nil {
+		return nil, errors.Wrap(err, "opening database connection")
+	}
+	db.SetMaxOpenConns(cfg.DBMaxOpenConns)
+	db.SetMaxIdleConns(cfg.DBMaxIdleConns)
+	db.SetConnMaxLifetime(cfg.DBConnMaxLifetime)
+
+	deadline := time.Now().Add(cfg.DBConnectTimeout)
+	wait := 500 * time.Millisecond
+	for {
+		pctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+		err = db.PingContext(pctx)
+		cancel()
+		if err == nil {
+			return db, nil
+		}
+		if time.Now().Add(wait).After(deadline) {
+			db.Close()
+			return nil, errors.Wrap(err, "pinging database")
+		}
+		logging.Warn(ctx, "database unavailable, retrying", "error", err, "retry_in", wait.String())
+		time.Sleep(wait)
+		if wait *= 2; wait > 10*time.Second {
+			wait = 10 * time.Second
+		}
 	}
+}
+
+// serve serves the API, and runs the scheduled jobs, until the server
+// is sent SIGTERM or SIGINT, then stops accepting connections and
+// waits for in-flight requests to finish.
+func serve(ctx context.Context, cfg *config.Config, db *sql.DB, args []string) {
+	if cfg.SchemaCheck != "off" {
+		err := migrate.Check(ctx, db)
+		if err != nil && cfg.SchemaCheck == "strict" {
+			logging.Error(ctx, "error checking schema", "error", err)
+			os.Exit(1)
+		} else if err != nil {
+			logging.Warn(ctx, "schema check failed", "error", err)
+		}
+	}
+
 	s := api.NewServer(db)
-	httpserver := http.Server{
-		Addr:    port,
-		Handler: s.API(),
+	s.AllowedOrigins = cfg.CORSOrigins
+	s.CacheMaxAge = cfg.CacheMaxAge
+	s.TrustedProxies = cfg.TrustedProxies
+	s.AnonymousLimit = api.RateLimit{
+		PerMinute: cfg.AnonymousRatePerMinute,
+		Daily:     cfg.AnonymousDailyQuota,
+	}
+	httpserver := &http.Server{
+		Addr:              cfg.Listen,
+		Handler:           s.API(),
+		ReadHeaderTimeout: cfg.ReadHeaderTimeout,
+		ReadTimeout:       cfg.ReadTimeout,
+		WriteTimeout:      cfg.WriteTimeout,
+		IdleTimeout:       cfg.IdleTimeout,
+		ErrorLog:          log.New(logging.Default.Writer(logging.LevelError), "", 0),
+	}
+
+	// Background jobs are stopped after in-flight requests finish
+	jobsCtx, stopJobs := context.WithCancel(ctx)
+	defer stopJobs()
+	scheduler := jobs.NewScheduler(scheduledJobs(cfg, db)...)
+	scheduler.Start(jobsCtx)
+
+	errc := make(chan error, 1)
+	go func() {
+		logging.Info(ctx, "starting server", "addr", httpserver.Addr)
+		errc <- httpserver.ListenAndServe()
+	}()
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, syscall.SIGTERM, os.Interrupt)
+	select {
+	case err := <-errc:
+		logging.Error(ctx, "server stopped", "error", err)
+		os.Exit(1)
+	case sig := <-stop:
+		logging.Info(ctx, "shutting down", "signal", sig.String(), "timeout", cfg.ShutdownTimeout.String())
+	}
+
+	sctx, cancel := context.WithTimeout(ctx, cfg.ShutdownTimeout)
+	defer cancel()
+	err := httpserver.Shutdown(sctx)
+	if err != nil {
+		logging.Error(ctx, "error waiting for requests to finish", "error", err)
+	}
+	// Running jobs are canceled, to be run again at the next start
+	stopJobs()
+	scheduler.Wait()
+	if err == nil {
+		logging.Info(ctx, "server stopped")
+	}
+}
+
+// runMigrate implements the migrate subcommand:
+//
+//	migrate [up]        apply all pending migrations
+//	migrate down [n]    revert the last n migrations (default 1)
+//	migrate status      list migrations and whether they're applied
+//	migrate repair      list rows that violate constraints added by
+//	                    migrations; with -fix, delete or repair them
+func runMigrate(ctx context.Context, cfg *config.Config, db *sql.DB, args []string) {
+	cmd := "up"
+	if len(args) > 0 {
+		cmd = args[0]
+	}
+	switch cmd {
+	case "up":
+		applied, err := migrate.Up(ctx, db)
+		for _, m := range applied {
+			log.Printf("applied %s", m)
+		}
+		if err != nil {
+			log.Fatalf("error migrating: %v\n", err)
+		}
+		if len(applied) == 0 {
+			log.Println("schema is up to date")
+		}
+	case "down":
+		steps := 1
+		if len(args) > 1 {
+			n, err := strconv.Atoi(args[1])
+			if err != nil || n < 1 {
+				log.Fatalf("invalid number of migrations %q", args[1])
+			}
+			steps = n
+		}
+		reverted, err := migrate.Down(ctx, db, steps)
+		for _, m := range reverted {
+			log.Printf("reverted %s", m)
+		}
+		if err != nil {
+			log.Fatalf("error reverting migrations: %v\n", err)
+		}
+	case "status":
+		statuses, err := migrate.Statuses(ctx, db)
+		if err != nil {
+			log.Fatalf("error getting migration status: %v\n", err)
+		}
+		for _, s := range statuses {
+			switch {
+			case s.Modified:
+				log.Printf("%s  applied %s, MODIFIED since", s.Migration, s.AppliedTS.Format("2006-01-02 15:04:05"))
+			case s.Applied:
+				log.Printf("%s  applied %s", s.Migration, s.AppliedTS.Format("2006-01-02 15:04:05"))
+			default:
+				log.Printf("%s  pending", s.Migration)
+			}
+		}
+		err = migrate.Check(ctx, db)
+		if err != nil {
+			log.Println(err)
+		}
+	case "repair":
+		fix := len(args) > 1 && args[1] == "-fix"
+		problems, err := migrate.Repair(ctx, db, fix)
+		if err != nil {
+			log.Fatalf("error repairing data: %v\n", err)
+		}
+		for _, p := range problems {
+			if fix {
+				log.Printf("fixed %d %s", p.Rows, p.Description)
+			} else {
+				log.Printf("found %d %s", p.Rows, p.Description)
+			}
+		}
+		if len(problems) == 0 {
+			log.Println("no problems found")
+		} else if !fix {
+			log.Println("run `migrate repair -fix` to fix them")
+		}
+	default:
+		log.Fatalf("unknown migrate command %q", cmd)
 	}
-	log.Printf("Starting server on port %s", httpserver.Addr)
-	httpserver.ListenAndServe()
 }
 
-// envString returns the value of the named environment variable.
-// If name isn't in the environment os ir empty, it returns value.
-func envString(name, value string) string {
-	if s := os.Getenv(name); s != "" {
-		value = s
+// runUsers implements the users subcommand, for managing API users
+// before there's an admin to do it through the API:
+//
+//	users add NAME ROLE   add a user with the role viewer, editor or
+//	                      admin, and print their token
+//	users revoke NAME     revoke the user's token
+func runUsers(ctx context.Context, cfg *config.Config, db *sql.DB, args []string) {
+	switch {
+	case len(args) == 3 && args[0] == "add":
+		token, err := api.CreateUser(ctx, db, args[1], args[2])
+		if err != nil {
+			log.Fatalf("error adding user: %v\n", err)
+		}
+		fmt.Println(token)
+	case len(args) == 2 && args[0] == "revoke":
+		err := api.RevokeUser(ctx, db, args[1])
+		if err != nil {
+			log.Fatalf("error revoking user: %v\n", err)
+		}
+	default:
+		log.Fatalf("usage: users add NAME ROLE | users revoke NAME")
 	}
-	return value
 }
@@ -0,0 +1,303 @@
+// Package migrate applies versioned schema migrations to the
+// database.
+//
+// Migrations are applied in version order, each in its own
+// transaction, and recorded in the schema_migrations table along
+// with a checksum of their up script so edits to migrations that
+// have already been applied are detected.
+package migrate
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/vickiniu/project-red-string/internal/sqlutil"
+)
+
+// Migration is a single schema change.
+type Migration struct {
+	Version int
+	Name    string
+	Up      string
+	Down    string
+	// Precheck, if set, runs in the migration's transaction before
+	// Up and aborts the migration if it fails.
+	Precheck func(ctx context.Context, tx *sql.Tx) error
+}
+
+// Checksum identifies the contents of the migration's up script.
+func (m Migration) Checksum() string {
+	sum := sha256.Sum256([]byte(m.Up))
+	return hex.EncodeToString(sum[:])
+}
+
+func (m Migration) String() string {
+	return fmt.Sprintf("%04d_%s", m.Version, m.Name)
+}
+
+// Latest returns the version of the newest migration.
+func Latest() int {
+	return Migrations[len(Migrations)-1].Version
+}
+
+// lockID is the advisory lock held while migrating so concurrent
+// runs don't interleave.
+const lockID = 7267746
+
+const createTableQ = `
+	CREATE TABLE IF NOT EXISTS schema_migrations (
+		version integer PRIMARY KEY,
+		name text NOT NULL,
+		checksum text NOT NULL,
+		applied_ts timestamp NOT NULL
+	)
+`
+
+// Status describes a migration and whether it has been applied.
+type Status struct {
+	Migration
+	Applied   bool
+	AppliedTS time.Time
+	// Modified is set when an applied migration's up script has
+	// changed since it was applied.
+	Modified bool
+}
+
+// applied is a row of schema_migrations.
+type applied struct {
+	version   int
+	name      string
+	checksum  string
+	appliedTS time.Time
+}
+
+func appliedMigrations(ctx context.Context, q sqlutil.Querier) (map[int]applied, error) {
+	const appliedQ = `SELECT version, name, checksum, applied_ts FROM schema_migrations`
+	rows, err := q.QueryContext(ctx, appliedQ)
+	if err != nil {
+		return nil, errors.Wrap(err, "querying applied migrations")
+	}
+	defer rows.Close()
+	res := make(map[int]applied)
+	for rows.Next() {
+		var a applied
+		err := rows.Scan(&a.version, &a.name, &a.checksum, &a.appliedTS)
+		if err != nil {
+			return nil, errors.Wrap(err, "scanning migration row")
+		}
+		res[a.version] = a
+	}
+	if err := rows.Err(); err != nil {
+		return nil, errors.Wrap(err, "reading migration rows")
+	}
+	return res, nil
+}
+
+// Statuses returns the status of every known migration.
+func Statuses(ctx context.Context, db *sql.DB) ([]Status, error) {
+	_, err := db.ExecContext(ctx, createTableQ)
+	if err != nil {
+		return nil, errors.Wrap(err, "creating schema_migrations")
+	}
+	done, err := appliedMigrations(ctx, db)
+	if err != nil {
+		return nil, err
+	}
+	var res []Status
+	for _, m := range Migrations {
+		s := Status{Migration: m}
+		if a, ok := done[m.Version]; ok {
+			s.Applied = true
+			s.AppliedTS = a.appliedTS
+			s.Modified = a.checksum != m.Checksum()
+		}
+		res = append(res, s)
+	}
+	return res, nil
+}
+
+// MismatchError reports how the database schema differs from the
+// migrations known to this binary.
+type MismatchError struct {
+	Pending  []int // known migrations that haven't been applied
+	Modified []int // applied migrations whose checksum changed
+	Unknown  []int // applied migrations this binary doesn't know
+}
+
+func (e *MismatchError) Error() string {
+	var parts []string
+	if len(e.Pending) > 0 {
+		parts = append(parts, fmt.Sprintf("pending migrations %v", e.Pending))
+	}
+	if len(e.Modified) > 0 {
+		parts = append(parts, fmt.Sprintf("modified migrations %v", e.Modified))
+	}
+	if len(e.Unknown) > 0 {
+		parts = append(parts, fmt.Sprintf("unknown migrations %v", e.Unknown))
+	}
+	return "schema mismatch: " + strings.Join(parts, ", ")
+}
+
+// Check returns a *MismatchError if the database hasn't had exactly
+// the known migrations applied. It doesn't modify the database.
+func Check(ctx context.Context, db *sql.DB) error {
+	var exists bool
+	const existsQ = `SELECT to_regclass('schema_migrations') IS NOT NULL`
+	err := db.QueryRowContext(ctx, existsQ).Scan(&exists)
+	if err != nil {
+		return errors.Wrap(err, "checking for schema_migrations")
+	}
+	done := make(map[int]applied)
+	if exists {
+		done, err = appliedMigrations(ctx, db)
+		if err != nil {
+			return err
+		}
+	}
+	mismatch := &MismatchError{}
+	known := make(map[int]bool)
+	for _, m := range Migrations {
+		known[m.Version] = true
+		a, ok := done[m.Version]
+		switch {
+		case !ok:
+			mismatch.Pending = append(mismatch.Pending, m.Version)
+		case a.checksum != m.Checksum():
+			mismatch.Modified = append(mismatch.Modified, m.Version)
+		}
+	}
+	for v := range done {
+		if !known[v] {
+			mismatch.Unknown = append(mismatch.Unknown, v)
+		}
+	}
+	if len(mismatch.Pending)+len(mismatch.Modified)+len(mismatch.Unknown) > 0 {
+		return mismatch
+	}
+	return nil
+}
+
+// Up applies every pending migration in order and returns those
+// applied. It refuses to run if an applied migration was modified.
+func Up(ctx context.Context, db *sql.DB) ([]Migration, error) {
+	var res []Migration
+	err := withLock(ctx, db, func(conn *sql.Conn) error {
+		done, err := appliedMigrations(ctx, conn)
+		if err != nil {
+			return err
+		}
+		for _, m := range Migrations {
+			a, ok := done[m.Version]
+			if ok {
+				if a.checksum != m.Checksum() {
+					return fmt.Errorf("migration %s was modified after being applied", m)
+				}
+				continue
+			}
+			err := run(ctx, conn, m.Precheck, m.Up, func(tx *sql.Tx) error {
+				const insertQ = `
+					INSERT INTO schema_migrations (
+						version,
+						name,
+						checksum,
+						applied_ts
+					) VALUES (
+						$1,
+						$2,
+						$3,
+						current_timestamp
+					)
+				`
+				_, err := tx.ExecContext(ctx, insertQ, m.Version, m.Name, m.Checksum())
+				return err
+			})
+			if err != nil {
+				return errors.Wrapf(err, "applying %s", m)
+			}
+			res = append(res, m)
+		}
+		return nil
+	})
+	return res, err
+}
+
+// Down reverts the newest steps applied migrations and returns
+// those reverted.
+func Down(ctx context.Context, db *sql.DB, steps int) ([]Migration, error) {
+	var res []Migration
+	err := withLock(ctx, db, func(conn *sql.Conn) error {
+		done, err := appliedMigrations(ctx, conn)
+		if err != nil {
+			return err
+		}
+		for i := len(Migrations) - 1; i >= 0 && len(res) < steps; i-- {
+			m := Migrations[i]
+			if _, ok := done[m.Version]; !ok {
+				continue
+			}
+			err := run(ctx, conn, nil, m.Down, func(tx *sql.Tx) error {
+				const deleteQ = `DELETE FROM schema_migrations WHERE version = $1`
+				_, err := tx.ExecContext(ctx, deleteQ, m.Version)
+				return err
+			})
+			if err != nil {
+				return errors.Wrapf(err, "reverting %s", m)
+			}
+			res = append(res, m)
+		}
+		return nil
+	})
+	return res, err
+}
+
+// withLock runs fn on a connection holding the migration lock,
+// after ensuring schema_migrations exists.
+func withLock(ctx context.Context, db *sql.DB, fn func(conn *sql.Conn) error) error {
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return errors.Wrap(err, "getting connection")
+	}
+	defer conn.Close()
+	_, err = conn.ExecContext(ctx, `SELECT pg_advisory_lock($1)`, lockID)
+	if err != nil {
+		return errors.Wrap(err, "acquiring migration lock")
+	}
+	defer conn.ExecContext(context.Background(), `SELECT pg_advisory_unlock($1)`, lockID)
+
+	_, err = conn.ExecContext(ctx, createTableQ)
+	if err != nil {
+		return errors.Wrap(err, "creating schema_migrations")
+	}
+	return fn(conn)
+}
+
+// run executes precheck (if set), script and then record in a
+// single transaction.
+func run(ctx context.Context, conn *sql.Conn, precheck func(context.Context, *sql.Tx) error, script string, record func(tx *sql.Tx) error) error {
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		return errors.Wrap(err, "beginning transaction")
+	}
+	defer tx.Rollback()
+	if precheck != nil {
+		err = precheck(ctx, tx)
+		if err != nil {
+			return err
+		}
+	}
+	_, err = tx.ExecContext(ctx, script)
+	if err != nil {
+		return err
+	}
+	err = record(tx)
+	if err != nil {
+		return errors.Wrap(err, "recording migration")
+	}
+	return tx.Commit()
+}
@@ -0,0 +1,195 @@
+package migrate
+
+import (
+	"context"
+	"database/sql"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/vickiniu/project-red-string/internal/testdb"
+)
+
+func TestMain(m *testing.M) {
+	os.Exit(testdb.Run(m))
+}
+
+// catalog lists the columns, constraints and indexes of the tables in
+// db, other than schema_migrations, one per line.
+func catalog(t *testing.T, db *sql.DB) []string {
+	t.Helper()
+	const q = `
+		SELECT 'column ' || table_name || '.' || column_name || ' ' || data_type || ' ' ||
+			is_nullable || ' ' || COALESCE(column_default, '')
+		FROM information_schema.columns
+		WHERE table_schema = 'public'
+		AND table_name <> 'schema_migrations'
+		UNION ALL
+		SELECT 'constraint ' || conrelid::regclass::text || ' ' || conname || ' ' || pg_get_constraintdef(oid)
+		FROM pg_constraint
+		WHERE connamespace = 'public'::regnamespace
+		AND conrelid <> 0
+		AND conrelid::regclass::text <> 'schema_migrations'
+		UNION ALL
+		SELECT 'index ' || indexdef
+		FROM pg_indexes
+		WHERE schemaname = 'public'
+		AND tablename <> 'schema_migrations'
+		UNION ALL
+		SELECT 'sequence ' || sequence_name
+		FROM information_schema.sequences
+		WHERE sequence_schema = 'public'
+		ORDER BY 1
+	`
+	rows, err := db.Query(q)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	var res []string
+	for rows.Next() {
+		var s string
+		if err := rows.Scan(&s); err != nil {
+			t.Fatal(err)
+		}
+		res = append(res, s)
+	}
+	if err := rows.Err(); err != nil {
+		t.Fatal(err)
+	}
+	return res
+}
+
+// compareCatalogs reports the lines in only one of got and want.
+func compareCatalogs(t *testing.T, got, want []string) {
+	t.Helper()
+	if reflect.DeepEqual(got, want) {
+		return
+	}
+	in := func(s string, list []string) bool {
+		for _, l := range list {
+			if l == s {
+				return true
+			}
+		}
+		return false
+	}
+	for _, s := range got {
+		if !in(s, want) {
+			t.Errorf("migrated schema has %s, schema.sql doesn't", s)
+		}
+	}
+	for _, s := range want {
+		if !in(s, got) {
+			t.Errorf("schema.sql has %s, migrated schema doesn't", s)
+		}
+	}
+}
+
+func TestMigrationsMatchSchema(t *testing.T) {
+	ctx := context.Background()
+	schemaDB, cleanup := testdb.New(t)
+	defer cleanup()
+	want := catalog(t, schemaDB)
+
+	db, cleanup := testdb.NewEmpty(t)
+	defer cleanup()
+	applied, err := Up(ctx, db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(applied) != len(Migrations) {
+		t.Errorf("applied %d migrations, want %d", len(applied), len(Migrations))
+	}
+	if err := Check(ctx, db); err != nil {
+		t.Fatal(err)
+	}
+	compareCatalogs(t, catalog(t, db), want)
+
+	// Every migration can be reverted and applied again
+	reverted, err := Down(ctx, db, Latest())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(reverted) != len(Migrations) {
+		t.Errorf("reverted %d migrations, want %d", len(reverted), len(Migrations))
+	}
+	if got := catalog(t, db); len(got) != 0 {
+		t.Errorf("got %v after reverting every migration, want nothing", got)
+	}
+	_, err = Up(ctx, db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	compareCatalogs(t, catalog(t, db), want)
+}
+
+func TestModifiedMigration(t *testing.T) {
+	ctx := context.Background()
+	db, cleanup := testdb.NewEmpty(t)
+	defer cleanup()
+	_, err := Up(ctx, db)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = db.Exec(`UPDATE schema_migrations SET checksum = 'edited' WHERE version = 1`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = Check(ctx, db)
+	var mismatch *MismatchError
+	if !errors.As(err, &mismatch) || !reflect.DeepEqual(mismatch.Modified, []int{1}) {
+		t.Errorf("got error %v, want migration 1 modified", err)
+	}
+	_, err = Up(ctx, db)
+	if err == nil || !strings.Contains(err.Error(), "was modified") {
+		t.Errorf("got error %v, want Up to refuse to run", err)
+	}
+}
+
+func TestPrecheck(t *testing.T) {
+	ctx := context.Background()
+	db, cleanup := testdb.NewEmpty(t)
+	defer cleanup()
+
+	// Apply the migrations before referential_integrity, then add
+	// an association with no individual
+	all := Migrations
+	Migrations = all[:4]
+	_, err := Up(ctx, db)
+	Migrations = all
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.Exec(`
+		INSERT INTO associations (id, description) VALUES ('1', 'Tenants Union');
+		INSERT INTO individual_associations (individual_id, association_id, updated_ts)
+		VALUES ('404', '1', current_timestamp);
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	applied, err := Up(ctx, db)
+	if err == nil || !strings.Contains(err.Error(), "migrate repair") {
+		t.Errorf("got error %v, want the precheck to fail", err)
+	}
+	if len(applied) != 0 {
+		t.Errorf("applied %v, want nothing", applied)
+	}
+
+	problems, err := Repair(ctx, db, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(problems) != 1 || problems[0].Rows != 1 {
+		t.Errorf("got problems %+v, want the one association fixed", problems)
+	}
+	_, err = Up(ctx, db)
+	if err != nil {
+		t.Errorf("got error %v after repairing", err)
+	}
+}
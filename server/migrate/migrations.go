@@ -0,0 +1,484 @@
+package migrate
+
+// Migrations are all schema migrations in version order. Never edit
+// a migration once it has been applied anywhere; add a new one.
+// schema.sql at the repository root should always reflect the schema
+// after every migration has been applied.
+var Migrations = []Migration{
+	{
+		Version: 1,
+		Name:    "initial",
+		// The original schema.sql. IF NOT EXISTS lets databases
+		// created from it adopt migrations.
+		Up: `
+		CREATE SEQUENCE
+		IF NOT EXISTS next_id
+			START WITH 1
+			INCREMENT BY 1
+			NO MINVALUE
+			NO MAXVALUE
+			CACHE 1;
+
+		CREATE TABLE IF NOT EXISTS individuals (
+			id text DEFAULT nextval('next_id') PRIMARY KEY,
+			first_name text NOT NULL,
+			last_name text NOT NULL,
+			-- cfb_name is the name formatted to match CFB
+			-- filings in "Last, First" format
+			cfb_name text NOT NULL,
+			-- TODO: make a search_name column (?)
+			zip text,
+			updated_ts timestamp NOT NULL,
+			role text,
+			title text,
+			twitter text
+			-- TODO: add other fields
+		);
+
+		CREATE TABLE IF NOT EXISTS associations (
+			id text DEFAULT nextval('next_id') PRIMARY KEY,
+			description text NOT NULL,
+			category_id text
+		);
+
+		CREATE TABLE IF NOT EXISTS categories (
+			id text DEFAULT nextval('next_id') PRIMARY KEY,
+			description text NOT NULL
+		);
+
+		CREATE TABLE IF NOT EXISTS individual_associations (
+			individual_id text NOT NULL,
+			association_id text NOT NULL,
+			updated_ts timestamp NOT NULL
+		);
+
+		CREATE TABLE IF NOT EXISTS contributions (
+			id text DEFAULT nextval('next_id') PRIMARY KEY,
+			-- reference number from CFB
+			refno text NOT NULL,
+			-- amount denominated in cents
+			amount integer NOT NULL,
+			date timestamp NOT NULL,
+			-- contributor_name as reported in CFB filing
+			contributor_name text NOT NULL,
+			-- contributor id (individuals table)
+			contributor_id text NOT NULL,
+			-- recipient_name as reported in CFB filing
+			recipient_name text NOT NULL,
+			-- recipient id (individuals table)
+			recipient_id text,
+			-- CFB gives each recipient a recipient ID, so note this.
+			cfb_recipient_id text NOT NULL,
+
+			-- Other contribution data from CFB
+			election TEXT NOT NULL,
+			office_cd TEXT,
+			can_class TEXT,
+			committee TEXT,
+			filing INT,
+			schedule TEXT,
+			c_code TEXT,
+
+			borough text,
+			city text NOT NULL,
+			state text NOT NULL,
+			zip text NOT NULL,
+			occupation text,
+			employer_name text
+		);
+		`,
+		Down: `
+		DROP TABLE IF EXISTS contributions;
+		DROP TABLE IF EXISTS individual_associations;
+		DROP TABLE IF EXISTS categories;
+		DROP TABLE IF EXISTS associations;
+		DROP TABLE IF EXISTS individuals;
+		DROP SEQUENCE IF EXISTS next_id;
+		`,
+	},
+	{
+		Version: 2,
+		Name:    "airtable_record_ids",
+		Up: `
+		ALTER TABLE individuals ADD COLUMN IF NOT EXISTS airtable_id text UNIQUE;
+		`,
+		Down: `
+		ALTER TABLE individuals DROP COLUMN IF EXISTS airtable_id;
+		`,
+	},
+	{
+		Version: 3,
+		Name:    "annotation_fields",
+		Up: `
+		ALTER TABLE individuals ADD COLUMN IF NOT EXISTS notes text;
+		ALTER TABLE individuals ADD COLUMN IF NOT EXISTS source_urls text[];
+		`,
+		Down: `
+		ALTER TABLE individuals DROP COLUMN IF EXISTS source_urls;
+		ALTER TABLE individuals DROP COLUMN IF EXISTS notes;
+		`,
+	},
+	{
+		Version: 4,
+		Name:    "association_categories",
+		Up: `
+		ALTER TABLE categories ADD COLUMN IF NOT EXISTS airtable_id text UNIQUE;
+
+		CREATE TABLE IF NOT EXISTS association_categories (
+			association_id text NOT NULL,
+			category_id text NOT NULL,
+			updated_ts timestamp NOT NULL
+		);
+
+		-- Carry over categories set by hand on associations
+		INSERT INTO association_categories (association_id, category_id, updated_ts)
+		SELECT id, category_id, current_timestamp
+		FROM associations
+		WHERE category_id IS NOT NULL AND NOT EXISTS (
+			SELECT 1
+			FROM association_categories
+			WHERE association_categories.association_id = associations.id
+			AND association_categories.category_id = associations.category_id
+		);
+		`,
+		Down: `
+		DROP TABLE IF EXISTS association_categories;
+		ALTER TABLE categories DROP COLUMN IF EXISTS airtable_id;
+		`,
+	},
+	{
+		Version:  5,
+		Name:     "referential_integrity",
+		Precheck: checkRepaired,
+		Up: `
+		UPDATE contributions SET recipient_id = NULL WHERE recipient_id = '';
+
+		ALTER TABLE individual_associations
+			ADD PRIMARY KEY (individual_id, association_id),
+			ADD FOREIGN KEY (individual_id) REFERENCES individuals (id) ON DELETE CASCADE,
+			ADD FOREIGN KEY (association_id) REFERENCES associations (id) ON DELETE CASCADE;
+
+		ALTER TABLE association_categories
+			ADD PRIMARY KEY (association_id, category_id),
+			ADD FOREIGN KEY (association_id) REFERENCES associations (id) ON DELETE CASCADE,
+			ADD FOREIGN KEY (category_id) REFERENCES categories (id) ON DELETE CASCADE;
+
+		ALTER TABLE associations
+			ADD FOREIGN KEY (category_id) REFERENCES categories (id) ON DELETE SET NULL;
+
+		ALTER TABLE contributions
+			ADD UNIQUE (refno),
+			ADD FOREIGN KEY (contributor_id) REFERENCES individuals (id),
+			ADD FOREIGN KEY (recipient_id) REFERENCES individuals (id);
+
+		CREATE INDEX ON individuals (cfb_name);
+		CREATE INDEX ON individuals (first_name, last_name);
+		CREATE INDEX ON associations (description);
+		CREATE INDEX ON associations (category_id);
+		CREATE INDEX ON individual_associations (association_id);
+		CREATE INDEX ON association_categories (category_id);
+		CREATE INDEX ON contributions (contributor_id);
+		CREATE INDEX ON contributions (recipient_id);
+		`,
+		Down: `
+		DROP INDEX IF EXISTS individuals_cfb_name_idx;
+		DROP INDEX IF EXISTS individuals_first_name_last_name_idx;
+		DROP INDEX IF EXISTS associations_description_idx;
+		DROP INDEX IF EXISTS associations_category_id_idx;
+		DROP INDEX IF EXISTS individual_associations_association_id_idx;
+		DROP INDEX IF EXISTS association_categories_category_id_idx;
+		DROP INDEX IF EXISTS contributions_contributor_id_idx;
+		DROP INDEX IF EXISTS contributions_recipient_id_idx;
+
+		ALTER TABLE contributions
+			DROP CONSTRAINT IF EXISTS contributions_refno_key,
+			DROP CONSTRAINT IF EXISTS contributions_contributor_id_fkey,
+			DROP CONSTRAINT IF EXISTS contributions_recipient_id_fkey;
+		ALTER TABLE associations
+			DROP CONSTRAINT IF EXISTS associations_category_id_fkey;
+		ALTER TABLE association_categories
+			DROP CONSTRAINT IF EXISTS association_categories_pkey,
+			DROP CONSTRAINT IF EXISTS association_categories_association_id_fkey,
+			DROP CONSTRAINT IF EXISTS association_categories_category_id_fkey;
+		ALTER TABLE individual_associations
+			DROP CONSTRAINT IF EXISTS individual_associations_pkey,
+			DROP CONSTRAINT IF EXISTS individual_associations_individual_id_fkey,
+			DROP CONSTRAINT IF EXISTS individual_associations_association_id_fkey;
+		`,
+	},
+	{
+		Version: 6,
+		Name:    "provenance",
+		Up: `
+		CREATE TABLE sources (
+			id text DEFAULT nextval('next_id') PRIMARY KEY,
+			source_type text NOT NULL,
+			url text,
+			airtable_record_id text,
+			file text,
+			cfb_refno text,
+			note text,
+			added_by text NOT NULL,
+			added_ts timestamp NOT NULL
+		);
+
+		ALTER TABLE individuals ADD COLUMN source_id text REFERENCES sources (id);
+		ALTER TABLE associations ADD COLUMN source_id text REFERENCES sources (id);
+		ALTER TABLE individual_associations ADD COLUMN source_id text REFERENCES sources (id);
+		ALTER TABLE contributions
+			ADD COLUMN contributor_source_id text REFERENCES sources (id),
+			ADD COLUMN recipient_source_id text REFERENCES sources (id);
+		`,
+		Down: `
+		ALTER TABLE contributions
+			DROP COLUMN contributor_source_id,
+			DROP COLUMN recipient_source_id;
+		ALTER TABLE individual_associations DROP COLUMN source_id;
+		ALTER TABLE associations DROP COLUMN source_id;
+		ALTER TABLE individuals DROP COLUMN source_id;
+		DROP TABLE sources;
+		`,
+	},
+	{
+		Version: 7,
+		Name:    "role_history",
+		Up: `
+		ALTER TABLE individual_associations
+			ADD COLUMN start_date date,
+			ADD COLUMN end_date date;
+
+		CREATE TABLE individual_roles (
+			id text DEFAULT nextval('next_id') PRIMARY KEY,
+			individual_id text NOT NULL REFERENCES individuals (id) ON DELETE CASCADE,
+			role text,
+			title text,
+			start_date date,
+			end_date date,
+			source_id text REFERENCES sources (id),
+			updated_ts timestamp NOT NULL
+		);
+		CREATE INDEX ON individual_roles (individual_id);
+
+		-- Everyone's current role, with an unknown start date
+		INSERT INTO individual_roles (individual_id, role, title, source_id, updated_ts)
+		SELECT id, NULLIF(role, ''), NULLIF(title, ''), source_id, updated_ts
+		FROM individuals
+		WHERE COALESCE(role, '') <> '' OR COALESCE(title, '') <> '';
+		`,
+		Down: `
+		DROP TABLE individual_roles;
+		ALTER TABLE individual_associations
+			DROP COLUMN start_date,
+			DROP COLUMN end_date;
+		`,
+	},
+	{
+		Version: 8,
+		Name:    "audit_log",
+		Up: `
+		CREATE TABLE audit_runs (
+			id text DEFAULT nextval('next_id') PRIMARY KEY,
+			command text NOT NULL,
+			actor text NOT NULL,
+			started_ts timestamp NOT NULL
+		);
+
+		CREATE TABLE audit_log (
+			id bigserial PRIMARY KEY,
+			run_id text NOT NULL REFERENCES audit_runs (id),
+			entity_type text NOT NULL,
+			entity_id text NOT NULL,
+			individual_id text,
+			field text NOT NULL,
+			old_value text,
+			new_value text,
+			actor text NOT NULL,
+			source_id text REFERENCES sources (id),
+			changed_ts timestamp NOT NULL
+		);
+		CREATE INDEX ON audit_log (individual_id);
+		CREATE INDEX ON audit_log (run_id);
+		`,
+		Down: `
+		DROP TABLE audit_log;
+		DROP TABLE audit_runs;
+		`,
+	},
+	{
+		Version: 9,
+		Name:    "api_users",
+		Up: `
+		CREATE TABLE api_users (
+			id text DEFAULT nextval('next_id') PRIMARY KEY,
+			name text NOT NULL UNIQUE,
+			role text NOT NULL CHECK (role IN ('viewer', 'editor', 'admin')),
+			token_hash text NOT NULL UNIQUE,
+			created_ts timestamp NOT NULL,
+			revoked_ts timestamp
+		);
+		`,
+		Down: `
+		DROP TABLE api_users;
+		`,
+	},
+	{
+		Version: 10,
+		Name:    "merges",
+		Up: `
+		CREATE TABLE individual_aliases (
+			id text DEFAULT nextval('next_id') PRIMARY KEY,
+			individual_id text NOT NULL REFERENCES individuals (id) ON DELETE CASCADE,
+			first_name text NOT NULL,
+			last_name text NOT NULL,
+			cfb_name text NOT NULL,
+			source_id text REFERENCES sources (id)
+		);
+		CREATE INDEX ON individual_aliases (individual_id);
+		CREATE INDEX ON individual_aliases (cfb_name);
+
+		CREATE TABLE individual_redirects (
+			from_id text PRIMARY KEY,
+			to_id text NOT NULL REFERENCES individuals (id) ON DELETE CASCADE
+		);
+		CREATE INDEX ON individual_redirects (to_id);
+
+		CREATE TABLE individual_merges (
+			id text DEFAULT nextval('next_id') PRIMARY KEY,
+			from_id text NOT NULL,
+			into_id text NOT NULL,
+			individual json NOT NULL,
+			associations json NOT NULL,
+			contributor_ids text[] NOT NULL,
+			recipient_ids text[] NOT NULL,
+			added_association_ids text[] NOT NULL,
+			role_ids text[] NOT NULL,
+			alias_ids text[] NOT NULL,
+			added_alias_id text,
+			redirect_ids text[] NOT NULL,
+			filled_columns text[] NOT NULL,
+			run_id text REFERENCES audit_runs (id),
+			merged_ts timestamp NOT NULL,
+			split_ts timestamp
+		);
+		CREATE INDEX ON individual_merges (from_id);
+		`,
+		Down: `
+		DROP TABLE individual_merges;
+		DROP TABLE individual_redirects;
+		DROP TABLE individual_aliases;
+		`,
+	},
+	{
+		Version: 11,
+		Name:    "api_keys",
+		Up: `
+		CREATE TABLE api_keys (
+			id text DEFAULT nextval('next_id') PRIMARY KEY,
+			name text NOT NULL,
+			key_hash text NOT NULL UNIQUE,
+			rate_per_minute integer NOT NULL,
+			daily_quota integer,
+			created_by text NOT NULL,
+			created_ts timestamp NOT NULL,
+			revoked_ts timestamp
+		);
+		`,
+		Down: `
+		DROP TABLE api_keys;
+		`,
+	},
+	{
+		Version: 12,
+		Name:    "data_version",
+		Up: `
+		CREATE TABLE data_version (
+			id boolean PRIMARY KEY DEFAULT true CHECK (id),
+			version bigint NOT NULL,
+			updated_ts timestamp NOT NULL
+		);
+		INSERT INTO data_version (version, updated_ts) VALUES (1, current_timestamp);
+		`,
+		Down: `
+		DROP TABLE data_version;
+		`,
+	},
+	{
+		Version: 13,
+		Name:    "job_runs",
+		Up: `
+		CREATE TABLE job_runs (
+			id text DEFAULT nextval('next_id') PRIMARY KEY,
+			job text NOT NULL,
+			target text,
+			status text NOT NULL CHECK (status IN ('running', 'succeeded', 'failed')),
+			counts json NOT NULL,
+			error text,
+			started_ts timestamp NOT NULL,
+			finished_ts timestamp
+		);
+		CREATE INDEX ON job_runs (job, started_ts);
+		`,
+		Down: `
+		DROP TABLE job_runs;
+		`,
+	},
+	{
+		Version: 14,
+		Name:    "cfb_downloads",
+		Up: `
+		CREATE TABLE cfb_downloads (
+			sha256 text PRIMARY KEY,
+			url text NOT NULL,
+			file text NOT NULL,
+			size bigint NOT NULL,
+			downloaded_ts timestamp NOT NULL
+		);
+		`,
+		Down: `
+		DROP TABLE cfb_downloads;
+		`,
+	},
+	{
+		Version: 15,
+		Name:    "cfb_imports",
+		Up: `
+		CREATE TABLE cfb_imports (
+			id text DEFAULT nextval('next_id') PRIMARY KEY,
+			file text NOT NULL,
+			status text NOT NULL CHECK (status IN ('running', 'succeeded', 'failed')),
+			rows_read integer NOT NULL DEFAULT 0,
+			rows_inserted integer NOT NULL DEFAULT 0,
+			rows_skipped integer NOT NULL DEFAULT 0,
+			rows_errored integer NOT NULL DEFAULT 0,
+			contributor_match_rate double precision NOT NULL DEFAULT 0,
+			recipient_match_rate double precision NOT NULL DEFAULT 0,
+			unmatched_recipients integer NOT NULL DEFAULT 0,
+			error text,
+			started_ts timestamp NOT NULL,
+			finished_ts timestamp
+		);
+		CREATE INDEX ON cfb_imports (started_ts);
+		CREATE TABLE cfb_import_errors (
+			import_id text NOT NULL REFERENCES cfb_imports (id) ON DELETE CASCADE,
+			row_number integer NOT NULL,
+			refno text,
+			error text NOT NULL,
+			PRIMARY KEY (import_id, row_number)
+		);
+		`,
+		Down: `
+		DROP TABLE cfb_import_errors;
+		DROP TABLE cfb_imports;
+		`,
+	},
+	{
+		Version: 16,
+		Name:    "job_runs_checksum",
+		Up: `
+		ALTER TABLE job_runs ADD COLUMN checksum text;
+		`,
+		Down: `
+		ALTER TABLE job_runs DROP COLUMN checksum;
+		`,
+	},
+}
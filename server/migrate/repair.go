@@ -0,0 +1,190 @@
+package migrate
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/pkg/errors"
+)
+
+// Problem is a kind of bad data found by Repair, with the number
+// of rows affected.
+type Problem struct {
+	Description string
+	Rows        int64
+}
+
+// repairCheck finds and fixes one kind of row that would violate
+// the constraints added by the referential_integrity migration.
+type repairCheck struct {
+	description string
+	count       string
+	fix         string
+}
+
+var repairChecks = []repairCheck{
+	{
+		description: "individual associations with a missing individual or association",
+		count: `
+			SELECT count(*) FROM individual_associations
+			WHERE individual_id NOT IN (SELECT id FROM individuals)
+			OR association_id NOT IN (SELECT id FROM associations)
+		`,
+		fix: `
+			DELETE FROM individual_associations
+			WHERE individual_id NOT IN (SELECT id FROM individuals)
+			OR association_id NOT IN (SELECT id FROM associations)
+		`,
+	},
+	{
+		description: "duplicate individual associations",
+		count: `
+			SELECT count(*) - count(DISTINCT (individual_id, association_id))
+			FROM individual_associations
+		`,
+		fix: `
+			DELETE FROM individual_associations a
+			USING individual_associations b
+			WHERE a.individual_id = b.individual_id
+			AND a.association_id = b.association_id
+			AND a.ctid > b.ctid
+		`,
+	},
+	{
+		description: "association categories with a missing association or category",
+		count: `
+			SELECT count(*) FROM association_categories
+			WHERE association_id NOT IN (SELECT id FROM associations)
+			OR category_id NOT IN (SELECT id FROM categories)
+		`,
+		fix: `
+			DELETE FROM association_categories
+			WHERE association_id NOT IN (SELECT id FROM associations)
+			OR category_id NOT IN (SELECT id FROM categories)
+		`,
+	},
+	{
+		description: "duplicate association categories",
+		count: `
+			SELECT count(*) - count(DISTINCT (association_id, category_id))
+			FROM association_categories
+		`,
+		fix: `
+			DELETE FROM association_categories a
+			USING association_categories b
+			WHERE a.association_id = b.association_id
+			AND a.category_id = b.category_id
+			AND a.ctid > b.ctid
+		`,
+	},
+	{
+		description: "associations with a missing category",
+		count: `
+			SELECT count(*) FROM associations
+			WHERE category_id NOT IN (SELECT id FROM categories)
+		`,
+		fix: `
+			UPDATE associations SET category_id = NULL
+			WHERE category_id NOT IN (SELECT id FROM categories)
+		`,
+	},
+	{
+		// Empty recipients are cleared by the migration itself.
+		description: "contributions with a missing recipient",
+		count: `
+			SELECT count(*) FROM contributions
+			WHERE recipient_id <> '' AND recipient_id NOT IN (SELECT id FROM individuals)
+		`,
+		fix: `
+			UPDATE contributions SET recipient_id = NULL
+			WHERE recipient_id <> '' AND recipient_id NOT IN (SELECT id FROM individuals)
+		`,
+	},
+	{
+		// Contributions are only imported for known contributors,
+		// so these are dropped and reimported if the contributor
+		// is added back.
+		description: "contributions with a missing contributor",
+		count: `
+			SELECT count(*) FROM contributions
+			WHERE contributor_id NOT IN (SELECT id FROM individuals)
+		`,
+		fix: `
+			DELETE FROM contributions
+			WHERE contributor_id NOT IN (SELECT id FROM individuals)
+		`,
+	},
+	{
+		description: "contributions with a duplicate refno",
+		count: `
+			SELECT count(*) - count(DISTINCT refno) FROM contributions
+		`,
+		fix: `
+			DELETE FROM contributions a
+			USING contributions b
+			WHERE a.refno = b.refno
+			AND a.ctid > b.ctid
+		`,
+	},
+}
+
+// Repair finds orphaned and duplicate rows that would prevent the
+// referential_integrity migration from being applied. If fix is
+// set, they're deleted (or their dangling references cleared) in a
+// single transaction. It returns the problems found either way.
+func Repair(ctx context.Context, db *sql.DB, fix bool) ([]Problem, error) {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, errors.Wrap(err, "beginning transaction")
+	}
+	defer tx.Rollback()
+	problems, err := repair(ctx, tx, fix)
+	if err != nil {
+		return nil, err
+	}
+	if fix {
+		err = tx.Commit()
+		if err != nil {
+			return nil, errors.Wrap(err, "committing repairs")
+		}
+	}
+	return problems, nil
+}
+
+func repair(ctx context.Context, tx *sql.Tx, fix bool) ([]Problem, error) {
+	var problems []Problem
+	for _, c := range repairChecks {
+		p := Problem{Description: c.description}
+		err := tx.QueryRowContext(ctx, c.count).Scan(&p.Rows)
+		if err != nil {
+			return nil, errors.Wrapf(err, "counting %s", c.description)
+		}
+		if p.Rows == 0 {
+			continue
+		}
+		problems = append(problems, p)
+		if fix {
+			_, err := tx.ExecContext(ctx, c.fix)
+			if err != nil {
+				return nil, errors.Wrapf(err, "fixing %s", c.description)
+			}
+		}
+	}
+	return problems, nil
+}
+
+// checkRepaired fails if there are rows Repair would fix.
+func checkRepaired(ctx context.Context, tx *sql.Tx) error {
+	problems, err := repair(ctx, tx, false)
+	if err != nil {
+		return err
+	}
+	if len(problems) > 0 {
+		var total int64
+		for _, p := range problems {
+			total += p.Rows
+		}
+		return errors.Errorf("found %d rows violating constraints, run `migrate repair` to see and fix them", total)
+	}
+	return nil
+}
@@ -0,0 +1,87 @@
+// Package provenance records where facts in the database came from.
+//
+// Each fact (an individual, an association, an individual's
+// association or a contribution's match to an individual) points at
+// a row in the sources table describing the source it was taken
+// from, who added it and when.
+package provenance
+
+import (
+	"context"
+	"os"
+
+	"github.com/pkg/errors"
+	"github.com/vickiniu/project-red-string/internal/sqlutil"
+)
+
+// Source types
+const (
+	// TypeAirtable is an annotation synced from Airtable.
+	TypeAirtable = "airtable"
+	// TypeFile is an annotation imported from an exported file.
+	TypeFile = "file"
+	// TypeCFB is a contribution matched to an individual during a
+	// CFB import.
+	TypeCFB = "cfb"
+	// TypeManual is a fact entered by hand.
+	TypeManual = "manual"
+)
+
+// Source describes where a fact came from. Empty fields are stored
+// as NULL.
+type Source struct {
+	Type             string
+	URL              string
+	AirtableRecordID string
+	File             string
+	CFBRefNo         string
+	Note             string
+	AddedBy          string
+}
+
+// Insert records s and returns its ID.
+func Insert(ctx context.Context, db sqlutil.Querier, s Source) (string, error) {
+	if s.AddedBy == "" {
+		s.AddedBy = Actor()
+	}
+	const insertQ = `
+		INSERT INTO sources (
+			source_type,
+			url,
+			airtable_record_id,
+			file,
+			cfb_refno,
+			note,
+			added_by,
+			added_ts
+		) VALUES (
+			$1,
+			$2,
+			$3,
+			$4,
+			$5,
+			$6,
+			$7,
+			current_timestamp
+		) RETURNING id
+	`
+	var id string
+	err := db.QueryRowContext(
+		ctx, insertQ, s.Type, sqlutil.NullString(s.URL), sqlutil.NullString(s.AirtableRecordID), sqlutil.NullString(s.File), sqlutil.NullString(s.CFBRefNo), sqlutil.NullString(s.Note), s.AddedBy,
+	).Scan(&id)
+	if err != nil {
+		return "", errors.Wrap(err, "inserting source")
+	}
+	return id, nil
+}
+
+// Actor returns who is running the current command, from the ACTOR
+// environment variable or else the system user.
+func Actor() string {
+	for _, name := range []string{"ACTOR", "USER"} {
+		if s := os.Getenv(name); s != "" {
+			return s
+		}
+	}
+	return "unknown"
+}